@@ -0,0 +1,115 @@
+package ocp
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/rest"
+)
+
+// Ways to authenticate to the cluster.
+const (
+	// AuthKubeconfig uses the kubeconfig, or the pod's service account.
+	// OIDC and other single sign-on logins go through it, with an exec
+	// credential plugin such as kubelogin in the kubeconfig user.
+	AuthKubeconfig = "kubeconfig"
+	// AuthToken sends a bearer token, e.g. of a service account.
+	AuthToken = "token"
+	// AuthPassword logs in with a username and password through the
+	// OpenShift OAuth server.
+	AuthPassword = "password"
+	// AuthLabNFS logs in to a lab cluster as kubeadmin with the password
+	// from its install directory on an NFS share, which it mounts with
+	// sudo.
+	AuthLabNFS = "lab-nfs"
+)
+
+// AuthMethods lists the valid values of AuthOptions.Method.
+var AuthMethods = []string{AuthKubeconfig, AuthToken, AuthPassword, AuthLabNFS}
+
+// AuthOptions say how to reach the cluster and authenticate to it.
+type AuthOptions struct {
+	Method string
+	// KubeContext selects a kubeconfig context for AuthKubeconfig.
+	KubeContext string
+	// APIURL is the API server for AuthToken and AuthPassword; a token
+	// without it is used against the cluster the pod runs in.
+	APIURL string
+	// Token, or the file holding it, for AuthToken.
+	Token     string
+	TokenFile string
+	// Username and Password for AuthPassword.
+	Username string
+	Password string
+	// CAFile verifies the API server; without it the system roots do.
+	// Insecure skips the verification for every method and is only meant
+	// for labs.
+	CAFile   string
+	Insecure bool
+	// Lab holds the settings of AuthLabNFS.
+	Lab LabOptions
+}
+
+// LabOptions locate the install directory of a lab cluster.
+type LabOptions struct {
+	ClusterName   string
+	MountBasePath string
+	NFSServerPath string
+}
+
+// ClusterConfig returns the client config opts describe, logging in first
+// where the method needs it.
+func ClusterConfig(opts AuthOptions) (*rest.Config, error) {
+	switch opts.Method {
+	case "", AuthKubeconfig:
+		return KubeConfig(opts.KubeContext)
+	case AuthToken:
+		return tokenConfig(opts)
+	case AuthPassword:
+		if opts.APIURL == "" || opts.Username == "" || opts.Password == "" {
+			return nil, fmt.Errorf("password authentication needs the API URL, a username and a password")
+		}
+		config := &rest.Config{Host: opts.APIURL, TLSClientConfig: tlsConfig(opts)}
+		token, err := requestOAuthToken(config, opts.Username, opts.Password)
+		if err != nil {
+			return nil, fmt.Errorf("login as %s failed: %w", opts.Username, err)
+		}
+		config.BearerToken = token
+		return config, nil
+	case AuthLabNFS:
+		return LoginToCluster(opts)
+	}
+	return nil, fmt.Errorf("unknown authentication method %q (expected %s)", opts.Method, strings.Join(AuthMethods, ", "))
+}
+
+// tokenConfig uses the token of opts against the API URL, or against the
+// cluster the pod runs in when there is no URL.
+func tokenConfig(opts AuthOptions) (*rest.Config, error) {
+	token := opts.Token
+	if token == "" && opts.TokenFile != "" {
+		content, err := os.ReadFile(opts.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %w", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token == "" {
+		return nil, fmt.Errorf("token authentication needs a token or a token file")
+	}
+
+	if opts.APIURL == "" {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("token authentication needs the API URL outside of a cluster: %w", err)
+		}
+		config.BearerToken, config.BearerTokenFile = token, ""
+		return config, nil
+	}
+	return &rest.Config{Host: opts.APIURL, BearerToken: token, TLSClientConfig: tlsConfig(opts)}, nil
+}
+
+// tlsConfig verifies the API server with the CA of opts.
+func tlsConfig(opts AuthOptions) rest.TLSClientConfig {
+	return rest.TLSClientConfig{CAFile: opts.CAFile, Insecure: opts.Insecure}
+}
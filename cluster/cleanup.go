@@ -0,0 +1,68 @@
+package ocp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// cleanupKinds are the kinds a run creates, in the order they are deleted:
+// a Migration before its Plan, the Plan before the maps and the provider
+// it uses.
+var cleanupKinds = []string{"Migration", "Plan", "NetworkMap", "StorageMap", "Provider", "Secret"}
+
+// Cleanup deletes every object the run runID created in namespace. The
+// migrated VMs are kept unless deleteVMs is set. It returns the number of
+// objects deleted; an error on one object does not stop the others.
+func Cleanup(ctx context.Context, c *Client, namespace, runID string, deleteVMs bool) (int, error) {
+	selector := RunSelector(runID)
+	deleted := 0
+	var errs []error
+	for _, kind := range cleanupKinds {
+		if kind == "Plan" && deleteVMs {
+			n, err := deletePlanVMs(ctx, c, namespace, selector)
+			deleted += n
+			errs = append(errs, err)
+		}
+		n, err := deleteObjects(ctx, c, kind, namespace, selector)
+		deleted += n
+		errs = append(errs, err)
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// deletePlanVMs deletes the VMs migrated by the plans matching selector.
+func deletePlanVMs(ctx context.Context, c *Client, namespace, selector string) (int, error) {
+	plans, err := c.List(ctx, "Plan", namespace, selector)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	var errs []error
+	for _, plan := range plans {
+		// Forklift labels the VMs it creates with the UID of their plan
+		n, err := deleteObjects(ctx, c, "VirtualMachine", namespace, "plan="+string(plan.GetUID()))
+		deleted += n
+		errs = append(errs, err)
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// deleteObjects deletes the objects of kind in namespace matching selector.
+func deleteObjects(ctx context.Context, c *Client, kind, namespace, selector string) (int, error) {
+	objects, err := c.List(ctx, kind, namespace, selector)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	var errs []error
+	for _, obj := range objects {
+		if err := c.Delete(ctx, kind, namespace, obj.GetName()); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("Deleted", "kind", kind, "name", obj.GetName())
+		deleted++
+	}
+	return deleted, errors.Join(errs...)
+}
@@ -0,0 +1,213 @@
+package ocp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// fieldManager owns the fields this tool sets with server-side apply.
+const fieldManager = "hyperv-to-ova"
+
+const forkliftGroup = "forklift.konveyor.io"
+
+// resources maps the kinds the migration creates to their API resources.
+var resources = map[string]schema.GroupVersionResource{
+	"Secret":     {Version: "v1", Resource: "secrets"},
+	"Provider":   {Group: forkliftGroup, Version: "v1beta1", Resource: "providers"},
+	"NetworkMap": {Group: forkliftGroup, Version: "v1beta1", Resource: "networkmaps"},
+	"StorageMap": {Group: forkliftGroup, Version: "v1beta1", Resource: "storagemaps"},
+	"Plan":       {Group: forkliftGroup, Version: "v1beta1", Resource: "plans"},
+	"Migration":  {Group: forkliftGroup, Version: "v1beta1", Resource: "migrations"},
+	"Route":      {Group: "route.openshift.io", Version: "v1", Resource: "routes"},
+	// VirtualMachine is what a migration creates in the target namespace
+	"VirtualMachine": {Group: "kubevirt.io", Version: "v1", Resource: "virtualmachines"},
+	// NetworkAttachmentDefinition is a Multus network a VM can be mapped to
+	"NetworkAttachmentDefinition": {Group: "k8s.cni.cncf.io", Version: "v1", Resource: "network-attachment-definitions"},
+	// StorageClass is cluster scoped; disks are mapped to one
+	"StorageClass": {Group: "storage.k8s.io", Version: "v1", Resource: "storageclasses"},
+	// Pods and events explain a migration that failed
+	"Pod":   {Version: "v1", Resource: "pods"},
+	"Event": {Version: "v1", Resource: "events"},
+}
+
+// Client creates and reads the Forklift objects of a migration.
+type Client struct {
+	dyn    dynamic.Interface
+	host   string
+	config *rest.Config
+}
+
+// NewClient returns a client for the cluster config points to.
+func NewClient(config *rest.Config) (*Client, error) {
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+	return &Client{dyn: dyn, host: config.Host, config: config}, nil
+}
+
+// NewClientFor wraps an existing dynamic client, e.g. a fake one.
+func NewClientFor(dyn dynamic.Interface) *Client {
+	return &Client{dyn: dyn}
+}
+
+// Host is the API server the client talks to.
+func (c *Client) Host() string {
+	return c.host
+}
+
+// KubeConfig loads the client config the way kubectl does: the files in
+// KUBECONFIG, else ~/.kube/config, with kubeContext overriding the current
+// context. Without any kubeconfig the in-cluster service account is used.
+func KubeConfig(kubeContext string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err == nil {
+		return config, nil
+	}
+	if clientcmd.IsEmptyConfig(err) && kubeContext == "" {
+		if inCluster, icErr := rest.InClusterConfig(); icErr == nil {
+			return inCluster, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+}
+
+// Apply creates or updates obj with server-side apply and returns the
+// object as stored.
+func (c *Client) Apply(ctx context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	gvr, ok := resources[obj.GetKind()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %q", obj.GetKind())
+	}
+	applied, err := c.dyn.Resource(gvr).Namespace(obj.GetNamespace()).Apply(ctx, obj.GetName(), obj,
+		metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply %s %s/%s: %w", obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+	}
+	return applied, nil
+}
+
+// ApplyObject applies a typed resource such as a Plan.
+func (c *Client) ApplyObject(ctx context.Context, object any) (*unstructured.Unstructured, error) {
+	content, err := json.Marshal(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal object: %w", err)
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(content, &obj.Object); err != nil {
+		return nil, fmt.Errorf("failed to convert object: %w", err)
+	}
+	return c.Apply(ctx, obj)
+}
+
+// Get returns the object of kind named name in namespace.
+func (c *Client) Get(ctx context.Context, kind, namespace, name string) (*unstructured.Unstructured, error) {
+	gvr, ok := resources[kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+	obj, err := c.dyn.Resource(gvr).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s %s/%s: %w", kind, namespace, name, err)
+	}
+	return obj, nil
+}
+
+// List returns the objects of kind in namespace matching the label
+// selector.
+func (c *Client) List(ctx context.Context, kind, namespace, selector string) ([]unstructured.Unstructured, error) {
+	gvr, ok := resources[kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+	list, err := c.dyn.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s in %s: %w", kind, namespace, err)
+	}
+	return list.Items, nil
+}
+
+// Delete deletes the object of kind named name in namespace and the objects
+// it owns. An object that is already gone is not an error.
+func (c *Client) Delete(ctx context.Context, kind, namespace, name string) error {
+	gvr, ok := resources[kind]
+	if !ok {
+		return fmt.Errorf("unsupported kind %q", kind)
+	}
+	policy := metav1.DeletePropagationBackground
+	err := c.dyn.Resource(gvr).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &policy})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete %s %s/%s: %w", kind, namespace, name, err)
+	}
+	return nil
+}
+
+// Watch watches the object of kind named name in namespace for changes
+// after resourceVersion.
+func (c *Client) Watch(ctx context.Context, kind, namespace, name, resourceVersion string) (watch.Interface, error) {
+	gvr, ok := resources[kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+	w, err := c.dyn.Resource(gvr).Namespace(namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+		ResourceVersion: resourceVersion,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch %s %s/%s: %w", kind, namespace, name, err)
+	}
+	return w, nil
+}
+
+// PodLog returns the last tailLines lines of the log of container in pod;
+// an empty container is the only one of the pod.
+func (c *Client) PodLog(ctx context.Context, namespace, pod, container string, tailLines int) (string, error) {
+	if c.config == nil {
+		return "", fmt.Errorf("pod logs need a client created with NewClient")
+	}
+	httpClient, err := rest.HTTPClientFor(c.config)
+	if err != nil {
+		return "", fmt.Errorf("failed to create log client: %w", err)
+	}
+	query := url.Values{"tailLines": {strconv.Itoa(tailLines)}}
+	if container != "" {
+		query.Set("container", container)
+	}
+	logURL := strings.TrimSuffix(c.config.Host, "/") + path.Join(c.config.APIPath, "/api/v1/namespaces", namespace, "pods", pod, "log") + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, logURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read log of pod %s/%s: %w", namespace, pod, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read log of pod %s/%s: %w", namespace, pod, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("log of pod %s/%s: %s: %s", namespace, pod, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
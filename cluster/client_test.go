@@ -0,0 +1,325 @@
+package ocp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNamespace = "openshift-mtv"
+
+// newFakeClient returns a client backed by the fake dynamic client, which
+// knows every kind the tool uses.
+func newFakeClient(objects ...runtime.Object) *Client {
+	listKinds := make(map[schema.GroupVersionResource]string)
+	for kind, gvr := range resources {
+		listKinds[gvr] = kind + "List"
+	}
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+	dyn.PrependReactor("patch", "*", applyReactor(dyn.Tracker()))
+	return NewClientFor(dyn)
+}
+
+// applyReactor stands in for server-side apply, which the fake client only
+// supports on existing objects: the applied object replaces the stored one
+// or is created.
+func applyReactor(tracker k8stesting.ObjectTracker) k8stesting.ReactionFunc {
+	return func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch, ok := action.(k8stesting.PatchAction)
+		if !ok || patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(patch.GetPatch()); err != nil {
+			return true, nil, err
+		}
+		gvr, ns := patch.GetResource(), patch.GetNamespace()
+		err := tracker.Update(gvr, obj, ns)
+		if apierrors.IsNotFound(err) {
+			err = tracker.Create(gvr, obj, ns)
+		}
+		if err != nil {
+			return true, nil, err
+		}
+		stored, err := tracker.Get(gvr, ns, obj.GetName())
+		return true, stored, err
+	}
+}
+
+// object builds an object of kind with the given labels.
+func object(kind, name string, labels map[string]string) *unstructured.Unstructured {
+	gvr := resources[kind]
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(schema.GroupVersion{Group: gvr.Group, Version: gvr.Version}.String())
+	obj.SetKind(kind)
+	obj.SetNamespace(testNamespace)
+	obj.SetName(name)
+	obj.SetLabels(labels)
+	return obj
+}
+
+// names lists the names of the objects of kind left in the namespace.
+func names(t *testing.T, c *Client, kind string) []string {
+	t.Helper()
+	objects, err := c.List(context.Background(), kind, testNamespace, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, obj := range objects {
+		names = append(names, obj.GetName())
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestClientApplyGetListDelete(t *testing.T) {
+	c := newFakeClient()
+	ctx := context.Background()
+
+	secret := object("Secret", "hyperv-run1", runLabels("run1", ""))
+	if err := unstructured.SetNestedStringMap(secret.Object, map[string]string{"url": "bmZz"}, "data"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Apply(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Get(ctx, "Secret", testNamespace, "hyperv-run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url, _, _ := unstructured.NestedString(got.Object, "data", "url"); url != "bmZz" {
+		t.Errorf("data.url = %q after apply", url)
+	}
+
+	if _, err := c.ApplyObject(ctx, object("Secret", "other", nil)); err != nil {
+		t.Fatal(err)
+	}
+	selected, err := c.List(ctx, "Secret", testNamespace, RunSelector("run1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0].GetName() != "hyperv-run1" {
+		t.Errorf("run selector matched %d secrets", len(selected))
+	}
+
+	if err := c.Delete(ctx, "Secret", testNamespace, "hyperv-run1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "Secret", testNamespace, "hyperv-run1"); err != nil {
+		t.Errorf("deleting a missing object: %v", err)
+	}
+	if got := names(t, c, "Secret"); !slices.Equal(got, []string{"other"}) {
+		t.Errorf("secrets left: %v", got)
+	}
+
+	if _, err := c.Get(ctx, "Bogus", testNamespace, "x"); err == nil {
+		t.Error("unknown kind was not an error")
+	}
+}
+
+// runObjects are the objects of a run with one wave, plus the VM its plan
+// migrated.
+func runObjects(runID string) []runtime.Object {
+	plan, migration := MigrationNames(runID, "default")
+	provider := providerObjectName(runID)
+	waveLabels := runLabels(runID, "default")
+
+	planObj := object("Plan", plan, waveLabels)
+	planObj.SetUID(types.UID("uid-" + runID))
+	vm := object("VirtualMachine", "vm-"+runID, map[string]string{"plan": "uid-" + runID})
+	return []runtime.Object{
+		object("Secret", provider, runLabels(runID, "")),
+		object("Provider", provider, runLabels(runID, "")),
+		object("NetworkMap", plan, waveLabels),
+		object("StorageMap", plan, waveLabels),
+		planObj,
+		object("Migration", migration, waveLabels),
+		vm,
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	for _, deleteVMs := range []bool{false, true} {
+		objects := append(runObjects("run1"), runObjects("run2")...)
+		// Not created by the tool, even though it uses the same name scheme
+		objects = append(objects, object("Plan", "hyperv-run1-manual", nil))
+		c := newFakeClient(objects...)
+
+		deleted, err := Cleanup(context.Background(), c, testNamespace, "run1", deleteVMs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 6
+		if deleteVMs {
+			want++
+		}
+		if deleted != want {
+			t.Errorf("deleteVMs=%v: deleted %d objects, want %d", deleteVMs, deleted, want)
+		}
+
+		for _, kind := range cleanupKinds {
+			for _, name := range names(t, c, kind) {
+				if strings.HasPrefix(name, "hyperv-run1") && name != "hyperv-run1-manual" {
+					t.Errorf("deleteVMs=%v: %s %s of run1 was not deleted", deleteVMs, kind, name)
+				}
+			}
+		}
+		if got := names(t, c, "Plan"); !slices.Equal(got, []string{"hyperv-run1-manual", "hyperv-run2-default"}) {
+			t.Errorf("deleteVMs=%v: plans left: %v", deleteVMs, got)
+		}
+
+		wantVMs := []string{"vm-run1", "vm-run2"}
+		if deleteVMs {
+			wantVMs = []string{"vm-run2"}
+		}
+		if got := names(t, c, "VirtualMachine"); !slices.Equal(got, wantVMs) {
+			t.Errorf("deleteVMs=%v: VMs left: %v, want %v", deleteVMs, got, wantVMs)
+		}
+	}
+}
+
+// providerWithStatus returns a Provider with the given generation and status.
+func providerWithStatus(generation, observed int64, conditions ...Condition) *unstructured.Unstructured {
+	obj := object("Provider", "hyperv-run1", nil)
+	obj.SetGeneration(generation)
+	var conds []interface{}
+	for _, c := range conditions {
+		conds = append(conds, map[string]interface{}{
+			"type": c.Type, "status": c.Status, "category": c.Category, "message": c.Message,
+		})
+	}
+	obj.Object["status"] = map[string]interface{}{
+		"observedGeneration": observed,
+		"conditions":         conds,
+	}
+	return obj
+}
+
+func TestWaitForConditions(t *testing.T) {
+	ready := []Condition{
+		{Type: "ConnectionTestSucceeded", Status: "True", Category: "Required"},
+		{Type: "InventoryCreated", Status: "True", Category: "Required"},
+		{Type: "Ready", Status: "True", Category: "Required"},
+	}
+	critical := Condition{Type: "ConnectionTestFailed", Status: "True", Category: "Critical", Message: "NFS share not reachable"}
+
+	tests := []struct {
+		name     string
+		provider *unstructured.Unstructured
+		// wantCritical expects a NotReadyError with this condition
+		wantCritical string
+		wantErr      string
+	}{
+		{name: "ready", provider: providerWithStatus(1, 1, ready...)},
+		{name: "critical", provider: providerWithStatus(1, 1, ready[0], critical),
+			wantCritical: "ConnectionTestFailed"},
+		// A critical condition of an older generation may be fixed by the
+		// last apply already
+		{name: "stale critical", provider: providerWithStatus(2, 1, critical),
+			wantErr: "timeout waiting for Provider hyperv-run1"},
+		{name: "not ready", provider: providerWithStatus(1, 1, ready[0]),
+			wantErr: "missing InventoryCreated, Ready"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient(tt.provider)
+			start := time.Now()
+			err := c.WaitForProviderReady(context.Background(), testNamespace, "hyperv-run1", 100*time.Millisecond)
+
+			var notReady *NotReadyError
+			switch {
+			case tt.wantCritical != "":
+				if !errors.As(err, &notReady) {
+					t.Fatalf("error = %v, want a NotReadyError", err)
+				}
+				if len(notReady.Conditions) != 1 || notReady.Conditions[0].Type != tt.wantCritical {
+					t.Errorf("conditions = %+v, want %s", notReady.Conditions, tt.wantCritical)
+				}
+				if !strings.Contains(err.Error(), critical.Message) {
+					t.Errorf("error %q lacks the condition message", err)
+				}
+				if time.Since(start) >= 100*time.Millisecond {
+					t.Error("critical condition did not stop the wait early")
+				}
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || errors.As(err, &notReady) {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+			default:
+				if err != nil {
+					t.Errorf("error = %v", err)
+				}
+			}
+		})
+	}
+
+	c := newFakeClient()
+	if err := c.WaitForPlanReady(context.Background(), testNamespace, "missing", time.Second); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("missing plan: error = %v, want not found", err)
+	}
+}
+
+func TestWaitForConditionsRetries(t *testing.T) {
+	old := readyPollInterval
+	readyPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { readyPollInterval = old })
+
+	ready := []Condition{
+		{Type: "ConnectionTestSucceeded", Status: "True"},
+		{Type: "InventoryCreated", Status: "True"},
+		{Type: "Ready", Status: "True"},
+	}
+	gr := schema.GroupResource{Group: resources["Provider"].Group, Resource: resources["Provider"].Resource}
+
+	tests := []struct {
+		name    string
+		errs    []error
+		wantErr string
+	}{
+		{name: "server timeout", errs: []error{apierrors.NewServerTimeout(gr, "get", 1), apierrors.NewTimeoutError("slow", 1)}},
+		{name: "throttled", errs: []error{apierrors.NewTooManyRequests("slow down", 1)}},
+		{name: "unavailable", errs: []error{apierrors.NewServiceUnavailable("restarting")}},
+		{name: "connection refused", errs: []error{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}},
+		{name: "forbidden", errs: []error{apierrors.NewForbidden(gr, "hyperv-run1", errors.New("no access"))},
+			wantErr: "forbidden"},
+		{name: "never recovers", errs: slices.Repeat([]error{apierrors.NewServiceUnavailable("restarting")}, 1000),
+			wantErr: "timeout waiting for Provider hyperv-run1 to be ready: failed to get Provider"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient(providerWithStatus(1, 1, ready...))
+			errs := tt.errs
+			c.dyn.(*dynamicfake.FakeDynamicClient).PrependReactor("get", "*", func(k8stesting.Action) (bool, runtime.Object, error) {
+				if len(errs) == 0 {
+					return false, nil, nil
+				}
+				err := errs[0]
+				errs = errs[1:]
+				return true, nil, err
+			})
+
+			err := c.WaitForProviderReady(context.Background(), testNamespace, "hyperv-run1", 200*time.Millisecond)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("error = %v, want the provider ready after the retries", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
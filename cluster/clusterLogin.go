@@ -1,41 +1,63 @@
 package ocp
 
 import (
-	"bytes"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-)
 
-func LoginToCluster() error {
+	"k8s.io/client-go/rest"
+)
 
-	clusterName := os.Getenv("CLUSTER_NAME")
-	if clusterName == "" {
-		return fmt.Errorf("cluster name is required")
+// labDomain is the base domain of the lab clusters, whose API is at
+// api.<cluster>.<labDomain>.
+const labDomain = "rhos-psi.cnv-qe.rhood.us"
+
+// LoginToCluster logs in to the lab cluster opts.Lab.ClusterName as
+// kubeadmin, with the password read from the cluster's install directory
+// on the NFS share, and returns the config of the session. The share is
+// mounted with sudo when it is not mounted yet. The API is opts.APIURL,
+// else the lab address of the cluster, and is verified like for the other
+// methods: the lab clusters use self-signed certificates, so they need
+// opts.CAFile or opts.Insecure.
+func LoginToCluster(opts AuthOptions) (*rest.Config, error) {
+	lab := opts.Lab
+	if lab.ClusterName == "" {
+		return nil, fmt.Errorf("cluster name is required")
 	}
-
-	mountBasePath := os.Getenv("MOUNT_BASH_PATH")
-	if mountBasePath == "" {
-		return fmt.Errorf("mount base path is required")
+	if lab.MountBasePath == "" {
+		return nil, fmt.Errorf("mount base path is required")
 	}
-	nfsServerPath := os.Getenv("CLUSTER_NFS_SERVER_PATH")
-	if nfsServerPath == "" {
-		return fmt.Errorf("NFS server path is required")
+	if lab.NFSServerPath == "" {
+		return nil, fmt.Errorf("NFS server path is required")
 	}
 
-	password, err := fetchClusterPassword(clusterName, mountBasePath, nfsServerPath)
+	password, err := fetchClusterPassword(lab.ClusterName, lab.MountBasePath, lab.NFSServerPath)
 	if err != nil {
-		return fmt.Errorf("fetch password: %w", err)
+		return nil, fmt.Errorf("fetch password: %w", err)
 	}
 
-	if err := clusterLogin(clusterName, password); err != nil {
-		return fmt.Errorf("login failed: %w", err)
+	apiURL := opts.APIURL
+	if apiURL == "" {
+		apiURL = fmt.Sprintf("https://api.%s.%s:6443", lab.ClusterName, labDomain)
+	}
+	config := &rest.Config{Host: apiURL, TLSClientConfig: tlsConfig(opts)}
+	token, err := requestOAuthToken(config, "kubeadmin", password)
+	if err != nil {
+		var unknownCA x509.UnknownAuthorityError
+		if errors.As(err, &unknownCA) {
+			return nil, fmt.Errorf("login failed, set CLUSTER_CA_FILE to the CA of the lab cluster or CLUSTER_INSECURE_SKIP_TLS_VERIFY=true: %w", err)
+		}
+		return nil, fmt.Errorf("login failed: %w", err)
 	}
+	config.BearerToken = token
 
-	fmt.Printf("Logged in to cluster %s successfully.\n", clusterName)
-	return nil
+	slog.Info("Logged in to cluster", "cluster", lab.ClusterName)
+	return config, nil
 }
 
 func fetchClusterPassword(clusterName, mountBasePath, nfsServerPath string) (string, error) {
@@ -68,34 +90,6 @@ func fetchClusterPassword(clusterName, mountBasePath, nfsServerPath string) (str
 	return strings.TrimSpace(string(content)), nil
 }
 
-func clusterLogin(clusterName, password string) error {
-	apiURL := fmt.Sprintf("https://api.%s.rhos-psi.cnv-qe.rhood.us:6443", clusterName)
-	username := "kubeadmin"
-
-	// Check if already logged in to same cluster
-	if err := exec.Command("oc", "whoami").Run(); err == nil {
-		cmd := exec.Command("oc", "whoami", "--show-server")
-		out, err := cmd.Output()
-		if err == nil && strings.Contains(string(out), clusterName) {
-			fmt.Printf("Already logged in to %s\n", clusterName)
-			return nil
-		}
-	}
-
-	// Logout (ignore error)
-	_ = exec.Command("oc", "logout").Run()
-
-	// Attempt login
-	cmd := exec.Command("oc", "login", "--insecure-skip-tls-verify=true", apiURL, "-u", username, "-p", password)
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("oc login: %v - %s", err, stderr.String())
-	}
-
-	return nil
-}
-
 func runCommand(name string, args ...string) error {
 	cmd := exec.Command(name, args...)
 	cmd.Stdout = os.Stdout
@@ -0,0 +1,196 @@
+package ocp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+)
+
+const (
+	// defaultReadyTimeout bounds the wait for a provider or plan when
+	// READY_TIMEOUT is not set.
+	defaultReadyTimeout = 10 * time.Minute
+)
+
+// readyPollInterval is how often the conditions are read again.
+var readyPollInterval = 5 * time.Second
+
+// providerReadyConditions must all be true before the inventory of a
+// provider can be used.
+var providerReadyConditions = []string{"ConnectionTestSucceeded", "InventoryCreated", "Ready"}
+
+// planReadyConditions must all be true before a plan can be migrated.
+var planReadyConditions = []string{"Ready"}
+
+// ReadyTimeout returns how long to wait for a provider or plan to become
+// ready, from READY_TIMEOUT.
+func ReadyTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("READY_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return defaultReadyTimeout
+}
+
+// NotReadyError reports a provider or plan Forklift refuses to use, with
+// the conditions that say why.
+type NotReadyError struct {
+	Kind       string
+	Name       string
+	Conditions []Condition
+}
+
+func (e *NotReadyError) Error() string {
+	var reasons []string
+	for _, cond := range e.Conditions {
+		reason := cond.Type
+		if cond.Message != "" {
+			reason += ": " + cond.Message
+		}
+		reasons = append(reasons, reason)
+	}
+	return fmt.Sprintf("%s %s is not ready: %s", e.Kind, e.Name, strings.Join(reasons, "; "))
+}
+
+// resourceStatus is the part of the status of a Forklift resource the
+// wait looks at.
+type resourceStatus struct {
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	Conditions         []Condition `json:"conditions,omitempty"`
+}
+
+// WaitForProviderReady waits until Forklift connected to the provider and
+// built its inventory.
+func (c *Client) WaitForProviderReady(ctx context.Context, namespace, name string, timeout time.Duration) error {
+	return c.waitForConditions(ctx, "Provider", namespace, name, providerReadyConditions, timeout)
+}
+
+// WaitForPlanReady waits until Forklift validated the plan, so a Migration
+// of it can start.
+func (c *Client) WaitForPlanReady(ctx context.Context, namespace, planName string, timeout time.Duration) error {
+	return c.waitForConditions(ctx, "Plan", namespace, planName, planReadyConditions, timeout)
+}
+
+// waitForConditions polls the object until every condition in required is
+// true. It stops early with a NotReadyError when Forklift reports a
+// critical condition, since those need a fix before anything can proceed.
+// Errors a busy or restarting API server returns are retried until the
+// timeout; any other error ends the wait.
+func (c *Client) waitForConditions(ctx context.Context, kind, namespace, name string, required []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	var missing []string
+	var lastErr error
+	for {
+		obj, err := c.Get(ctx, kind, namespace, name)
+		if err != nil && ctx.Err() == nil {
+			if !isRetryableAPIError(err) {
+				return err
+			}
+			lastErr = err
+			slog.Debug("Reading conditions failed, retrying", "kind", kind, "name", name, "error", err)
+		}
+		if err == nil {
+			lastErr = nil
+			status, err := statusOf(obj)
+			if err != nil {
+				return err
+			}
+			// Conditions of an older generation may be from before the last
+			// apply
+			if status.ObservedGeneration >= obj.GetGeneration() {
+				if critical := criticalConditions(status.Conditions); len(critical) > 0 {
+					return &NotReadyError{Kind: kind, Name: name, Conditions: critical}
+				}
+				missing = missingConditions(status.Conditions, required)
+				if len(missing) == 0 {
+					return nil
+				}
+			}
+			slog.Debug("Waiting for conditions", "kind", kind, "name", name, "missing", strings.Join(missing, ", "))
+		}
+
+		select {
+		case <-ctx.Done():
+			if len(missing) > 0 {
+				return fmt.Errorf("timeout waiting for %s %s to be ready (missing %s)", kind, name, strings.Join(missing, ", "))
+			}
+			if lastErr != nil {
+				return fmt.Errorf("timeout waiting for %s %s to be ready: %w", kind, name, lastErr)
+			}
+			return fmt.Errorf("timeout waiting for %s %s to be ready", kind, name)
+		case <-ticker.C:
+		}
+	}
+}
+
+// isRetryableAPIError reports whether err is one asking the API server
+// again can fix: a timeout, throttling, an unavailable server or a failed
+// connection.
+func isRetryableAPIError(err error) bool {
+	if apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) {
+		return true
+	}
+	if utilnet.IsConnectionRefused(err) || utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// statusOf decodes the status of a Forklift resource.
+func statusOf(obj *unstructured.Unstructured) (*resourceStatus, error) {
+	var status resourceStatus
+	raw, found, err := unstructured.NestedMap(obj.Object, "status")
+	if err != nil || !found {
+		return &status, nil
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status); err != nil {
+		return nil, fmt.Errorf("failed to decode status of %s %s: %w", obj.GetKind(), obj.GetName(), err)
+	}
+	return &status, nil
+}
+
+// criticalConditions returns the true conditions that block the resource,
+// such as a VM missing from the inventory or a source without a mapping.
+func criticalConditions(conditions []Condition) []Condition {
+	var critical []Condition
+	for _, cond := range conditions {
+		if cond.Status == "True" && cond.Category == "Critical" {
+			critical = append(critical, cond)
+		}
+	}
+	return critical
+}
+
+// missingConditions returns the types in required that are not true.
+func missingConditions(conditions []Condition, required []string) []string {
+	var missing []string
+	for _, t := range required {
+		ok := false
+		for _, cond := range conditions {
+			if cond.Type == t && cond.Status == "True" {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			missing = append(missing, t)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,137 @@
+package ocp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// diagnosticsDirName holds what was collected about a failed migration,
+	// below the manifests of its wave.
+	diagnosticsDirName = "diagnostics"
+	// podLogLines is how much of the log of each pod is kept.
+	podLogLines = 200
+	// importerLabel marks the CDI pods that import the disks.
+	importerLabel = "app=containerized-data-importer"
+)
+
+// collectDiagnostics saves the warning events and the logs of the
+// conversion and importer pods of a failed migration to dir and logs the
+// events, so the reason is at hand without access to the cluster.
+// Problems collecting them are only logged.
+func (c *Client) collectDiagnostics(ctx context.Context, namespace string, migration *unstructured.Unstructured, planName, dir string) {
+	logger := slog.With("migration", migration.GetName())
+	started := migration.GetCreationTimestamp().Time
+	dir = filepath.Join(dir, diagnosticsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Warn("Failed to create diagnostics directory", "error", err)
+		return
+	}
+
+	// Forklift labels its pods with the migration; CDI's importer pods are
+	// only told apart by when they started
+	var pods []unstructured.Unstructured
+	for _, selector := range []string{"migration=" + string(migration.GetUID()), importerLabel} {
+		found, err := c.List(ctx, "Pod", namespace, selector)
+		if err != nil {
+			logger.Warn("Failed to list pods", "selector", selector, "error", err)
+			continue
+		}
+		for _, pod := range found {
+			if pod.GetCreationTimestamp().Time.Before(started) {
+				continue
+			}
+			pods = append(pods, pod)
+		}
+	}
+
+	involved := map[string]bool{migration.GetName(): true, planName: true}
+	for _, pod := range pods {
+		involved[pod.GetName()] = true
+		phase, _, _ := unstructured.NestedString(pod.Object, "status", "phase")
+		if phase == "Succeeded" {
+			continue
+		}
+		containers, _, _ := unstructured.NestedSlice(pod.Object, "spec", "containers")
+		for _, ct := range containers {
+			container, ok := ct.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _, _ := unstructured.NestedString(container, "name")
+			log, err := c.PodLog(ctx, namespace, pod.GetName(), name, podLogLines)
+			if err != nil {
+				logger.Warn("Failed to read pod log", "pod", pod.GetName(), "container", name, "error", err)
+				continue
+			}
+			file := filepath.Join(dir, pod.GetName()+"-"+name+".log")
+			if err := os.WriteFile(file, []byte(log), 0644); err != nil {
+				logger.Warn("Failed to save pod log", "pod", pod.GetName(), "error", err)
+				continue
+			}
+			logger.Warn("Saved log of pod", "pod", pod.GetName(), "container", name, "phase", phase, "file", file)
+		}
+	}
+
+	events, err := c.List(ctx, "Event", namespace, "")
+	if err != nil {
+		logger.Warn("Failed to list events", "error", err)
+		return
+	}
+	var lines []string
+	for _, event := range events {
+		if t, _, _ := unstructured.NestedString(event.Object, "type"); t != "Warning" {
+			continue
+		}
+		kind, _, _ := unstructured.NestedString(event.Object, "involvedObject", "kind")
+		name, _, _ := unstructured.NestedString(event.Object, "involvedObject", "name")
+		if !involved[name] && !migratedKind(kind) {
+			continue
+		}
+		last := eventTime(event)
+		if last.Before(started) {
+			continue
+		}
+		reason, _, _ := unstructured.NestedString(event.Object, "reason")
+		message, _, _ := unstructured.NestedString(event.Object, "message")
+		logger.Warn("Kubernetes event", "object", kind+"/"+name, "reason", reason, "message", message)
+		lines = append(lines, fmt.Sprintf("%s %s/%s %s: %s", last.Format(time.RFC3339), kind, name, reason, message))
+	}
+	sort.Strings(lines)
+	file := filepath.Join(dir, "events.txt")
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		logger.Warn("Failed to save events", "error", err)
+		return
+	}
+	logger.Info("Saved migration diagnostics", "dir", dir, "events", len(lines), "pods", len(pods))
+}
+
+// migratedKind reports whether events about objects of kind can come from
+// a migration: the disks and VMs it creates in the target namespace.
+func migratedKind(kind string) bool {
+	switch kind {
+	case "PersistentVolumeClaim", "DataVolume", "VirtualMachine", "VirtualMachineInstance":
+		return true
+	}
+	return false
+}
+
+// eventTime is when the event was last seen.
+func eventTime(event unstructured.Unstructured) time.Time {
+	for _, field := range []string{"lastTimestamp", "eventTime", "firstTimestamp"} {
+		if s, _, _ := unstructured.NestedString(event.Object, field); s != "" {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				return t
+			}
+		}
+	}
+	return event.GetCreationTimestamp().Time
+}
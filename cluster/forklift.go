@@ -0,0 +1,296 @@
+package ocp
+
+// The Forklift (forklift.konveyor.io/v1beta1) resources the migration
+// creates, with only the fields this tool sets. They are marshalled as
+// JSON, so names need no quoting or escaping.
+
+import "strconv"
+
+const forkliftAPIVersion = forkliftGroup + "/v1beta1"
+
+type TypeMeta struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+}
+
+type ObjectMeta struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// ObjectRef points to another resource.
+type ObjectRef struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+// ProviderPair is the source and destination provider of a map or plan.
+type ProviderPair struct {
+	Source      ObjectRef `json:"source"`
+	Destination ObjectRef `json:"destination"`
+}
+
+type Secret struct {
+	TypeMeta `json:",inline"`
+	Metadata ObjectMeta `json:"metadata"`
+	Type     string     `json:"type"`
+	// Data is base64 encoded by the marshaller.
+	Data map[string][]byte `json:"data"`
+}
+
+type Provider struct {
+	TypeMeta `json:",inline"`
+	Metadata ObjectMeta   `json:"metadata"`
+	Spec     ProviderSpec `json:"spec"`
+}
+
+type ProviderSpec struct {
+	Type   string    `json:"type"`
+	URL    string    `json:"url"`
+	Secret ObjectRef `json:"secret"`
+}
+
+type NetworkMap struct {
+	TypeMeta `json:",inline"`
+	Metadata ObjectMeta     `json:"metadata"`
+	Spec     NetworkMapSpec `json:"spec"`
+}
+
+type NetworkMapSpec struct {
+	Map      []NetworkPair `json:"map"`
+	Provider ProviderPair  `json:"provider"`
+}
+
+type NetworkPair struct {
+	Source      SourceRef          `json:"source"`
+	Destination DestinationNetwork `json:"destination"`
+}
+
+// SourceRef identifies a network, disk or VM in the source inventory.
+type SourceRef struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type DestinationNetwork struct {
+	// Type is pod, multus or ignored.
+	Type      string `json:"type"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type StorageMap struct {
+	TypeMeta `json:",inline"`
+	Metadata ObjectMeta     `json:"metadata"`
+	Spec     StorageMapSpec `json:"spec"`
+}
+
+type StorageMapSpec struct {
+	Map      []StoragePair `json:"map"`
+	Provider ProviderPair  `json:"provider"`
+}
+
+type StoragePair struct {
+	Source      SourceRef          `json:"source"`
+	Destination DestinationStorage `json:"destination"`
+}
+
+type DestinationStorage struct {
+	StorageClass string `json:"storageClass"`
+	VolumeMode   string `json:"volumeMode,omitempty"`
+	AccessMode   string `json:"accessMode,omitempty"`
+}
+
+type Plan struct {
+	TypeMeta `json:",inline"`
+	Metadata ObjectMeta  `json:"metadata"`
+	Spec     PlanSpec    `json:"spec"`
+	Status   *PlanStatus `json:"status,omitempty"`
+}
+
+type PlanSpec struct {
+	Provider                       ProviderPair `json:"provider"`
+	Map                            PlanMap      `json:"map"`
+	TargetNamespace                string       `json:"targetNamespace"`
+	PVCNameTemplateUseGenerateName bool         `json:"pvcNameTemplateUseGenerateName"`
+	SkipGuestConversion            bool         `json:"skipGuestConversion"`
+	Warm                           bool         `json:"warm"`
+	MigrateSharedDisks             bool         `json:"migrateSharedDisks"`
+	VMs                            []PlanVM     `json:"vms"`
+}
+
+// PlanVM is a VM of a plan. TargetName renames a VM whose name is not a
+// valid name in the cluster.
+type PlanVM struct {
+	ID         string `json:"id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	TargetName string `json:"targetName,omitempty"`
+}
+
+type PlanMap struct {
+	Network ObjectRef `json:"network"`
+	Storage ObjectRef `json:"storage"`
+}
+
+type PlanStatus struct {
+	Phase      string      `json:"phase,omitempty"`
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+type Migration struct {
+	TypeMeta `json:",inline"`
+	Metadata ObjectMeta       `json:"metadata"`
+	Spec     MigrationSpec    `json:"spec"`
+	Status   *MigrationStatus `json:"status,omitempty"`
+}
+
+type MigrationSpec struct {
+	Plan ObjectRef `json:"plan"`
+}
+
+type MigrationStatus struct {
+	Phase      string      `json:"phase,omitempty"`
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+type Condition struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	// Category is Forklift's severity: Critical, Error, Warn, Advisory or
+	// Required.
+	Category string `json:"category,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// StorageMapping maps one source disk to a storage class and volume
+// settings.
+type StorageMapping struct {
+	SourceID    string
+	SourceName  string
+	Destination DestinationStorage
+}
+
+// NetworkMapping maps one source network to a destination network.
+type NetworkMapping struct {
+	SourceID    string
+	SourceName  string
+	Destination DestinationNetwork
+}
+
+func newSecret(name, namespace, url string, insecureSkipVerify bool) *Secret {
+	return &Secret{
+		TypeMeta: TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		Metadata: ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{
+			"createdForProviderType": "ova",
+			"createdForResourceType": "providers",
+		}},
+		Type: "Opaque",
+		Data: map[string][]byte{
+			"url":                []byte(url),
+			"insecureSkipVerify": []byte(strconv.FormatBool(insecureSkipVerify)),
+		},
+	}
+}
+
+func newOvaProvider(name, namespace string, secret ObjectRef, nfsURL string) *Provider {
+	return &Provider{
+		TypeMeta: TypeMeta{APIVersion: forkliftAPIVersion, Kind: "Provider"},
+		Metadata: ObjectMeta{Name: name, Namespace: namespace},
+		Spec:     ProviderSpec{Type: "ova", URL: nfsURL, Secret: secret},
+	}
+}
+
+func newNetworkMap(name, namespace string, providers ProviderPair, mappings []NetworkMapping) *NetworkMap {
+	m := &NetworkMap{
+		TypeMeta: TypeMeta{APIVersion: forkliftAPIVersion, Kind: "NetworkMap"},
+		Metadata: ObjectMeta{Name: name, Namespace: namespace},
+		Spec:     NetworkMapSpec{Map: []NetworkPair{}, Provider: providers},
+	}
+	for _, n := range mappings {
+		m.Spec.Map = append(m.Spec.Map, NetworkPair{
+			Source:      sourceRef(n.SourceID, n.SourceName),
+			Destination: n.Destination,
+		})
+	}
+	return m
+}
+
+func newStorageMap(name, namespace string, providers ProviderPair, mappings []StorageMapping) *StorageMap {
+	m := &StorageMap{
+		TypeMeta: TypeMeta{APIVersion: forkliftAPIVersion, Kind: "StorageMap"},
+		Metadata: ObjectMeta{Name: name, Namespace: namespace},
+		Spec:     StorageMapSpec{Map: []StoragePair{}, Provider: providers},
+	}
+	for _, s := range mappings {
+		m.Spec.Map = append(m.Spec.Map, StoragePair{
+			Source:      sourceRef(s.SourceID, s.SourceName),
+			Destination: s.Destination,
+		})
+	}
+	return m
+}
+
+func newPlan(name, namespace string, providers ProviderPair, networkMap, storageMap ObjectRef, vms []PlanVM) *Plan {
+	return &Plan{
+		TypeMeta: TypeMeta{APIVersion: forkliftAPIVersion, Kind: "Plan"},
+		Metadata: ObjectMeta{Name: name, Namespace: namespace},
+		Spec: PlanSpec{
+			Provider:                       providers,
+			Map:                            PlanMap{Network: networkMap, Storage: storageMap},
+			TargetNamespace:                namespace,
+			PVCNameTemplateUseGenerateName: true,
+			MigrateSharedDisks:             true,
+			VMs:                            vms,
+		},
+	}
+}
+
+func newMigration(name, namespace string, plan ObjectRef) *Migration {
+	return &Migration{
+		TypeMeta: TypeMeta{APIVersion: forkliftAPIVersion, Kind: "Migration"},
+		Metadata: ObjectMeta{Name: name, Namespace: namespace},
+		Spec:     MigrationSpec{Plan: plan},
+	}
+}
+
+// labeled is implemented by every resource, so labels can be added to any
+// of them.
+type labeled interface {
+	meta() *ObjectMeta
+}
+
+func (s *Secret) meta() *ObjectMeta     { return &s.Metadata }
+func (p *Provider) meta() *ObjectMeta   { return &p.Metadata }
+func (m *NetworkMap) meta() *ObjectMeta { return &m.Metadata }
+func (m *StorageMap) meta() *ObjectMeta { return &m.Metadata }
+func (p *Plan) meta() *ObjectMeta       { return &p.Metadata }
+func (m *Migration) meta() *ObjectMeta  { return &m.Metadata }
+
+// addLabels adds labels to obj, keeping the ones it already has.
+func addLabels(obj labeled, labels map[string]string) {
+	meta := obj.meta()
+	if meta.Labels == nil {
+		meta.Labels = make(map[string]string)
+	}
+	for k, v := range labels {
+		meta.Labels[k] = v
+	}
+}
+
+// sourceRef references a source object by ID, or by name when the ID is
+// not known yet.
+func sourceRef(id, name string) SourceRef {
+	if id != "" {
+		return SourceRef{ID: id}
+	}
+	return SourceRef{Name: name}
+}
+
+// forkliftRef references a Forklift resource of kind.
+func forkliftRef(kind, name, namespace string) ObjectRef {
+	return ObjectRef{APIVersion: forkliftAPIVersion, Kind: kind, Name: name, Namespace: namespace}
+}
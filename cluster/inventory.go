@@ -0,0 +1,333 @@
+package ocp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hyperv/logging"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// inventoryRoute is the route of the Forklift inventory service.
+	inventoryRoute = "forklift-inventory"
+	// defaultForkliftNamespace is where the operator installs Forklift.
+	defaultForkliftNamespace = "openshift-mtv"
+	// defaultInventoryTimeout bounds the wait for the scan when
+	// INVENTORY_TIMEOUT is not set.
+	defaultInventoryTimeout = 10 * time.Minute
+)
+
+// inventoryPollInterval is how often the inventory is asked again while
+// the provider is still scanning the share.
+var inventoryPollInterval = 5 * time.Second
+
+// InventoryTimeout returns how long to wait for the inventory to list a
+// VM, its networks and its disks, from INVENTORY_TIMEOUT.
+func InventoryTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("INVENTORY_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return defaultInventoryTimeout
+}
+
+// Inventory reads the Forklift inventory service, which lists what a
+// provider found with the IDs the Plan and maps have to use.
+type Inventory struct {
+	baseURL string
+	client  *http.Client
+}
+
+// SourceIDs are the inventory IDs of a VM and of its networks and disks,
+// by network name and disk file name.
+type SourceIDs struct {
+	VM       string
+	Networks map[string]string
+	Disks    map[string]string
+}
+
+// retryableError is an inventory error asking again can fix: an entry the
+// provider has not scanned yet, a server error or a failed connection.
+// Every other error, e.g. a 4xx status or a response that does not decode,
+// ends the wait.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+
+func (e *retryableError) Unwrap() error { return e.err }
+
+// retryable marks err as one to ask the inventory again for.
+func retryable(err error) error {
+	return &retryableError{err: err}
+}
+
+// inventoryObject is an entry of an inventory list. The inventory uses
+// both "id" and "ID"; encoding/json matches either.
+type inventoryObject struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	OvaPath  string `json:"ovaPath"`
+	FilePath string `json:"filePath"`
+	Disks    []struct {
+		ID string `json:"id"`
+	} `json:"disks"`
+	Networks []struct {
+		ID string `json:"id"`
+	} `json:"networks"`
+}
+
+// NewInventory returns an inventory client for baseURL that authenticates
+// and verifies TLS like config.
+func NewInventory(baseURL string, config *rest.Config) (*Inventory, error) {
+	tlsConfig, err := inventoryTLSConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inventory TLS config: %w", err)
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	wrapped, err := rest.HTTPWrappersForConfig(config, transport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inventory transport: %w", err)
+	}
+	return &Inventory{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Transport: wrapped, Timeout: time.Minute},
+	}, nil
+}
+
+// inventoryTLSConfig returns the TLS settings of config for the inventory
+// route. The route is usually served with the ingress certificate rather
+// than the API server's, so a CA of config is trusted in addition to the
+// system roots, and a server name meant for the API server is dropped.
+func inventoryTLSConfig(config *rest.Config) (*tls.Config, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return &tls.Config{}, nil
+	}
+	tlsConfig.ServerName = ""
+	if tlsConfig.RootCAs == nil {
+		return tlsConfig, nil
+	}
+
+	ca := config.CAData
+	if len(ca) == 0 {
+		if ca, err = os.ReadFile(config.CAFile); err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	roots.AppendCertsFromPEM(ca)
+	tlsConfig.RootCAs = roots
+	return tlsConfig, nil
+}
+
+// Inventory returns a client for the inventory service: the URL in
+// FORKLIFT_INVENTORY_URL, else the forklift-inventory route in
+// FORKLIFT_NAMESPACE (openshift-mtv by default).
+func (c *Client) Inventory(ctx context.Context) (*Inventory, error) {
+	if c.config == nil {
+		return nil, fmt.Errorf("the inventory needs a client created with NewClient")
+	}
+	baseURL := os.Getenv("FORKLIFT_INVENTORY_URL")
+	if baseURL == "" {
+		namespace := os.Getenv("FORKLIFT_NAMESPACE")
+		if namespace == "" {
+			namespace = defaultForkliftNamespace
+		}
+		route, err := c.Get(ctx, "Route", namespace, inventoryRoute)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the Forklift inventory (set FORKLIFT_INVENTORY_URL): %w", err)
+		}
+		host, _, _ := unstructured.NestedString(route.Object, "spec", "host")
+		if host == "" {
+			return nil, fmt.Errorf("route %s/%s has no host", namespace, inventoryRoute)
+		}
+		baseURL = "https://" + host
+	}
+	return NewInventory(baseURL, c.config)
+}
+
+// ResolveOva looks up vmName and the named networks and disk files in the
+// inventory of the OVA provider with UID providerUID. The provider scans
+// the share in the background, so missing entries, server errors and
+// failed connections are asked for again until they show up, ctx is
+// cancelled or InventoryTimeout passes; any other error is returned at
+// once.
+func (inv *Inventory) ResolveOva(ctx context.Context, providerUID, vmName string, networks, disks []string) (*SourceIDs, error) {
+	ctx, cancel := context.WithTimeout(ctx, InventoryTimeout())
+	defer cancel()
+
+	logger := slog.With(logging.KeyVM, vmName, logging.KeyStage, "migrate")
+	ticker := time.NewTicker(inventoryPollInterval)
+	defer ticker.Stop()
+
+	var last error
+	for {
+		ids, err := inv.resolveOva(ctx, providerUID, vmName, networks, disks)
+		if err == nil {
+			return ids, nil
+		}
+		var retry *retryableError
+		if !errors.As(err, &retry) {
+			return nil, err
+		}
+		// A request the timeout cut short says less than the one before
+		if last == nil || ctx.Err() == nil {
+			last = err
+		}
+		logger.Debug("Inventory not complete yet, retrying", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timeout waiting for the Forklift inventory: %w", last)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (inv *Inventory) resolveOva(ctx context.Context, providerUID, vmName string, networks, disks []string) (*SourceIDs, error) {
+	base := "/providers/ova/" + url.PathEscape(providerUID)
+
+	var vms []inventoryObject
+	if err := inv.get(ctx, base+"/vms?detail=1", &vms); err != nil {
+		return nil, err
+	}
+	vm, err := findVM(vms, vmName)
+	if err != nil {
+		return nil, err
+	}
+	ids := &SourceIDs{VM: vm.ID, Networks: make(map[string]string), Disks: make(map[string]string)}
+
+	if len(networks) > 0 {
+		var list []inventoryObject
+		if err := inv.get(ctx, base+"/networks?detail=1", &list); err != nil {
+			return nil, err
+		}
+		vmNetworks := make(map[string]bool)
+		for _, n := range vm.Networks {
+			vmNetworks[n.ID] = true
+		}
+		for _, name := range networks {
+			id := findByName(list, name, vmNetworks, "")
+			if id == "" {
+				return nil, retryable(fmt.Errorf("network %q is not in the inventory", name))
+			}
+			ids.Networks[name] = id
+		}
+	}
+
+	if len(disks) > 0 {
+		var list []inventoryObject
+		if err := inv.get(ctx, base+"/disks?detail=1", &list); err != nil {
+			return nil, err
+		}
+		vmDisks := make(map[string]bool)
+		for _, d := range vm.Disks {
+			vmDisks[d.ID] = true
+		}
+		for _, name := range disks {
+			id := findByName(list, name, vmDisks, "/"+vmName+"/")
+			if id == "" {
+				return nil, retryable(fmt.Errorf("disk %q is not in the inventory", name))
+			}
+			ids.Disks[name] = id
+		}
+	}
+	return ids, nil
+}
+
+// findVM picks the VM named name. The share may hold several OVAs of VMs
+// with the same name; the one in the directory named after it wins.
+func findVM(vms []inventoryObject, name string) (*inventoryObject, error) {
+	var found []*inventoryObject
+	for i := range vms {
+		if vms[i].Name == name {
+			found = append(found, &vms[i])
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, retryable(fmt.Errorf("VM %q is not in the inventory", name))
+	case 1:
+		return found[0], nil
+	}
+	for _, vm := range found {
+		if strings.Contains(vm.OvaPath, "/"+name+"/") {
+			return vm, nil
+		}
+	}
+	return nil, fmt.Errorf("the inventory has %d VMs named %q", len(found), name)
+}
+
+// findByName returns the ID of the entry named name, preferring the ones
+// listed in owned and then the ones whose path contains pathHint.
+func findByName(list []inventoryObject, name string, owned map[string]bool, pathHint string) string {
+	var candidates []inventoryObject
+	for _, obj := range list {
+		if obj.Name == name {
+			candidates = append(candidates, obj)
+		}
+	}
+	for _, obj := range candidates {
+		if owned[obj.ID] {
+			return obj.ID
+		}
+	}
+	if pathHint != "" {
+		for _, obj := range candidates {
+			if strings.Contains(obj.FilePath+"/", pathHint) || strings.Contains(obj.OvaPath, pathHint) {
+				return obj.ID
+			}
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0].ID
+	}
+	return ""
+}
+
+func (inv *Inventory) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, inv.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := inv.client.Do(req)
+	if err != nil {
+		return retryable(fmt.Errorf("inventory request failed: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("inventory %s returned %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return retryable(err)
+		}
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode inventory %s: %w", path, err)
+	}
+	return nil
+}
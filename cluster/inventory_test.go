@@ -0,0 +1,269 @@
+package ocp
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+const testProviderUID = "uid-1"
+
+// fakeInventory serves the lists of one OVA provider the way the Forklift
+// inventory does.
+type fakeInventory struct {
+	mu sync.Mutex
+	// lists are the JSON bodies by list, e.g. "vms"
+	lists map[string]string
+	// replies are returned, first to last, before the list itself: a
+	// status code, or a body to send with 200 when it is not a number
+	replies map[string][]string
+	// requests counts the requests by list
+	requests map[string]int
+}
+
+func (f *fakeInventory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	list, ok := strings.CutPrefix(r.URL.Path, "/providers/ova/"+testProviderUID+"/")
+	if !ok || r.URL.Query().Get("detail") != "1" {
+		http.NotFound(w, r)
+		return
+	}
+	f.requests[list]++
+	if replies := f.replies[list]; len(replies) > 0 {
+		f.replies[list] = replies[1:]
+		if code, err := strconv.Atoi(replies[0]); err == nil {
+			http.Error(w, http.StatusText(code), code)
+		} else {
+			w.Write([]byte(replies[0]))
+		}
+		return
+	}
+	body, ok := f.lists[list]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write([]byte(body))
+}
+
+// inventoryLists is a share with two exports of web01: the current one in
+// the directory named after it and an old copy. Both have a network and a
+// disk of the same names.
+var inventoryLists = map[string]string{
+	"vms": `[
+		{"id": "vm-old", "name": "web01", "ovaPath": "/ova/archive/web01.ovf",
+		 "networks": [{"id": "net-old"}], "disks": [{"id": "disk-old"}]},
+		{"id": "vm-web", "name": "web01", "ovaPath": "/ova/web01/web01.ovf",
+		 "networks": [{"id": "net-web"}], "disks": [{"id": "disk-web"}]},
+		{"ID": "vm-db", "name": "db01", "ovaPath": "/ova/db01/db01.ovf"}
+	]`,
+	"networks": `[
+		{"id": "net-old", "name": "VM Network"},
+		{"id": "net-web", "name": "VM Network"},
+		{"id": "net-db", "name": "Backend"}
+	]`,
+	"disks": `[
+		{"id": "disk-old", "name": "web01.vhdx", "filePath": "/ova/archive"},
+		{"id": "disk-web", "name": "web01.vhdx", "filePath": "/ova/web01"},
+		{"id": "disk-db", "name": "db01.vhdx", "filePath": "/ova/db01"},
+		{"id": "disk-db-copy", "name": "db01.vhdx", "filePath": "/ova/archive"}
+	]`,
+}
+
+func newFakeInventory(t *testing.T, lists map[string]string) (*fakeInventory, *Inventory) {
+	t.Helper()
+	old := inventoryPollInterval
+	inventoryPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { inventoryPollInterval = old })
+
+	f := &fakeInventory{lists: lists, replies: make(map[string][]string), requests: make(map[string]int)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	inv, err := NewInventory(srv.URL+"/", &rest.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, inv
+}
+
+func TestResolveOva(t *testing.T) {
+	tests := []struct {
+		name     string
+		vm       string
+		networks []string
+		disks    []string
+		want     SourceIDs
+		wantErr  string
+	}{
+		// The duplicates are told apart by the VM's own networks and
+		// disks and by the directory named after the VM
+		{name: "duplicate VM names", vm: "web01", networks: []string{"VM Network"}, disks: []string{"web01.vhdx"},
+			want: SourceIDs{VM: "vm-web", Networks: map[string]string{"VM Network": "net-web"}, Disks: map[string]string{"web01.vhdx": "disk-web"}}},
+		{name: "disk by path", vm: "db01", networks: []string{"Backend"}, disks: []string{"db01.vhdx"},
+			want: SourceIDs{VM: "vm-db", Networks: map[string]string{"Backend": "net-db"}, Disks: map[string]string{"db01.vhdx": "disk-db"}}},
+		{name: "ambiguous network", vm: "db01", networks: []string{"VM Network"},
+			wantErr: `network "VM Network" is not in the inventory`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, inv := newFakeInventory(t, inventoryLists)
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			ids, err := inv.ResolveOva(ctx, testProviderUID, tt.vm, tt.networks, tt.disks)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids.VM != tt.want.VM {
+				t.Errorf("VM = %s, want %s", ids.VM, tt.want.VM)
+			}
+			for name, id := range tt.want.Networks {
+				if ids.Networks[name] != id {
+					t.Errorf("network %s = %s, want %s", name, ids.Networks[name], id)
+				}
+			}
+			for name, id := range tt.want.Disks {
+				if ids.Disks[name] != id {
+					t.Errorf("disk %s = %s, want %s", name, ids.Disks[name], id)
+				}
+			}
+		})
+	}
+}
+
+func TestFindVM(t *testing.T) {
+	vms := []inventoryObject{
+		{ID: "a", Name: "app", OvaPath: "/ova/x/app.ovf"},
+		{ID: "b", Name: "app", OvaPath: "/ova/y/app.ovf"},
+		{ID: "c", Name: "web01", OvaPath: "/ova/web01/web01.ovf"},
+	}
+	if vm, err := findVM(vms, "web01"); err != nil || vm.ID != "c" {
+		t.Errorf("findVM(web01) = %v, %v", vm, err)
+	}
+	// Another scan does not make duplicates go away, but may add a VM
+	var retry *retryableError
+	if _, err := findVM(vms, "app"); err == nil || !strings.Contains(err.Error(), `2 VMs named "app"`) || errors.As(err, &retry) {
+		t.Errorf("duplicates outside their directory: error = %v", err)
+	}
+	if _, err := findVM(vms, "missing"); !errors.As(err, &retry) {
+		t.Errorf("missing VM: error = %v, want a retryable one", err)
+	}
+}
+
+func TestResolveOvaRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []string
+		// wantRequests is how often the VM list is asked for
+		wantRequests int
+		wantErr      string
+	}{
+		{name: "server error", replies: []string{"503", "503"}, wantRequests: 3},
+		{name: "not scanned yet", replies: []string{`[]`, `[{"id": "vm-db", "name": "other"}]`}, wantRequests: 3},
+		{name: "unauthorized", replies: []string{"401"}, wantRequests: 1, wantErr: "401 Unauthorized"},
+		{name: "not found", replies: []string{"404"}, wantRequests: 1, wantErr: "404 Not Found"},
+		{name: "invalid JSON", replies: []string{`{"vms":`}, wantRequests: 1, wantErr: "failed to decode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, inv := newFakeInventory(t, inventoryLists)
+			fake.replies["vms"] = tt.replies
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			ids, err := inv.ResolveOva(ctx, testProviderUID, "db01", nil, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil || ids.VM != "vm-db" {
+				t.Errorf("ResolveOva = %+v, %v", ids, err)
+			}
+			if got := fake.requests["vms"]; got != tt.wantRequests {
+				t.Errorf("asked for the VMs %d times, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+
+	// Entries that never show up are asked for until the context ends
+	_, inv := newFakeInventory(t, inventoryLists)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := inv.ResolveOva(ctx, testProviderUID, "missing", nil, nil); err == nil || !strings.Contains(err.Error(), "timeout waiting") {
+		t.Errorf("error = %v, want a timeout", err)
+	}
+}
+
+func TestResolveOvaInventoryTimeout(t *testing.T) {
+	t.Setenv("INVENTORY_TIMEOUT", "100ms")
+	_, inv := newFakeInventory(t, inventoryLists)
+
+	start := time.Now()
+	if _, err := inv.ResolveOva(context.Background(), testProviderUID, "missing", nil, nil); err == nil || !strings.Contains(err.Error(), "timeout waiting") {
+		t.Errorf("error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gave up after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestNewInventoryPrivateCA(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(srv.Close)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	tests := []struct {
+		name    string
+		config  *rest.Config
+		wantErr bool
+	}{
+		{"system roots", &rest.Config{}, true},
+		{"CA data", &rest.Config{TLSClientConfig: rest.TLSClientConfig{CAData: ca}}, false},
+		{"CA file", &rest.Config{TLSClientConfig: rest.TLSClientConfig{CAFile: writeCA(t, ca)}}, false},
+		{"API server name", &rest.Config{TLSClientConfig: rest.TLSClientConfig{CAData: ca, ServerName: "api.example.com"}}, false},
+		{"insecure", &rest.Config{TLSClientConfig: rest.TLSClientConfig{Insecure: true}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, err := NewInventory(srv.URL, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var list []inventoryObject
+			err = inv.get(context.Background(), "/providers", &list)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("get error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func writeCA(t *testing.T, ca []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(path, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,271 @@
+package ocp
+
+import (
+	"context"
+	"fmt"
+	"hyperv/ova"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Destination network types of a NetworkMap.
+const (
+	NetworkPod     = "pod"
+	NetworkMultus  = "multus"
+	NetworkIgnored = "ignored"
+)
+
+// MappingRules decide where the networks and disks of the migrated VMs
+// end up.
+type MappingRules struct {
+	// Networks are tried in order; networks no rule matches go to the pod
+	// network.
+	Networks []NetworkRule
+	// Storage is tried in order; disks no rule matches, or whose rule names
+	// no class, get DefaultStorageClass.
+	Storage []StorageRule
+	// DefaultStorageClass is the cluster's default StorageClass; RunOvaPlan
+	// looks it up when it is empty.
+	DefaultStorageClass string
+}
+
+// NetworkRule maps the source networks whose adapters it matches to
+// Destination. Empty criteria match any adapter.
+type NetworkRule struct {
+	// Switch and Adapter are globs on the virtual switch and the adapter
+	// name.
+	Switch  string
+	Adapter string
+	// VLAN matches the access VLAN when set; 0 is an untagged adapter.
+	VLAN *int
+	// Destination is a pod, multus or ignored network. A Multus network
+	// without a namespace is looked up in the migration namespace.
+	Destination DestinationNetwork
+}
+
+// matches reports whether the rule matches adapter.
+func (r NetworkRule) matches(adapter ova.Adapter) bool {
+	if r.Switch != "" {
+		if ok, _ := path.Match(r.Switch, adapter.Switch); !ok {
+			return false
+		}
+	}
+	if r.Adapter != "" {
+		if ok, _ := path.Match(r.Adapter, adapter.Name); !ok {
+			return false
+		}
+	}
+	return r.VLAN == nil || *r.VLAN == adapter.VLAN
+}
+
+// networkDestination returns the destination of the source network named
+// network of a VM with adapters: that of the first rule matching one of
+// the adapters on it, else the pod network. An OVF from before networks
+// were named after the switch names the adapter instead, which is matched
+// as well. Without any adapter on it (no vm-info.json) the network is
+// matched as an adapter of that name.
+func networkDestination(rules []NetworkRule, network, namespace string, adapters []ova.Adapter) DestinationNetwork {
+	var on []ova.Adapter
+	for _, a := range adapters {
+		if a.Network() == network || a.Name == network {
+			on = append(on, a)
+		}
+	}
+	if len(on) == 0 {
+		on = []ova.Adapter{{Name: network}}
+	}
+	for _, rule := range rules {
+		for _, a := range on {
+			if rule.matches(a) {
+				dest := rule.Destination
+				if dest.Type == NetworkMultus && dest.Namespace == "" {
+					dest.Namespace = namespace
+				}
+				return dest
+			}
+		}
+	}
+	return DestinationNetwork{Type: NetworkPod}
+}
+
+// StorageRule maps the disks it matches to Destination. Empty criteria
+// match any disk.
+type StorageRule struct {
+	// VM is a glob on the VM name.
+	VM string
+	// Path is a glob on the disk path on the Hyper-V host; either slash
+	// works as separator.
+	Path string
+	// Controller is a glob on the position of the drive, e.g. "SCSI 0:*".
+	Controller string
+	// MinSize and MaxSize bound the virtual size in bytes; 0 is no bound.
+	MinSize int64
+	MaxSize int64
+	// Destination is the StorageClass and volume settings; an empty class
+	// is the default one.
+	Destination DestinationStorage
+}
+
+// DiskInfo is what a storage rule can match on.
+type DiskInfo struct {
+	VM   string
+	File string
+	// Drive is the Hyper-V drive of the file; zero when vm-info.json is not
+	// available.
+	Drive ova.Drive
+	// Size is the virtual size in bytes; 0 when unknown.
+	Size int64
+}
+
+// matches reports whether the rule matches disk.
+func (r StorageRule) matches(disk DiskInfo) bool {
+	if r.VM != "" {
+		if ok, _ := path.Match(r.VM, disk.VM); !ok {
+			return false
+		}
+	}
+	if r.Path != "" {
+		pattern := strings.ReplaceAll(r.Path, "\\", "/")
+		ok, _ := path.Match(pattern, strings.ReplaceAll(disk.Drive.Path, "\\", "/"))
+		if byName, _ := path.Match(pattern, disk.File); !ok && !byName {
+			return false
+		}
+	}
+	if r.Controller != "" {
+		if ok, _ := path.Match(r.Controller, disk.Drive.Position()); !ok || disk.Drive.ControllerType == "" {
+			return false
+		}
+	}
+	if r.MinSize > 0 && (disk.Size == 0 || disk.Size < r.MinSize) {
+		return false
+	}
+	if r.MaxSize > 0 && (disk.Size == 0 || disk.Size > r.MaxSize) {
+		return false
+	}
+	return true
+}
+
+// storageDestination returns the destination of disk: that of the first
+// matching rule, with the default StorageClass filled in.
+func storageDestination(rules MappingRules, disk DiskInfo) DestinationStorage {
+	var dest DestinationStorage
+	for _, rule := range rules.Storage {
+		if rule.matches(disk) {
+			dest = rule.Destination
+			break
+		}
+	}
+	if dest.StorageClass == "" {
+		dest.StorageClass = rules.DefaultStorageClass
+	}
+	return dest
+}
+
+// String describes the destination, e.g. "ocs-rbd (Block, ReadWriteMany)".
+func (d DestinationStorage) String() string {
+	var settings []string
+	for _, s := range []string{d.VolumeMode, d.AccessMode} {
+		if s != "" {
+			settings = append(settings, s)
+		}
+	}
+	if len(settings) == 0 {
+		return d.StorageClass
+	}
+	return fmt.Sprintf("%s (%s)", d.StorageClass, strings.Join(settings, ", "))
+}
+
+// String describes the destination, e.g. "multus vlan/vlan-10".
+func (d DestinationNetwork) String() string {
+	if d.Type == NetworkMultus {
+		return d.Type + " " + d.Namespace + "/" + d.Name
+	}
+	return d.Type
+}
+
+// validateNetworks checks that the Multus networks the mappings use exist
+// on the cluster, so a typo fails before anything is created.
+func (c *Client) validateNetworks(ctx context.Context, mappings []NetworkMapping) error {
+	var missing []string
+	checked := make(map[string]bool)
+	for _, m := range mappings {
+		dest := m.Destination
+		key := dest.Namespace + "/" + dest.Name
+		if dest.Type != NetworkMultus || checked[key] {
+			continue
+		}
+		checked[key] = true
+		if _, err := c.Get(ctx, "NetworkAttachmentDefinition", dest.Namespace, dest.Name); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("network attachment definitions used by the network mapping do not exist: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// defaultStorageClassAnnotations mark the default StorageClass of a
+// cluster; the beta one is still set by older provisioners.
+var defaultStorageClassAnnotations = []string{
+	"storageclass.kubernetes.io/is-default-class",
+	"storageclass.beta.kubernetes.io/is-default-class",
+}
+
+// DefaultStorageClass returns the name of the default StorageClass of the
+// cluster.
+func (c *Client) DefaultStorageClass(ctx context.Context) (string, error) {
+	classes, err := c.List(ctx, "StorageClass", "", "")
+	if err != nil {
+		return "", err
+	}
+	var defaults []string
+	for _, class := range classes {
+		for _, annotation := range defaultStorageClassAnnotations {
+			if class.GetAnnotations()[annotation] == "true" {
+				defaults = append(defaults, class.GetName())
+				break
+			}
+		}
+	}
+	switch len(defaults) {
+	case 0:
+		return "", fmt.Errorf("the cluster has no default StorageClass; name one in the storage rules")
+	case 1:
+		return defaults[0], nil
+	}
+	sort.Strings(defaults)
+	slog.Warn("The cluster has several default StorageClasses, using the first", "storage_classes", strings.Join(defaults, ", "), "using", defaults[0])
+	return defaults[0], nil
+}
+
+// validateStorage checks that the StorageClasses the mappings use exist on
+// the cluster.
+func (c *Client) validateStorage(ctx context.Context, mappings []StorageMapping) error {
+	var missing []string
+	checked := make(map[string]bool)
+	for _, m := range mappings {
+		class := m.Destination.StorageClass
+		if checked[class] {
+			continue
+		}
+		checked[class] = true
+		if _, err := c.Get(ctx, "StorageClass", "", class); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			missing = append(missing, class)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("storage classes used by the storage mapping do not exist: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
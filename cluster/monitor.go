@@ -0,0 +1,287 @@
+package ocp
+
+import (
+	"context"
+	"fmt"
+	"hyperv/logging"
+	"hyperv/metrics"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// defaultStallTimeout is how long a migration may go without any progress
+// when MIGRATION_STALL_TIMEOUT is not set. A large disk keeps reporting
+// transferred bytes, so only a migration that is stuck runs into it.
+const defaultStallTimeout = 30 * time.Minute
+
+// StallTimeout returns how long a migration may make no progress before it
+// is given up on, from MIGRATION_STALL_TIMEOUT.
+func StallTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("MIGRATION_STALL_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return defaultStallTimeout
+}
+
+// conversionStep is the pipeline step in which Forklift converts the disks
+// of a VM.
+const conversionStep = "ImageConversion"
+
+// StepProgress is one step of the pipeline of a VM, such as DiskTransfer or
+// ImageConversion.
+type StepProgress struct {
+	Name      string
+	Phase     string
+	Completed int64
+	Total     int64
+	// Unit of Completed and Total, e.g. MB for the disk transfer.
+	Unit string
+	// StartedAt and FinishedAt are when Forklift ran the step, zero until
+	// then.
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// Duration returns how long a finished step ran, or 0 while it runs.
+func (s StepProgress) Duration() time.Duration {
+	if s.StartedAt.IsZero() || s.FinishedAt.IsZero() {
+		return 0
+	}
+	return s.FinishedAt.Sub(s.StartedAt)
+}
+
+// Percent returns how far the step is, or -1 when Forklift does not say.
+func (s StepProgress) Percent() int {
+	switch {
+	case s.Phase == "Completed":
+		return 100
+	case s.Total > 0:
+		return int(s.Completed * 100 / s.Total)
+	}
+	return -1
+}
+
+// VMProgress is the phase and pipeline of one VM of a migration.
+type VMProgress struct {
+	Name  string
+	Phase string
+	Steps []StepProgress
+}
+
+// MigrationProgress reads the progress of every VM from the migration
+// status.
+func MigrationProgress(migration *unstructured.Unstructured) []VMProgress {
+	var progress []VMProgress
+	vms, _, _ := unstructured.NestedSlice(migration.Object, "status", "vms")
+	for _, v := range vms {
+		vm, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		p := VMProgress{}
+		p.Name, _, _ = unstructured.NestedString(vm, "name")
+		p.Phase, _, _ = unstructured.NestedString(vm, "phase")
+		pipeline, _, _ := unstructured.NestedSlice(vm, "pipeline")
+		for _, s := range pipeline {
+			step, ok := s.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			sp := StepProgress{}
+			sp.Name, _, _ = unstructured.NestedString(step, "name")
+			sp.Phase, _, _ = unstructured.NestedString(step, "phase")
+			sp.Unit, _, _ = unstructured.NestedString(step, "annotations", "unit")
+			if progress, ok := step["progress"].(map[string]interface{}); ok {
+				sp.Completed, _ = toInt64(progress["completed"])
+				sp.Total, _ = toInt64(progress["total"])
+			}
+			sp.StartedAt = stepTime(step, "started")
+			sp.FinishedAt = stepTime(step, "completed")
+			p.Steps = append(p.Steps, sp)
+		}
+		progress = append(progress, p)
+	}
+	return progress
+}
+
+// stepTime reads a timestamp of a pipeline step, zero when it is not set.
+func stepTime(step map[string]interface{}, field string) time.Time {
+	s, _, _ := unstructured.NestedString(step, field)
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+// formatProgress renders the progress of a migration for status, one line
+// per VM and one per step.
+func formatProgress(progress []VMProgress) string {
+	if len(progress) == 0 {
+		return "  no VMs in the migration status yet\n"
+	}
+	var sb strings.Builder
+	for _, vm := range progress {
+		fmt.Fprintf(&sb, "  %s: %s\n", vm.Name, vm.Phase)
+		for _, step := range vm.Steps {
+			fmt.Fprintf(&sb, "    %-24s %-10s", step.Name, step.Phase)
+			if step.Total > 0 {
+				fmt.Fprintf(&sb, " %d/%d %s", step.Completed, step.Total, step.Unit)
+			}
+			if pct := step.Percent(); pct >= 0 {
+				fmt.Fprintf(&sb, " (%d%%)", pct)
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// progressTracker logs the steps of a migration that changed since the
+// last update.
+type progressTracker struct {
+	migration string
+	vms       map[string]string
+	steps     map[string]StepProgress
+}
+
+func newProgressTracker(migration string) *progressTracker {
+	return &progressTracker{migration: migration, vms: make(map[string]string), steps: make(map[string]StepProgress)}
+}
+
+// update logs what changed in migration and reports whether anything did.
+func (t *progressTracker) update(migration *unstructured.Unstructured) bool {
+	changed := false
+	for _, vm := range MigrationProgress(migration) {
+		if vm.Name == "" {
+			continue
+		}
+		logger := slog.With(logging.KeyVM, vm.Name, logging.KeyStage, "migrate", "migration", t.migration)
+		if t.vms[vm.Name] != vm.Phase {
+			t.vms[vm.Name] = vm.Phase
+			changed = true
+			if vm.Phase != "" {
+				metrics.MigrationPhase.SetOnly(1, vm.Name, vm.Phase)
+				logger.Info("VM phase", "phase", vm.Phase)
+			}
+		}
+		for _, step := range vm.Steps {
+			key := vm.Name + "/" + step.Name
+			previous := t.steps[key]
+			if previous == step {
+				continue
+			}
+			t.steps[key] = step
+			changed = true
+			metrics.MigrationStepProgress.Set(float64(max(step.Percent(), 0))/100, vm.Name, step.Name)
+			logger.Info("Migration progress", "step", step.Name, "phase", step.Phase,
+				"completed", step.Completed, "total", step.Total, "unit", step.Unit, "percent", step.Percent())
+			if step.Name == conversionStep && step.Duration() > 0 && previous.Duration() == 0 {
+				metrics.ConversionSeconds.Observe(step.Duration().Seconds())
+				logger.Info("Disk conversion finished", "duration", step.Duration().Round(time.Second))
+			}
+		}
+	}
+	return changed
+}
+
+// watchMigration watches the migration and its plan until the migration
+// succeeded or failed and returns its final state. It gives up when the
+// migration makes no progress for stall; the last state seen is returned
+// with the error.
+func (c *Client) watchMigration(ctx context.Context, namespace, migrationName, planName string, stall time.Duration) (*unstructured.Unstructured, error) {
+	tracker := newProgressTracker(migrationName)
+	stallTimer := time.NewTimer(stall)
+	defer stallTimer.Stop()
+	lastPlanProblem := ""
+
+	var migration *unstructured.Unstructured
+	for {
+		// The watch ends now and then; the object is read again and watched
+		// from where it is
+		current, err := c.Get(ctx, "Migration", namespace, migrationName)
+		if err != nil {
+			return migration, err
+		}
+		migration = current
+		if tracker.update(migration) {
+			stallTimer.Reset(stall)
+		}
+		if isMigrationSucceeded(migration) || isMigrationFailed(migration) {
+			return migration, nil
+		}
+
+		migrationWatch, err := c.Watch(ctx, "Migration", namespace, migrationName, migration.GetResourceVersion())
+		if err != nil {
+			return migration, err
+		}
+		planWatch, err := c.Watch(ctx, "Plan", namespace, planName, "")
+		if err != nil {
+			migrationWatch.Stop()
+			return migration, err
+		}
+
+		done, err := func() (bool, error) {
+			defer migrationWatch.Stop()
+			defer planWatch.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return true, ctx.Err()
+				case <-stallTimer.C:
+					return true, fmt.Errorf("migration %s made no progress for %s", migrationName, stall)
+				case event, ok := <-migrationWatch.ResultChan():
+					if !ok || event.Type == watch.Error {
+						return false, nil
+					}
+					if event.Type == watch.Deleted {
+						return true, fmt.Errorf("migration %s was deleted", migrationName)
+					}
+					obj, ok := event.Object.(*unstructured.Unstructured)
+					if !ok {
+						continue
+					}
+					migration = obj
+					if tracker.update(migration) {
+						stallTimer.Reset(stall)
+					}
+					if isMigrationSucceeded(migration) || isMigrationFailed(migration) {
+						return true, nil
+					}
+				case event, ok := <-planWatch.ResultChan():
+					if !ok || event.Type == watch.Error {
+						return false, nil
+					}
+					obj, ok := event.Object.(*unstructured.Unstructured)
+					if !ok {
+						continue
+					}
+					// A plan that turns invalid while running is worth
+					// knowing about before the migration fails on it
+					if problem := planProblem(obj); problem != "" && problem != lastPlanProblem {
+						slog.Warn("Plan reports a problem", "plan", planName, "migration", migrationName, "problem", problem)
+					}
+					lastPlanProblem = planProblem(obj)
+				}
+			}
+		}()
+		if done {
+			return migration, err
+		}
+	}
+}
+
+// planProblem describes the critical conditions of a plan, if any.
+func planProblem(plan *unstructured.Unstructured) string {
+	status, err := statusOf(plan)
+	if err != nil {
+		return ""
+	}
+	critical := criticalConditions(status.Conditions)
+	if len(critical) == 0 {
+		return ""
+	}
+	return (&NotReadyError{Kind: "Plan", Name: plan.GetName(), Conditions: critical}).Error()
+}
@@ -0,0 +1,56 @@
+package ocp
+
+import (
+	"hyperv/metrics"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// migrationWithSteps returns a Migration of web01 with the given pipeline.
+func migrationWithSteps(steps ...map[string]interface{}) *unstructured.Unstructured {
+	obj := object("Migration", "hyperv-run1-wave1", nil)
+	pipeline := make([]interface{}, len(steps))
+	for i, step := range steps {
+		pipeline[i] = step
+	}
+	obj.Object["status"] = map[string]interface{}{
+		"vms": []interface{}{
+			map[string]interface{}{"name": "web01", "phase": "ConvertGuest", "pipeline": pipeline},
+		},
+	}
+	return obj
+}
+
+func TestProgressTrackerConversionDuration(t *testing.T) {
+	transfer := map[string]interface{}{"name": "DiskTransfer", "phase": "Completed",
+		"started": "2026-10-18T10:00:00Z", "completed": "2026-10-18T10:20:00Z",
+		"progress": map[string]interface{}{"completed": int64(2048), "total": int64(2048)}}
+	running := map[string]interface{}{"name": conversionStep, "phase": "Running",
+		"started": "2026-10-18T10:20:00Z"}
+	done := map[string]interface{}{"name": conversionStep, "phase": "Completed",
+		"started": "2026-10-18T10:20:00Z", "completed": "2026-10-18T10:32:30Z"}
+
+	progress := MigrationProgress(migrationWithSteps(transfer, done))
+	if len(progress) != 1 || len(progress[0].Steps) != 2 {
+		t.Fatalf("progress = %+v, want one VM with two steps", progress)
+	}
+	if got := progress[0].Steps[1].Duration(); got != 12*time.Minute+30*time.Second {
+		t.Errorf("conversion took %v, want 12m30s", got)
+	}
+	if got := progress[0].Steps[0].Completed; got != 2048 {
+		t.Errorf("transfer completed %d, want 2048", got)
+	}
+
+	count, sum := metrics.ConversionSeconds.Count()
+	tracker := newProgressTracker("hyperv-run1-wave1")
+	tracker.update(migrationWithSteps(transfer, running))
+	tracker.update(migrationWithSteps(transfer, done))
+	tracker.update(migrationWithSteps(transfer, done))
+
+	gotCount, gotSum := metrics.ConversionSeconds.Count()
+	if gotCount-count != 1 || gotSum-sum != 750 {
+		t.Errorf("observed %d conversions of %v seconds, want 1 of 750", gotCount-count, gotSum-sum)
+	}
+}
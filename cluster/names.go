@@ -0,0 +1,91 @@
+package ocp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Labels set on every object a run creates, so cleanup can find them.
+const (
+	LabelManagedBy = "app.kubernetes.io/managed-by"
+	LabelRunID     = "hyperv-to-ova/run-id"
+	LabelWave      = "hyperv-to-ova/wave"
+)
+
+// namePrefix starts the name of every object a run creates.
+const namePrefix = "hyperv"
+
+// maxNameLength is the limit of a DNS-1123 label, which the names of the
+// objects and label values have to be.
+const maxNameLength = 63
+
+// DNSLabel turns s into a DNS-1123 label: lowercase letters, digits and
+// dashes, starting and ending with a letter or digit, at most 63
+// characters. Longer names are cut and end in a hash of s, so different
+// long names stay different.
+func DNSLabel(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	label := strings.TrimRight(b.String(), "-")
+	if label == "" {
+		label = "x"
+	}
+	if len(label) > maxNameLength {
+		sum := sha256.Sum256([]byte(s))
+		hash := hex.EncodeToString(sum[:])[:8]
+		label = strings.TrimRight(label[:maxNameLength-len(hash)-1], "-") + "-" + hash
+	}
+	return label
+}
+
+// validDNSLabel reports whether s is already a DNS-1123 label.
+func validDNSLabel(s string) bool {
+	return s != "" && DNSLabel(s) == s
+}
+
+// objectName joins parts into the name of an object of the run.
+func objectName(parts ...string) string {
+	return DNSLabel(strings.Join(append([]string{namePrefix}, parts...), "-"))
+}
+
+// providerObjectName is the name of the OVA Provider of a run and of its
+// Secret.
+func providerObjectName(runID string) string {
+	return objectName(runID)
+}
+
+// MigrationNames returns the names of the Forklift Plan and Migration
+// RunOvaPlan creates for wave in the run runID. The maps of the wave share
+// the name of the plan.
+func MigrationNames(runID, wave string) (plan, migration string) {
+	name := objectName(runID, wave)
+	return name, name
+}
+
+// runLabels are the labels of the objects of a run; wave is empty for the
+// objects shared by every wave.
+func runLabels(runID, wave string) map[string]string {
+	labels := map[string]string{
+		LabelManagedBy: fieldManager,
+		LabelRunID:     DNSLabel(runID),
+	}
+	if wave != "" {
+		labels[LabelWave] = DNSLabel(wave)
+	}
+	return labels
+}
+
+// RunSelector selects every object of the run runID.
+func RunSelector(runID string) string {
+	return LabelRunID + "=" + DNSLabel(runID)
+}
@@ -0,0 +1,73 @@
+package ocp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"k8s.io/client-go/rest"
+)
+
+// requestOAuthToken gets an OpenShift access token for username the way
+// `oc login` does: the challenging client answers a basic auth request to
+// the authorization endpoint with a redirect carrying the token.
+func requestOAuthToken(config *rest.Config, username, password string) (string, error) {
+	transport, err := rest.TransportFor(&rest.Config{Host: config.Host, TLSClientConfig: config.TLSClientConfig})
+	if err != nil {
+		return "", fmt.Errorf("failed to create transport: %w", err)
+	}
+	client := &http.Client{
+		Transport: transport,
+		// The token is in the redirect itself
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := client.Get(strings.TrimSuffix(config.Host, "/") + "/.well-known/oauth-authorization-server")
+	if err != nil {
+		return "", fmt.Errorf("failed to discover the OAuth server: %w", err)
+	}
+	var metadata struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	resp.Body.Close()
+	if err != nil || metadata.AuthorizationEndpoint == "" {
+		return "", fmt.Errorf("cluster %s does not advertise an OAuth server", config.Host)
+	}
+
+	authURL, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint %q: %w", metadata.AuthorizationEndpoint, err)
+	}
+	authURL.RawQuery = url.Values{
+		"response_type": {"token"},
+		"client_id":     {"openshift-challenging-client"},
+	}.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, authURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(username, password)
+	req.Header.Set("X-CSRF-Token", "1")
+	resp, err = client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OAuth request failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", fmt.Errorf("the cluster rejected the credentials of %s", username)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("unexpected OAuth response %s", resp.Status)
+	}
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil || fragment.Get("access_token") == "" {
+		return "", fmt.Errorf("OAuth response did not contain an access token")
+	}
+	return fragment.Get("access_token"), nil
+}
@@ -1,338 +1,28 @@
 package ocp
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/gob"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hyperv/logging"
+	"hyperv/ova"
+	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"text/template"
-	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
 )
 
 const (
-	providerName       = "ova-provider-test"
-	secretName         = "ova-provider-lbmst"
-	migrationName      = "hyperv-demo"
-	planName           = "ovatohyper"
 	sourceProviderType = "host"
-	networkMapName     = "ova-network-map"
-	storageMapName     = "ova-storage-map"
-	sourceNetworkName  = "Network Adapter"
-	destStorageClass   = "nfs-csi"
-	destNetworkType    = "pod"
 )
 
-type PlanStatus struct {
-	Phase      string `json:"phase"`
-	Conditions []struct {
-		Type    string `json:"type"`
-		Status  string `json:"status"`
-		Reason  string `json:"reason,omitempty"`
-		Message string `json:"message,omitempty"`
-	} `json:"conditions"`
-}
-
-type MigrationStatus struct {
-	Phase      string `json:"phase"`
-	Conditions []struct {
-		Type    string `json:"type"`
-		Status  string `json:"status"`
-		Reason  string `json:"reason,omitempty"`
-		Message string `json:"message,omitempty"`
-	} `json:"conditions"`
-}
-
-type Migration struct {
-	Status MigrationStatus `json:"status"`
-}
-type Plan struct {
-	Status PlanStatus `json:"status"`
-}
-
-func WaitForPlanReady(namespace, planName string, timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("timeout waiting for plan %s to be ready", planName)
-		case <-ticker.C:
-			plan, err := getPlan(namespace, planName)
-			if err != nil {
-				return fmt.Errorf("failed to get plan: %w", err)
-			}
-
-			if isPlanReady(plan) {
-				return nil
-			}
-			fmt.Println("Plan not ready yet, waiting...")
-		}
-	}
-}
-
-// Use kubectl to fetch the plan
-func getPlan(namespace, name string) (*Plan, error) {
-	cmd := exec.Command("kubectl", "get", "plan", name, "-n", namespace, "-o", "json")
-	out, err := cmd.Output()
-	if err != nil {
-		return nil, err
-	}
-
-	var plan Plan
-	if err := json.Unmarshal(out, &plan); err != nil {
-		return nil, err
-	}
-	return &plan, nil
-}
-
-func isPlanReady(plan *Plan) bool {
-	// Check phase or conditions for readiness, for example:
-	if plan.Status.Phase == "Ready" {
-		return true
-	}
-	for _, cond := range plan.Status.Conditions {
-		if cond.Type == "Ready" && cond.Status == "True" {
-			return true
-		}
-	}
-	return false
-}
-
-func applyYamlFile(filename string) error {
-	cmd := exec.Command("kubectl", "apply", "-f", filename)
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	cmd.Stdout = &stderr // Optional: include stdout for debugging too
-
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("kubectl apply failed: %v\nOutput:\n%s", err, stderr.String())
-	}
-	return nil
-}
-
-func applyYaml(filename string) error {
-	cmd := exec.Command("oc", "apply", "-f", filename)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
-func writeTemplateToFile(templateName, templateContent string, data any, filename string) error {
-	tmpl, err := template.New(templateName).Parse(templateContent)
-	if err != nil {
-		return err
-	}
-
-	file, err := os.Create(filename)
-
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	return tmpl.Execute(file, data)
-}
-
-func createOvaProviderYaml(
-	namespace, providerName, secretName, secretNamespace, nfsURL, filename string,
-) error {
-	data := OvaProviderData{
-		Namespace:       namespace,
-		ProviderName:    providerName,
-		SecretName:      secretName,
-		SecretNamespace: secretNamespace,
-		NFSURL:          nfsURL,
-	}
-
-	return writeTemplateToFile("ovaProvider", ovaProviderTemplate, data, filename)
-}
-
-func createMigrationPlanYaml(
-	namespace, planName, sourceProvider, destProvider, networkMap, storageMap, vmID, vmName, filename string,
-) error {
-	data := MigrationPlanData{
-		Namespace:      namespace,
-		PlanName:       planName,
-		SourceProvider: sourceProvider,
-		DestProvider:   destProvider,
-		NetworkMap:     networkMap,
-		StorageMap:     storageMap,
-		VMID:           vmID,
-		VMName:         vmName,
-	}
-
-	return writeTemplateToFile("migrationPlan", migrationPlanTemplate, data, filename)
-}
-
-func createMigrationYaml(
-	filename string,
-	migrationName string,
-	namespace string,
-	planName string,
-	planNamespace string,
-) error {
-	data := MigrationData{
-		MigrationName: migrationName,
-		Namespace:     namespace,
-		PlanName:      planName,
-		PlanNamespace: planNamespace,
-	}
-
-	return writeTemplateToFile("migration", migrationTemplate, data, filename)
-}
-
-func createStorageMapYaml(
-	filename string,
-	mapName string,
-	namespace string,
-	sourceProvider string,
-	destinationProvider string,
-	storageMappings []StorageMapping,
-) error {
-	data := StorageMapData{
-		MapName:             mapName,
-		Namespace:           namespace,
-		SourceProvider:      sourceProvider,
-		DestinationProvider: destinationProvider,
-		StorageMappings:     storageMappings,
-	}
-
-	return writeTemplateToFile("storageMap", storageMapTemplate, data, filename)
-}
-
-func createNetworkMapYaml(
-	filename string,
-	mapName string,
-	namespace string,
-	sourceProvider string,
-	destinationProvider string,
-	networkMappings []NetworkMapping,
-) error {
-	data := NetworkMapData{
-		MapName:             mapName,
-		Namespace:           namespace,
-		SourceProvider:      sourceProvider,
-		DestinationProvider: destinationProvider,
-		NetworkMappings:     networkMappings,
-	}
-
-	return writeTemplateToFile("networkMap", networkMapTemplate, data, filename)
-
-}
-
-func createOvaSecretYaml(secretName, namespace, url string, insecureSkipVerify bool, filename string) error {
-	secretData := SecretData{
-		SecretName:               secretName,
-		Namespace:                namespace,
-		UrlBase64:                base64.StdEncoding.EncodeToString([]byte(url)),
-		InsecureSkipVerifyBase64: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%t", insecureSkipVerify))),
-	}
-
-	return writeTemplateToFile("secret", secretTemplate, secretData, filename)
-}
-
-func waitForMigrationComplete(namespace, migrationName string, timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	ticker := time.NewTicker(10 * time.Second) // poll interval
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return fmt.Errorf("timeout waiting for migration %s to complete", migrationName)
-		case <-ticker.C:
-			migration, err := getMigration(namespace, migrationName) // your function to fetch migration CR
-			if err != nil {
-				return fmt.Errorf("failed to get migration: %w", err)
-			}
-
-			if isMigrationSucceeded(migration) {
-				fmt.Println("Migration succeeded!")
-				return nil
-			}
-			if isMigrationFailed(migration) {
-				return fmt.Errorf("migration failed")
-			}
-
-			progress := extractProgressPercentage(migration)
-			fmt.Println(progress)
-		}
-	}
-}
-
-func extractProgressPercentage(migration *unstructured.Unstructured) string {
-	vms, found, err := unstructured.NestedSlice(migration.Object, "status", "vms")
-	if err != nil || !found || len(vms) == 0 {
-		return "No VMs found in migration status"
-	}
-
-	var sb strings.Builder
-	for _, v := range vms {
-		vm, ok := v.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		name, _, _ := unstructured.NestedString(vm, "name")
-		phase, _, _ := unstructured.NestedString(vm, "phase")
-		pipeline, found, _ := unstructured.NestedSlice(vm, "pipeline")
-
-		sb.WriteString(fmt.Sprintf("🖥️ VM: %s\n", name))
-		sb.WriteString(fmt.Sprintf("   Phase: %s\n", phase))
-
-		if found {
-			for _, step := range pipeline {
-				stepMap, ok := step.(map[string]interface{})
-				if !ok {
-					continue
-				}
-
-				stepName, _, _ := unstructured.NestedString(stepMap, "name")
-				stepPhase, _, _ := unstructured.NestedString(stepMap, "phase")
-				progressMap, _, _ := unstructured.NestedMap(stepMap, "progress")
-
-				completed, _, _ := unstructured.NestedInt64(progressMap, "completed")
-				total, _, _ := unstructured.NestedInt64(progressMap, "total")
-
-				percentage := "?"
-				if total > 0 {
-					percentage = fmt.Sprintf("%d%%", int((completed*100)/total))
-				}
-				if stepPhase == "Completed" {
-					percentage = "100%"
-				}
-				sb.WriteString(fmt.Sprintf("  Step: %s | %s | Progress: %s\n", stepName, stepPhase, percentage))
-			}
-		}
-		sb.WriteString("\n")
-	}
-	return sb.String()
-}
-
+// toInt64 reads a number from a decoded status, whatever its type.
 func toInt64(val interface{}) (int64, bool) {
 	switch v := val.(type) {
 	case int64:
@@ -357,39 +47,28 @@ func toInt64(val interface{}) (int64, bool) {
 	return 0, false
 }
 
-func getMigration(namespace, migrationName string) (*unstructured.Unstructured, error) {
-	var config *rest.Config
-	var err error
-
-	// Try loading from KUBECONFIG or default kubeconfig path
-	kubeconfig := filepath.Join(os.Getenv("HOME"), ".kube", "config")
-	if _, err := os.Stat(kubeconfig); err == nil {
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-	} else {
-		config, err = rest.InClusterConfig()
-	}
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to build kubeconfig: %w", err)
+// PrintMigrationStatus prints the phase and per-VM progress of the named
+// migration created by RunOvaPlan.
+func PrintMigrationStatus(ctx context.Context, c *Client, migrationName string) error {
+	namespace := os.Getenv("NAMESPACE")
+	if namespace == "" {
+		return fmt.Errorf("NAMESPACE environment variable not set")
 	}
 
-	dynClient, err := dynamic.NewForConfig(config)
+	migration, err := c.Get(ctx, "Migration", namespace, migrationName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
-	}
-
-	migrationGVR := schema.GroupVersionResource{
-		Group:    "forklift.konveyor.io",
-		Version:  "v1beta1",
-		Resource: "migrations",
+		return err
 	}
 
-	migration, err := dynClient.Resource(migrationGVR).Namespace(namespace).Get(context.TODO(), migrationName, metav1.GetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get migration CR: %w", err)
+	state := "Running"
+	if isMigrationSucceeded(migration) {
+		state = "Succeeded"
+	} else if isMigrationFailed(migration) {
+		state = "Failed"
 	}
-
-	return migration, nil
+	fmt.Printf("Migration %s/%s: %s\n", namespace, migrationName, state)
+	fmt.Print(formatProgress(MigrationProgress(migration)))
+	return nil
 }
 
 func isMigrationSucceeded(migration *unstructured.Unstructured) bool {
@@ -438,463 +117,518 @@ func isMigrationFailed(migration *unstructured.Unstructured) bool {
 	return false
 }
 
-func discoverNetworkMappings(outputDir string) ([]NetworkMapping, error) {
-	// Find OVF files to extract network information
+// errNoOvf is returned for a VM directory without an OVF.
+var errNoOvf = errors.New("no OVF files found in output directory")
+
+// readVMOvf parses the OVF in outputDir. Only the first one is used, the
+// package stage writes one per VM directory.
+func readVMOvf(outputDir string) (*ova.Envelope, error) {
 	ovfFiles, err := filepath.Glob(filepath.Join(outputDir, "*.ovf"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to search for OVF files: %w", err)
 	}
-
 	if len(ovfFiles) == 0 {
-		return nil, fmt.Errorf("no OVF files found in output directory")
-	}
-
-	// Use the first OVF file (assuming single VM for now)
-	ovfFile := ovfFiles[0]
-
-	networks, err := extractNetworksFromOVF(ovfFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to extract networks from OVF: %w", err)
+		return nil, errNoOvf
 	}
-
-	var networkMappings []NetworkMapping
-	for i, networkName := range networks {
-		// Generate network ID similar to how Forklift might do it
-		networkID := generateNetworkID(networkName, i)
-
-		networkMappings = append(networkMappings, NetworkMapping{
-			SourceID:        networkID,
-			SourceName:      networkName,
-			DestinationType: destNetworkType, // "pod"
-		})
-
-		fmt.Printf("Discovered network: %s → %s\n", networkName, networkID)
-	}
-
-	if len(networkMappings) == 0 {
-		// Fallback: create a default network mapping
-		networkMappings = append(networkMappings, NetworkMapping{
-			SourceID:        "d722072e029481b6ca769f17e8fc112a9f30", // default from working example
-			SourceName:      sourceNetworkName,                      // "Network Adapter"
-			DestinationType: destNetworkType,                        // "pod"
-		})
-		fmt.Println("No networks found in OVF, using default network mapping")
-	}
-
-	return networkMappings, nil
+	return ova.ReadOvf(ovfFiles[0])
 }
 
-func extractNetworksFromOVF(ovfFilePath string) ([]string, error) {
-	// Read and parse OVF file to extract network names
-	content, err := os.ReadFile(ovfFilePath)
+// discoverNetworks returns the names of the networks in the OVF in
+// outputDir.
+func discoverNetworks(outputDir string) ([]string, error) {
+	env, err := readVMOvf(outputDir)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to extract networks from OVF: %w", err)
 	}
-
 	var networks []string
-
-	// Simple string parsing to find network names in OVF
-	// Look for <Network ovf:name="..." patterns
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "<Network") && strings.Contains(line, "ovf:name=") {
-			// Extract network name from ovf:name="..."
-			start := strings.Index(line, "ovf:name=\"")
-			if start != -1 {
-				start += len("ovf:name=\"")
-				end := strings.Index(line[start:], "\"")
-				if end != -1 {
-					networkName := line[start : start+end]
-					networks = append(networks, networkName)
-				}
-			}
-		}
+	for _, n := range env.NetworkSection.Networks {
+		networks = append(networks, n.Name)
 	}
-
 	return networks, nil
 }
 
-func generateNetworkID(networkName string, index int) string {
-	// Pool of known working network IDs (first come, first serve)
-	knownNetworkIDs := []string{
-		"d722072e029481b6ca769f17e8fc112a9f30", // First network gets this ID
-		// Add more known working network IDs here as needed
-	}
-
-	// Use known working IDs in order (first come, first serve)
-	if index < len(knownNetworkIDs) {
-		fmt.Printf("✅ Using known working network ID #%d for %s: %s\n", index+1, networkName, knownNetworkIDs[index])
-		return knownNetworkIDs[index]
-	}
-
-	// If we run out of known IDs, generate new ones using Forklift's algorithm
-	fmt.Printf("⚠️  No known ID for network #%d (%s), attempting to generate...\n", index+1, networkName)
-
-	// Use Forklift's exact algorithm for generating network IDs
-	// Based on: networkIDMap.GetUUID(network.Name, network.Name)
-
-	// The key for networks is just the network name (used twice in Forklift)
-	key := networkName
-
-	// Use the network name as the object (Forklift uses network.Name directly)
-	id, err := generateForkliftUUID(networkName, key)
-	if err != nil {
-		// Fallback to simple hash if gob encoding fails
-		hasher := sha256.New()
-		hasher.Write([]byte(networkName))
-		hash := hasher.Sum(nil)
-		id = hex.EncodeToString(hash)[:32]
+// discoverDisks returns the disk files of the VM in outputDir, from the
+// OVF references when there is an OVF.
+func discoverDisks(logger *slog.Logger, outputDir string) ([]string, error) {
+	env, err := readVMOvf(outputDir)
+	if err == nil {
+		var disks []string
+		for _, f := range env.References.Files {
+			if strings.HasSuffix(f.Href, ".vhdx") {
+				disks = append(disks, f.Href)
+			}
+		}
+		if len(disks) > 0 {
+			return disks, nil
+		}
+	} else if !errors.Is(err, errNoOvf) {
+		logger.Warn("Could not extract disk info from OVF", "error", err)
 	}
 
-	return id
-}
-
-func discoverStorageMappings(outputDir string) ([]StorageMapping, error) {
-	// Find all .vhdx files in the output directory
 	diskFiles, err := filepath.Glob(filepath.Join(outputDir, "*.vhdx"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to search for vhdx files: %w", err)
 	}
-
 	if len(diskFiles) == 0 {
 		return nil, fmt.Errorf("no .vhdx files found in output directory")
 	}
+	disks := make([]string, len(diskFiles))
+	for i, diskFile := range diskFiles {
+		disks[i] = filepath.Base(diskFile)
+	}
+	return disks, nil
+}
 
-	// Also check OVF files for disk information
-	ovfFiles, err := filepath.Glob(filepath.Join(outputDir, "*.ovf"))
+// discoverDiskSizes returns the size of every disk file the OVF in
+// outputDir references; the package stage writes the virtual size there.
+// Without an OVF nothing is known.
+func discoverDiskSizes(outputDir string) map[string]int64 {
+	sizes := make(map[string]int64)
+	env, err := readVMOvf(outputDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to search for OVF files: %w", err)
+		return sizes
 	}
-
-	var diskInfo []DiskInfo
-
-	// Extract disk information from OVF if available
-	if len(ovfFiles) > 0 {
-		ovfDisks, err := extractDisksFromOVF(ovfFiles[0])
-		if err != nil {
-			fmt.Printf("Warning: Could not extract disk info from OVF: %v\n", err)
-		} else {
-			diskInfo = ovfDisks
+	for _, f := range env.References.Files {
+		if f.Href != "" {
+			sizes[f.Href] = f.Size
 		}
 	}
+	return sizes
+}
 
-	// If no OVF info, create basic disk info from file names
-	if len(diskInfo) == 0 {
-		for _, diskFile := range diskFiles {
-			fileName := filepath.Base(diskFile)
+// Wave is a group of VMs migrated by one Plan and Migration.
+type Wave struct {
+	Name string
+	VMs  []WaveVM
+}
 
-			// Get file size
-			size := int64(0)
-			if stat, err := os.Stat(diskFile); err == nil {
-				size = stat.Size()
-			}
+// WaveVM is a VM of a wave, the directory holding its OVF and disks and
+// its network adapters and drives.
+type WaveVM struct {
+	Name     string
+	Dir      string
+	Adapters []ova.Adapter
+	Drives   []ova.Drive
+}
 
-			diskInfo = append(diskInfo, DiskInfo{
-				FileName: fileName,
-				FilePath: diskFile,
-				Size:     size,
-			})
-		}
-	} else {
-		// Ensure file paths and sizes are set for OVF-derived disk info
-		for i := range diskInfo {
-			fullPath := filepath.Join(outputDir, diskInfo[i].FileName)
-			diskInfo[i].FilePath = fullPath
-
-			// Get actual file size
-			if stat, err := os.Stat(fullPath); err == nil {
-				diskInfo[i].Size = stat.Size()
-			}
-		}
+// VMNames returns the names of the VMs of the wave.
+func (w Wave) VMNames() []string {
+	names := make([]string, len(w.VMs))
+	for i, vm := range w.VMs {
+		names[i] = vm.Name
 	}
+	return names
+}
 
-	var storageMappings []StorageMapping
-
-	fmt.Printf("✅ Discovering storage for %d disk files:\n", len(diskInfo))
-
-	for i, disk := range diskInfo {
-		// Generate storage ID based on disk properties
-		storageID, err := generateStorageID(disk, i)
-		if err != nil {
-			fmt.Printf("Warning: Could not generate storage ID for %s, using fallback\n", disk.FileName)
-			storageID = generateFallbackStorageID(disk.FileName, i)
-		}
-
-		storageMappings = append(storageMappings, StorageMapping{
-			SourceID:                storageID,
-			DestinationStorageClass: destStorageClass,
-		})
+// Manifest is a resource the migration creates. File is set once it was
+// written to disk.
+type Manifest struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	File      string `json:"file,omitempty"`
 
-		fmt.Printf("   📁 %s → %s\n", disk.FileName, storageID)
-	}
+	object any
+	file   string
+}
 
-	return storageMappings, nil
+// RenderedVM is what RenderOvaPlan discovered about one VM.
+type RenderedVM struct {
+	Name     string
+	ID       string
+	Networks []NetworkMapping
+	Storage  []StorageMapping
 }
 
-type DiskInfo struct {
-	FileName string
-	FilePath string
-	Size     int64
-	DiskID   string // from OVF if available
+// RenderedMigration is everything RenderOvaPlan discovered and built.
+type RenderedMigration struct {
+	Plan      string
+	Migration string
+	VMs       []RenderedVM
+	Manifests []Manifest
 }
 
-func extractDisksFromOVF(ovfFilePath string) ([]DiskInfo, error) {
-	// Read and parse OVF file to extract disk information
-	content, err := os.ReadFile(ovfFilePath)
-	if err != nil {
-		return nil, err
+// RenderOvaPlan discovers the networks and disks from the OVF of every VM
+// of wave, maps them by rules and builds every resource the migration of
+// the wave in the run runID creates, in the order they have to be applied. ids holds the
+// inventory IDs by VM name; without them (e.g. in a dry run) the resources
+// reference the source by name only. Nothing is applied or written; see
+// WriteManifests.
+func RenderOvaPlan(runID string, wave Wave, rules MappingRules, namespace, nfsURL string, ids map[string]*SourceIDs) (*RenderedMigration, error) {
+	if len(wave.VMs) == 0 {
+		return nil, fmt.Errorf("wave %s has no VMs", wave.Name)
 	}
+	planName, migrationName := MigrationNames(runID, wave.Name)
+	mapName := planName
+	rendered := &RenderedMigration{Plan: planName, Migration: migrationName}
 
-	var disks []DiskInfo
-
-	// Parse References section for File entries
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "<File") && strings.Contains(line, "ovf:href=") {
-			// Extract file name from ovf:href="..."
-			start := strings.Index(line, "ovf:href=\"")
-			if start != -1 {
-				start += len("ovf:href=\"")
-				end := strings.Index(line[start:], "\"")
-				if end != -1 {
-					fileName := line[start : start+end]
-					if strings.HasSuffix(fileName, ".vhdx") {
-						disks = append(disks, DiskInfo{
-							FileName: fileName,
-							FilePath: "", // Will be set later
-						})
-					}
+	var networkMappings []NetworkMapping
+	var storageMappings []StorageMapping
+	var planVMs []PlanVM
+	type networkDest struct {
+		vm   string
+		dest DestinationNetwork
+	}
+	networkDests := make(map[string]networkDest)
+	seen := make(map[string]bool)
+	for _, vm := range wave.VMs {
+		vmIDs := ids[vm.Name]
+		if vmIDs == nil {
+			vmIDs = &SourceIDs{}
+		}
+		r, err := renderVM(vm, rules, namespace, vmIDs)
+		if err != nil {
+			return nil, err
+		}
+		rendered.VMs = append(rendered.VMs, *r)
+		planVM := PlanVM{ID: r.ID, Name: vm.Name}
+		if !validDNSLabel(vm.Name) {
+			planVM.TargetName = DNSLabel(vm.Name)
+		}
+		planVMs = append(planVMs, planVM)
+
+		// VMs of a wave often share networks; each source is mapped once,
+		// so it can only have one destination
+		for _, n := range r.Networks {
+			key := "network/" + n.SourceID + "/" + n.SourceName
+			if prev, ok := networkDests[key]; ok {
+				if prev.dest != n.Destination {
+					return nil, fmt.Errorf("network %q is mapped to %s for %s but to %s for %s; Forklift maps a source network to one destination",
+						n.SourceName, prev.dest, prev.vm, n.Destination, vm.Name)
 				}
+				continue
+			}
+			networkDests[key] = networkDest{vm: vm.Name, dest: n.Destination}
+			networkMappings = append(networkMappings, n)
+		}
+		for _, d := range r.Storage {
+			key := "disk/" + d.SourceID
+			if d.SourceID == "" {
+				key = "disk/" + vm.Name + "/" + d.SourceName
+			}
+			if !seen[key] {
+				seen[key] = true
+				storageMappings = append(storageMappings, d)
 			}
 		}
 	}
 
-	return disks, nil
-}
-
-func generateStorageID(disk DiskInfo, index int) (string, error) {
-	// Pool of known working storage IDs (first come, first serve)
-	knownStorageIDs := []string{
-		"dfb1a980140def3d29d0cd69034f9662fc8d", // First disk gets this ID
-		"b1872fd235ad7692d87ca041ddb4a523aa82", // Second disk gets this ID
-		// Add more known working IDs here as needed
-	}
-
-	// Use known working IDs in order (first come, first serve)
-	if index < len(knownStorageIDs) {
-		fmt.Printf("✅ Using known working storage ID #%d for %s: %s\n", index+1, disk.FileName, knownStorageIDs[index])
-		return knownStorageIDs[index], nil
+	secret, provider := ovaProviderObjects(runID, namespace, nfsURL)
+	providerName := provider.Metadata.Name
+	providers := ProviderPair{
+		Source:      ObjectRef{Name: providerName, Namespace: namespace},
+		Destination: ObjectRef{Name: sourceProviderType, Namespace: namespace},
 	}
-
-	// If we run out of known IDs, generate new ones using Forklift's algorithm
-	fmt.Printf("⚠️  No known ID for disk #%d (%s), attempting to generate...\n", index+1, disk.FileName)
-
-	// Find the OVF file path to calculate FilePath using Forklift's getDiskPath logic
-	ovaDir := filepath.Dir(disk.FilePath)
-	ovfPath := ""
-	if files, err := filepath.Glob(filepath.Join(ovaDir, "*.ovf")); err == nil && len(files) > 0 {
-		ovfPath = files[0]
-	} else {
-		// Fallback if no OVF found
-		ovfPath = filepath.Join(ovaDir, "vm.ovf")
+	planProviders := ProviderPair{
+		Source:      forkliftRef("Provider", providerName, namespace),
+		Destination: forkliftRef("Provider", sourceProviderType, namespace),
 	}
 
-	// Apply Forklift's getDiskPath logic to get the FilePath
-	filePath := ovfPath
-	if filepath.Ext(ovfPath) == ".ovf" {
-		if i := strings.LastIndex(ovfPath, "/"); i > -1 {
-			filePath = ovfPath[:i+1]
-		}
+	rendered.Manifests = []Manifest{
+		{Kind: "Secret", Name: secret.Metadata.Name, Namespace: namespace, file: "ova-secret.yaml", object: secret},
+		{Kind: "Provider", Name: providerName, Namespace: namespace, file: "ova-provider.yaml", object: provider},
+		{Kind: "StorageMap", Name: mapName, Namespace: namespace, file: "storage-map.yaml",
+			object: newStorageMap(mapName, namespace, providers, storageMappings)},
+		{Kind: "NetworkMap", Name: mapName, Namespace: namespace, file: "network-map.yaml",
+			object: newNetworkMap(mapName, namespace, providers, networkMappings)},
+		{Kind: "Plan", Name: planName, Namespace: namespace, file: "plan.yaml",
+			object: newPlan(planName, namespace, planProviders,
+				forkliftRef("NetworkMap", mapName, namespace),
+				forkliftRef("StorageMap", mapName, namespace),
+				planVMs)},
+		{Kind: "Migration", Name: migrationName, Namespace: namespace, file: "migration.yaml",
+			object: newMigration(migrationName, namespace, ObjectRef{Name: planName, Namespace: namespace})},
 	}
-
-	// Create a VmDisk object exactly as Forklift would populate it from OVF
-	vmDisk := VmDisk{
-		FilePath:                filePath,                         // Directory path from getDiskPath
-		Name:                    disk.FileName,                    // Just the filename
-		Capacity:                disk.Size,                        // File size
-		CapacityAllocationUnits: "byte",                           // Standard units
-		DiskId:                  fmt.Sprintf("vmdisk%d", index+1), // As generated in OVF
-		FileRef:                 fmt.Sprintf("file%d", index+1),   // As generated in OVF
-		Format:                  "http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized",
-		PopulatedSize:           disk.Size, // Same as capacity for our case
+	for _, m := range rendered.Manifests[2:] {
+		addLabels(m.object.(labeled), runLabels(runID, wave.Name))
 	}
-
-	// Create the key as Forklift does: ovaPath + "/" + name
-	key := ovfPath + "/" + disk.FileName
-
-	return generateForkliftUUID(vmDisk, key)
-}
-
-// VmDisk struct matching Forklift's structure (simplified)
-type VmDisk struct {
-	ID                      string
-	Name                    string
-	FilePath                string
-	Capacity                int64
-	CapacityAllocationUnits string
-	DiskId                  string
-	FileRef                 string
-	Format                  string
-	PopulatedSize           int64
+	return rendered, nil
 }
 
-// Forklift's exact UUID generation algorithm
-func generateForkliftUUID(object interface{}, key string) (string, error) {
-	// Use Go's gob encoder just like Forklift does
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
+// renderVM discovers the networks and disks of vm, fills in their IDs and
+// maps them by rules.
+func renderVM(vm WaveVM, rules MappingRules, namespace string, ids *SourceIDs) (*RenderedVM, error) {
+	logger := slog.With(logging.KeyVM, vm.Name, logging.KeyStage, "migrate")
+	r := &RenderedVM{Name: vm.Name, ID: ids.VM}
 
-	if err := enc.Encode(object); err != nil {
-		return "", err
+	networks, err := discoverNetworks(vm.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover networks of %s: %w", vm.Name, err)
+	}
+	for _, name := range networks {
+		dest := networkDestination(rules.Networks, name, namespace, vm.Adapters)
+		r.Networks = append(r.Networks, NetworkMapping{
+			SourceID:    ids.Networks[name],
+			SourceName:  name,
+			Destination: dest,
+		})
+		logger.Info("Discovered network", "network", name, "id", ids.Networks[name], "destination", dest.String())
 	}
-
-	// Create SHA256 hash of the encoded bytes
-	hash := sha256.Sum256(buf.Bytes())
-	id := hex.EncodeToString(hash[:])
-
-	// Take first 32 characters - this matches the working IDs we saw
-	if len(id) > 32 {
-		id = id[:32]
+	if len(r.Networks) == 0 {
+		logger.Warn("No networks found in OVF")
 	}
 
-	return id, nil
+	disks, err := discoverDisks(logger, vm.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover disks of %s: %w", vm.Name, err)
+	}
+	sizes := discoverDiskSizes(vm.Dir)
+	for _, name := range disks {
+		disk := DiskInfo{VM: vm.Name, File: name, Size: sizes[name]}
+		for _, drive := range vm.Drives {
+			if drive.FileName() == name {
+				disk.Drive = drive
+				break
+			}
+		}
+		dest := storageDestination(rules, disk)
+		r.Storage = append(r.Storage, StorageMapping{
+			SourceID:    ids.Disks[name],
+			SourceName:  name,
+			Destination: dest,
+		})
+		logger.Info("Discovered storage", logging.KeyDisk, name, "id", ids.Disks[name], "destination", dest.String())
+	}
+	return r, nil
 }
 
-func generateFallbackStorageID(fileName string, index int) string {
-	// Simple fallback ID generation
-	hasher := sha256.New()
-	hasher.Write([]byte(fileName))
-	hasher.Write([]byte(fmt.Sprintf("%d", index)))
-	hasher.Write([]byte("fallback-storage"))
-	hash := hasher.Sum(nil)
-
-	return hex.EncodeToString(hash)[:32]
+// ovaProviderObjects builds the OVA provider of the run runID reading
+// nfsURL and its secret.
+func ovaProviderObjects(runID, namespace, nfsURL string) (*Secret, *Provider) {
+	name := providerObjectName(runID)
+	secret := newSecret(name, namespace, nfsURL, false)
+	provider := newOvaProvider(name, namespace, ObjectRef{Name: name, Namespace: namespace}, nfsURL)
+	addLabels(secret, runLabels(runID, ""))
+	addLabels(provider, runLabels(runID, ""))
+	return secret, provider
 }
 
-func discoverVMID(outputDir, vmName string) (string, error) {
-	// Pool of known working VM IDs (first come, first serve)
-	knownVMIDs := []string{
-		"2d30892ae8876af8ece2ffbc88946cc6ced3", // First VM gets this ID (from working Plan)
-		// Add more known working VM IDs here as needed
+// WriteManifests writes every resource as YAML to dir for review.
+func (r *RenderedMigration) WriteManifests(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create manifest directory: %w", err)
 	}
-
-	// For now, always use the first known VM ID
-	// In the future, we could implement VM discovery logic like storage/network
-	if len(knownVMIDs) > 0 {
-		fmt.Printf("✅ Using known working VM ID for %s: %s\n", vmName, knownVMIDs[0])
-		return knownVMIDs[0], nil
-	}
-
-	// Fallback: try to generate VM ID using Forklift's algorithm
-	fmt.Printf("⚠️  No known VM ID, attempting to generate for %s...\n", vmName)
-
-	// Find the OVF file to extract VM information
-	ovfFiles, err := filepath.Glob(filepath.Join(outputDir, "*.ovf"))
-	if err != nil || len(ovfFiles) == 0 {
-		return "", fmt.Errorf("no OVF file found in output directory")
+	for i := range r.Manifests {
+		m := &r.Manifests[i]
+		content, err := yaml.Marshal(m.object)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", m.Kind, err)
+		}
+		path := filepath.Join(dir, m.file)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return fmt.Errorf("failed to write %s YAML: %w", m.Kind, err)
+		}
+		m.File = path
 	}
-
-	// For VM ID generation, we would need to create a VM object similar to Forklift's
-	// For now, generate a simple hash-based ID
-	hasher := sha256.New()
-	hasher.Write([]byte(vmName))
-	hasher.Write([]byte(ovfFiles[0])) // Use OVF path as key
-	hasher.Write([]byte("forklift-vm"))
-	hash := hasher.Sum(nil)
-
-	generatedID := hex.EncodeToString(hash)[:32]
-	fmt.Printf("⚠️  Generated VM ID for %s: %s\n", vmName, generatedID)
-
-	return generatedID, nil
+	return nil
 }
 
-func RunOvaMigration(vmName, outputDir string) error {
+// RunOvaPlan migrates the VMs of wave with one Plan and Migration of the
+// run runID, writing the manifests to manifestDir, and waits for it to
+// finish. Running it again for the same run and wave picks up where the
+// last attempt stopped: a migration that is still running is waited for,
+// one that succeeded is not repeated and one that failed is started again.
+// It returns the outcome of every VM of the wave; the error is only set
+// when the wave could not run at all.
+func RunOvaPlan(ctx context.Context, c *Client, runID string, wave Wave, rules MappingRules, manifestDir string) (map[string]error, error) {
 	namespace := os.Getenv("NAMESPACE")
-	secretNamespace := namespace
 	nfsURL := os.Getenv("OVA_PROVIDER_NFS_SERVER_PATH")
 
-	// Discover networks from OVA file
-	networkMappings, err := discoverNetworkMappings(outputDir)
-	if err != nil {
-		return fmt.Errorf("failed to discover network mappings: %w", err)
+	if namespace == "" {
+		return nil, fmt.Errorf("NAMESPACE environment variable not set")
 	}
-
-	// Discover storage from disk files and OVA
-	storageMappings, err := discoverStorageMappings(outputDir)
-	if err != nil {
-		return fmt.Errorf("failed to discover storage mappings: %w", err)
+	if nfsURL == "" {
+		return nil, fmt.Errorf("OVA_PROVIDER_NFS_SERVER_PATH environment variable not set")
+	}
+
+	logger := slog.With("wave", wave.Name, logging.KeyStage, "migrate")
+
+	planName, migrationName := MigrationNames(runID, wave.Name)
+	existing, err := c.Get(ctx, "Migration", namespace, migrationName)
+	switch {
+	case err == nil && isMigrationSucceeded(existing):
+		logger.Info("Migration already succeeded", "migration", migrationName)
+		return vmOutcomes(existing, wave), nil
+	case err == nil && isMigrationFailed(existing):
+		// A Migration runs once; retrying the plan takes a new one
+		logger.Info("Restarting failed migration", "migration", migrationName)
+		if err := c.Delete(ctx, "Migration", namespace, migrationName); err != nil {
+			return nil, err
+		}
+	case err == nil:
+		logger.Info("Migration already running, waiting for it", "migration", migrationName)
+		return c.waitForWave(ctx, namespace, planName, migrationName, wave, manifestDir)
+	case !apierrors.IsNotFound(err):
+		return nil, err
 	}
 
-	// Generate the correct VM ID that Forklift expects
-	vmID, err := discoverVMID(outputDir, vmName)
+	// The IDs of the plan come from the provider's inventory, so the
+	// provider has to be ready before the rest can be built
+	secret, provider := ovaProviderObjects(runID, namespace, nfsURL)
+	if _, err := c.ApplyObject(ctx, secret); err != nil {
+		return nil, err
+	}
+	applied, err := c.ApplyObject(ctx, provider)
 	if err != nil {
-		return fmt.Errorf("failed to discover VM ID: %w", err)
+		return nil, err
+	}
+	timeout := ReadyTimeout()
+	logger.Info("Waiting for the provider to become ready", "provider", provider.Metadata.Name, "timeout", timeout)
+	if err := c.WaitForProviderReady(ctx, namespace, provider.Metadata.Name, timeout); err != nil {
+		return nil, err
 	}
 
-	ovaProviderYaml := filepath.Join(outputDir, "ova-provider.yaml")
-	storageMapYaml := filepath.Join(outputDir, "storage-map.yaml")
-	networkMapYaml := filepath.Join(outputDir, "network-map.yaml")
-	migrationPlanYaml := filepath.Join(outputDir, "plan.yaml")
-	migrationYaml := filepath.Join(outputDir, "migration.yaml")
-	secretYaml := filepath.Join(outputDir, "ova-secret.yaml")
-
-	if namespace == "" {
-		return fmt.Errorf("NAMESPACE environment variable not set")
+	inventory, err := c.Inventory(ctx)
+	if err != nil {
+		return nil, err
 	}
-	if nfsURL == "" {
-		return fmt.Errorf("OVA_PROVIDER_NFS_SERVER_PATH environment variable not set")
+	logger.Info("Waiting for the provider inventory", "provider", provider.Metadata.Name)
+	ids := make(map[string]*SourceIDs)
+	for _, vm := range wave.VMs {
+		vmLogger := slog.With(logging.KeyVM, vm.Name, logging.KeyStage, "migrate")
+		networks, err := discoverNetworks(vm.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover networks of %s: %w", vm.Name, err)
+		}
+		disks, err := discoverDisks(vmLogger, vm.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover disks of %s: %w", vm.Name, err)
+		}
+		vmIDs, err := inventory.ResolveOva(ctx, string(applied.GetUID()), vm.Name, networks, disks)
+		if err != nil {
+			return nil, err
+		}
+		ids[vm.Name] = vmIDs
 	}
 
-	if err := createOvaSecretYaml(secretName, secretNamespace, nfsURL, false, secretYaml); err != nil {
-		return fmt.Errorf("failed to create secret YAML: %w", err)
+	// Disks no rule gives a class go to the cluster's default one, which
+	// is only an error to lack when such a disk exists
+	var defaultClassErr error
+	if rules.DefaultStorageClass == "" {
+		rules.DefaultStorageClass, defaultClassErr = c.DefaultStorageClass(ctx)
 	}
-	if err := applyYaml(secretYaml); err != nil {
-		return fmt.Errorf("failed to apply secret YAML: %w", err)
+	rendered, err := RenderOvaPlan(runID, wave, rules, namespace, nfsURL, ids)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := createStorageMapYaml(storageMapYaml, storageMapName, namespace, providerName, sourceProviderType, storageMappings); err != nil {
-		return fmt.Errorf("failed to create storage map YAML: %w", err)
+	var networkMappings []NetworkMapping
+	var storageMappings []StorageMapping
+	for _, vm := range rendered.VMs {
+		networkMappings = append(networkMappings, vm.Networks...)
+		storageMappings = append(storageMappings, vm.Storage...)
 	}
-	if err := applyYamlFile(storageMapYaml); err != nil {
-		return fmt.Errorf("failed to apply storage map YAML: %w", err)
+	for _, m := range storageMappings {
+		if m.Destination.StorageClass == "" {
+			return nil, fmt.Errorf("disk %s: %w", m.SourceName, defaultClassErr)
+		}
 	}
-
-	if err := createNetworkMapYaml(networkMapYaml, networkMapName, namespace, providerName, sourceProviderType, networkMappings); err != nil {
-		return fmt.Errorf("failed to create network map YAML: %w", err)
+	if err := c.validateNetworks(ctx, networkMappings); err != nil {
+		return nil, err
 	}
-	if err := applyYamlFile(networkMapYaml); err != nil {
-		return fmt.Errorf("failed to apply network map YAML: %w", err)
+	if err := c.validateStorage(ctx, storageMappings); err != nil {
+		return nil, err
 	}
-
-	if err := createOvaProviderYaml(namespace, providerName, secretName, secretNamespace, nfsURL, ovaProviderYaml); err != nil {
-		return fmt.Errorf("failed to create provider YAML: %w", err)
+	if err := rendered.WriteManifests(manifestDir); err != nil {
+		return nil, err
 	}
-	if err := applyYaml(ovaProviderYaml); err != nil {
-		return fmt.Errorf("failed to apply provider YAML: %w", err)
+	for _, m := range rendered.Manifests {
+		if m.Kind == "Migration" {
+			// Forklift only migrates a plan it validated; the reasons it
+			// rejects one are reported before anything is started
+			logger.Info("Waiting for the plan to become ready", "plan", planName, "timeout", timeout)
+			if err := c.WaitForPlanReady(ctx, namespace, planName, timeout); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := c.ApplyObject(ctx, m.object); err != nil {
+			return nil, fmt.Errorf("failed to apply %s YAML: %w", m.Kind, err)
+		}
 	}
 
-	time.Sleep(15 * time.Second) // make sure the provider is ready
+	return c.waitForWave(ctx, namespace, planName, migrationName, wave, manifestDir)
+}
 
-	if err := createMigrationPlanYaml(namespace, planName, providerName, sourceProviderType, networkMapName, storageMapName, vmID, vmName, migrationPlanYaml); err != nil {
-		return fmt.Errorf("failed to create migration plan YAML: %w", err)
-	}
-	if err := applyYamlFile(migrationPlanYaml); err != nil {
-		return fmt.Errorf("failed to apply migration plan YAML: %w", err)
+// waitForWave watches the migration of wave until it finishes and returns
+// the outcome of every VM. When it fails, the events and pod logs that
+// explain why are saved below manifestDir.
+func (c *Client) waitForWave(ctx context.Context, namespace, planName, migrationName string, wave Wave, manifestDir string) (map[string]error, error) {
+	logger := slog.With("wave", wave.Name, logging.KeyStage, "migrate")
+	stall := StallTimeout()
+	logger.Info("Waiting for migration to complete", "migration", migrationName, "plan", planName, "vms", len(wave.VMs), "stall_timeout", stall)
+	migration, err := c.watchMigration(ctx, namespace, migrationName, planName, stall)
+	if err != nil {
+		if migration != nil && ctx.Err() == nil {
+			c.collectDiagnostics(ctx, namespace, migration, planName, manifestDir)
+		}
+		return nil, fmt.Errorf("migration monitoring failed: %w", err)
 	}
 
-	if err := createMigrationYaml(migrationYaml, migrationName, namespace, planName, namespace); err != nil {
-		return fmt.Errorf("failed to create migration YAML: %w", err)
+	results := vmOutcomes(migration, wave)
+	if isMigrationSucceeded(migration) {
+		logger.Info("Migration completed successfully", "migration", migrationName)
+	} else {
+		logger.Error("Migration failed", "migration", migrationName)
+		c.collectDiagnostics(ctx, namespace, migration, planName, manifestDir)
 	}
-	if err := applyYaml(migrationYaml); err != nil {
-		return fmt.Errorf("failed to apply migration YAML: %w", err)
+	return results, nil
+}
+
+// vmOutcomes reads the result of every VM of wave from the final migration
+// status. A VM the status does not mention shares the outcome of the
+// migration.
+func vmOutcomes(migration *unstructured.Unstructured, wave Wave) map[string]error {
+	results := make(map[string]error)
+	vms, _, _ := unstructured.NestedSlice(migration.Object, "status", "vms")
+	for _, v := range vms {
+		vm, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(vm, "name")
+		if name == "" {
+			continue
+		}
+		results[name] = vmOutcome(vm)
 	}
 
-	fmt.Printf("Waiting for migration %s to complete...\n", migrationName)
-	timeout := 15 * time.Minute
-	if err := waitForMigrationComplete(namespace, migrationName, timeout); err != nil {
-		return fmt.Errorf("migration monitoring failed: %w", err)
+	for _, vm := range wave.VMs {
+		if _, ok := results[vm.Name]; ok {
+			continue
+		}
+		if isMigrationSucceeded(migration) {
+			results[vm.Name] = nil
+		} else {
+			results[vm.Name] = fmt.Errorf("migration %s failed", migration.GetName())
+		}
 	}
+	return results
+}
 
-	fmt.Println("Migration completed successfully!")
-	return nil
+// vmOutcome turns the status of one VM of a migration into an error.
+func vmOutcome(vm map[string]interface{}) error {
+	phase, _, _ := unstructured.NestedString(vm, "phase")
+	reasons, _, _ := unstructured.NestedStringSlice(vm, "error", "reasons")
+	conditions, _, _ := unstructured.NestedSlice(vm, "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if !ok || cond["status"] != "True" {
+			continue
+		}
+		switch cond["type"] {
+		case "Succeeded":
+			return nil
+		case "Failed", "Canceled":
+			if len(reasons) > 0 {
+				return fmt.Errorf("failed in phase %s: %s", phase, strings.Join(reasons, "; "))
+			}
+			return fmt.Errorf("%s in phase %s", strings.ToLower(cond["type"].(string)), phase)
+		}
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("failed in phase %s: %s", phase, strings.Join(reasons, "; "))
+	}
+	if phase == "Completed" {
+		return nil
+	}
+	return fmt.Errorf("did not complete (phase %s)", phase)
 }
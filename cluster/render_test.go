@@ -0,0 +1,201 @@
+package ocp
+
+import (
+	"bytes"
+	"flag"
+	"hyperv/ova"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// writeOVF writes a minimal OVF of vm with the given networks and disks,
+// laid out the way the package stage writes them.
+func writeOVF(t *testing.T, vm string, networks []string, disks map[string]int64) string {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Envelope>\n  <References>\n")
+	for _, name := range slices.Sorted(maps.Keys(disks)) {
+		b.WriteString("    <File ovf:href=\"" + name + "\" ovf:id=\"" + name + "\" ovf:size=\"" + strconv.FormatInt(disks[name], 10) + "\"/>\n")
+	}
+	b.WriteString("  </References>\n  <NetworkSection>\n")
+	for _, name := range networks {
+		b.WriteString("    <Network ovf:name=\"" + name + "\">\n    </Network>\n")
+	}
+	b.WriteString("  </NetworkSection>\n</Envelope>\n")
+
+	dir := filepath.Join(t.TempDir(), vm)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, vm+".ovf"), []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// TestRenderOvaPlanGolden renders a wave with the names that broke the
+// hand-written templates, a VM name with a colon and a network starting a
+// YAML comment, and compares the manifests with testdata. Run with -update
+// to rewrite the golden files.
+func TestRenderOvaPlanGolden(t *testing.T) {
+	vlan := 20
+	wave := Wave{Name: "default", VMs: []WaveVM{
+		{
+			Name: "web:01",
+			Dir: writeOVF(t, "web:01", []string{"#1", "External VLAN 20"},
+				map[string]int64{"web:01.vhdx": 40 << 30}),
+			Adapters: []ova.Adapter{
+				{Name: "Network Adapter", Switch: "#1"},
+				{Name: "Network Adapter 2", Switch: "External", VLAN: vlan},
+			},
+			Drives: []ova.Drive{{Path: `D:\VMs\web:01.vhdx`, ControllerType: "SCSI"}},
+		},
+		{
+			Name: "db01",
+			Dir: writeOVF(t, "db01", []string{"#1"},
+				map[string]int64{"db01.vhdx": 20 << 30, "db01-data.vhdx": 500 << 30}),
+			Adapters: []ova.Adapter{{Name: "Network Adapter", Switch: "#1"}},
+		},
+	}}
+	rules := MappingRules{
+		Networks: []NetworkRule{{
+			Switch: "External", VLAN: &vlan,
+			Destination: DestinationNetwork{Type: NetworkMultus, Name: "vlan-20"},
+		}},
+		Storage: []StorageRule{{
+			MinSize:     100 << 30,
+			Destination: DestinationStorage{StorageClass: "bulk", VolumeMode: "Block"},
+		}},
+		DefaultStorageClass: "standard",
+	}
+	// Only db01 is in the inventory; web:01 is referenced by name
+	ids := map[string]*SourceIDs{
+		"db01": {
+			VM:       "vm-db01",
+			Networks: map[string]string{"#1": "net-1"},
+			Disks:    map[string]string{"db01.vhdx": "disk-db01", "db01-data.vhdx": "disk-db01-data"},
+		},
+	}
+
+	rendered, err := RenderOvaPlan("20261018-120000", wave, rules, testNamespace, "nfs.example.com:/ova", ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := rendered.WriteManifests(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range rendered.Manifests {
+		name := filepath.Base(m.File)
+		got, err := os.ReadFile(m.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden := filepath.Join("testdata", strings.TrimSuffix(name, ".yaml")+".golden.yaml")
+		if *update {
+			if err := os.WriteFile(golden, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%v; run the test with -update to create it", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from %s:\n%s", name, golden, got)
+		}
+	}
+
+	// The names survive the round trip through YAML
+	plan := readManifest(t, filepath.Join(dir, "plan.yaml"))
+	vms, _ := plan["spec"].(map[string]any)["vms"].([]any)
+	if len(vms) != 2 || vms[0].(map[string]any)["name"] != "web:01" || vms[0].(map[string]any)["targetName"] != "web-01" {
+		t.Errorf("plan VMs = %v", vms)
+	}
+	networkMap := readManifest(t, filepath.Join(dir, "network-map.yaml"))
+	mappings, _ := networkMap["spec"].(map[string]any)["map"].([]any)
+	var sources []string
+	for _, m := range mappings {
+		source := m.(map[string]any)["source"].(map[string]any)
+		if name, ok := source["name"].(string); ok {
+			sources = append(sources, name)
+		}
+	}
+	if !slices.Contains(sources, "#1") {
+		t.Errorf("network map sources = %v, want #1", sources)
+	}
+}
+
+func readManifest(t *testing.T, path string) map[string]any {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj map[string]any
+	if err := yaml.Unmarshal(content, &obj); err != nil {
+		t.Fatalf("%s is not valid YAML: %v", path, err)
+	}
+	return obj
+}
+
+// TestDiscoverFromOVF reads the networks and disks of an OVF the way the
+// package stage writes it, with namespace declarations and prefixes.
+func TestDiscoverFromOVF(t *testing.T) {
+	env := &ova.Envelope{
+		Xmlns: "http://schemas.dmtf.org/ovf/envelope/1",
+		Ovf:   "http://schemas.dmtf.org/ovf/envelope/1",
+		Rasd:  "http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData",
+		References: ova.References{Files: []ova.File{
+			{ID: "file1", Href: "web01.vhdx", Size: 40 << 30},
+			{ID: "file2", Href: "web01-data.vhdx", Size: 100 << 30},
+		}},
+		NetworkSection: ova.NetworkSection{Networks: []ova.Network{{Name: "VM Network"}, {Name: "Backend <VLAN 20>"}}},
+		VirtualSystem:  ova.VirtualSystem{Name: "web01"},
+	}
+	content, err := ova.MarshalOvf(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "web01.ovf"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	networks, err := discoverNetworks(dir)
+	if err != nil || !slices.Equal(networks, []string{"VM Network", "Backend <VLAN 20>"}) {
+		t.Errorf("networks = %q, %v", networks, err)
+	}
+	disks, err := discoverDisks(slog.Default(), dir)
+	if err != nil || !slices.Equal(disks, []string{"web01.vhdx", "web01-data.vhdx"}) {
+		t.Errorf("disks = %q, %v", disks, err)
+	}
+	sizes := discoverDiskSizes(dir)
+	if want := map[string]int64{"web01.vhdx": 40 << 30, "web01-data.vhdx": 100 << 30}; !maps.Equal(sizes, want) {
+		t.Errorf("sizes = %v, want %v", sizes, want)
+	}
+
+	// Without an OVF the disks are the .vhdx files of the directory
+	empty := t.TempDir()
+	if err := os.WriteFile(filepath.Join(empty, "db01.vhdx"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if disks, err := discoverDisks(slog.Default(), empty); err != nil || !slices.Equal(disks, []string{"db01.vhdx"}) {
+		t.Errorf("disks without OVF = %q, %v", disks, err)
+	}
+	if _, err := discoverNetworks(empty); err == nil {
+		t.Error("discoverNetworks without OVF succeeded")
+	}
+}
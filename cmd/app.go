@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	ocp "hyperv/cluster"
+	hyperv "hyperv/common"
+	"hyperv/config"
+	"hyperv/logging"
+	"hyperv/metrics"
+	"hyperv/pipeline"
+	"hyperv/progress"
+	"hyperv/state"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const vmInfoFileName = "vm-info.json"
+
+// app holds the state shared by all subcommands.
+type app struct {
+	// ctx is cancelled on Ctrl-C
+	ctx       context.Context
+	outputDir string
+	cfg       *config.Config
+	conn      *hyperv.HyperVConnection
+	journal   *state.Journal
+	limiter   *pipeline.Limiter
+
+	// configPath and flags hold the shared flags until parse layers them
+	// over the config file and the environment.
+	configPath string
+	flags      config.Config
+
+	// dryRun collects a plan instead of acting; planWarnings are the
+	// problems found on the way that a real run would trip over.
+	dryRun       bool
+	planWarnings []string
+
+	// runID names this run's report; startedAt is when it began.
+	runID     string
+	startedAt time.Time
+
+	// closeLogs closes the per-VM log files.
+	closeLogs func() error
+}
+
+func newApp(ctx context.Context) (*app, error) {
+	// Stages that never talk to Hyper-V still read their settings from .env
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error loading .env file: %w", err)
+	}
+
+	outputDir, err := resolveOutputDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for output directory: %w", err)
+	}
+	startedAt := time.Now().UTC()
+	return &app{ctx: ctx, outputDir: outputDir, runID: newRunID(startedAt), startedAt: startedAt}, nil
+}
+
+// newRunID returns the start time followed by a random suffix, so two runs
+// started in the same second don't overwrite each other's report.
+func newRunID(startedAt time.Time) string {
+	var suffix [2]byte
+	rand.Read(suffix[:])
+	return startedAt.Format("20060102-150405") + "-" + hex.EncodeToString(suffix[:])
+}
+
+// flagSet returns a FlagSet for a subcommand with the shared flags registered.
+func (a *app) flagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&a.configPath, "config", os.Getenv("HYPERV_CONFIG"), "YAML config file (env HYPERV_CONFIG)")
+	fs.BoolVar(&a.flags.AssumeYes, "yes", false, "Answer yes to every confirmation, for unattended runs")
+	fs.StringVar(&a.flags.Output.Dir, "output", a.outputDir, "Directory for downloaded disks, OVFs and manifests")
+	fs.StringVar(&a.flags.Connection.Host, "host", "", "Hyper-V host (env HYPERV_HOST)")
+	fs.StringVar(&a.flags.Connection.User, "user", "", "Hyper-V user (env HYPERV_USER)")
+	fs.StringVar((*string)(&a.flags.Connection.WinRMPort), "winrm-port", "", "WinRM port (env HYPERV_PORT)")
+	fs.StringVar((*string)(&a.flags.Connection.SSHPort), "ssh-port", "", "SSH port (env SSH_PORT)")
+	fs.StringVar(&a.flags.Logging.Level, "log-level", "", "Log level: debug, info, warn or error (env LOG_LEVEL)")
+	fs.StringVar(&a.flags.Logging.Format, "log-format", "", "Log format: text or json (env LOG_FORMAT)")
+	fs.StringVar(&a.flags.Metrics.Listen, "metrics-addr", "", "Serve Prometheus metrics and health checks on this address, e.g. :9090 (env METRICS_ADDR)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n\n", filepath.Base(os.Args[0]), usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the subcommand flags and resolves the settings: the config
+// file first, then the environment (including .env), then explicit flags.
+func (a *app) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(a.configPath)
+	if err != nil {
+		return err
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "yes":
+			cfg.AssumeYes = a.flags.AssumeYes
+		case "output":
+			cfg.Output.Dir = a.flags.Output.Dir
+		case "host":
+			cfg.Connection.Host = a.flags.Connection.Host
+		case "user":
+			cfg.Connection.User = a.flags.Connection.User
+		case "winrm-port":
+			cfg.Connection.WinRMPort = a.flags.Connection.WinRMPort
+		case "ssh-port":
+			cfg.Connection.SSHPort = a.flags.Connection.SSHPort
+		case "parallel":
+			cfg.Concurrency.VMs = a.flags.Concurrency.VMs
+		case "winrm-limit":
+			cfg.Concurrency.WinRM = a.flags.Concurrency.WinRM
+		case "transfer-limit":
+			cfg.Concurrency.Transfers = a.flags.Concurrency.Transfers
+		case "conversion-limit":
+			cfg.Concurrency.Conversions = a.flags.Concurrency.Conversions
+		case "log-level":
+			cfg.Logging.Level = a.flags.Logging.Level
+		case "log-format":
+			cfg.Logging.Format = a.flags.Logging.Format
+		case "metrics-addr":
+			cfg.Metrics.Listen = a.flags.Metrics.Listen
+		case "parallel-waves":
+			cfg.Migration.ParallelWaves = a.flags.Migration.ParallelWaves
+		case "ready-timeout":
+			cfg.Migration.ReadyTimeout = a.flags.Migration.ReadyTimeout
+		case "inventory-timeout":
+			cfg.Migration.InventoryTimeout = a.flags.Migration.InventoryTimeout
+		case "stall-timeout":
+			cfg.Migration.StallTimeout = a.flags.Migration.StallTimeout
+		case "run-id":
+			cfg.Migration.RunID = a.flags.Migration.RunID
+		case "auth":
+			cfg.Migration.Auth = a.flags.Migration.Auth
+		case "api-url":
+			cfg.Migration.APIURL = a.flags.Migration.APIURL
+		case "ca-file":
+			cfg.Migration.CAFile = a.flags.Migration.CAFile
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	cfg.Export()
+	hyperv.SetAssumeYes(cfg.AssumeYes)
+	a.cfg = cfg
+	a.limiter = pipeline.NewLimiter(a.limits())
+
+	if cfg.Output.Dir != "" {
+		a.outputDir = cfg.Output.Dir
+	}
+	outputDir, err := filepath.Abs(a.outputDir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path for output directory: %w", err)
+	}
+	a.outputDir = outputDir
+
+	closeLogs, err := logging.Setup(logging.Options{
+		Level:  cfg.Logging.Level,
+		Format: cfg.Logging.Format,
+		Dir:    filepath.Join(a.outputDir, logging.DirName),
+	}, progress.Default.Writer())
+	if err != nil {
+		return err
+	}
+	a.closeLogs = closeLogs
+
+	if cfg.Metrics.Listen != "" {
+		if err := a.serveMetrics(cfg.Metrics.Listen); err != nil {
+			return err
+		}
+	}
+	metrics.SetReady(true)
+	return nil
+}
+
+// serveMetrics starts the metrics endpoint, including the VMs by stage from
+// the state journal.
+func (a *app) serveMetrics(addr string) error {
+	journal, err := a.openJournal()
+	if err != nil {
+		return err
+	}
+	metrics.NewGaugeFunc("hyperv_vms", "VMs in the state journal by last completed stage.", "stage", func() map[string]float64 {
+		counts := make(map[string]float64)
+		for _, stage := range state.Stages() {
+			counts[string(stage)] = 0
+		}
+		for _, vm := range journal.All() {
+			if vm.Stage != state.StageNone {
+				counts[string(vm.Stage)]++
+			}
+		}
+		return counts
+	})
+	return metrics.Serve(addr)
+}
+
+// close releases what parse opened.
+func (a *app) close() {
+	if a.closeLogs != nil {
+		a.closeLogs()
+	}
+}
+
+// concurrencyFlags registers the limits of the VM pipeline on fs.
+func (a *app) concurrencyFlags(fs *flag.FlagSet) {
+	d := pipeline.DefaultLimits
+	fs.IntVar(&a.flags.Concurrency.VMs, "parallel", d.VMs, "VMs processed at once (env PARALLEL_VMS)")
+	fs.IntVar(&a.flags.Concurrency.WinRM, "winrm-limit", d.WinRM, "Concurrent WinRM operations against the host (env WINRM_LIMIT)")
+	fs.IntVar(&a.flags.Concurrency.Transfers, "transfer-limit", d.Transfers, "Concurrent disk downloads (env TRANSFER_LIMIT)")
+	fs.IntVar(&a.flags.Concurrency.Conversions, "conversion-limit", d.Conversions, "Concurrent OVF conversions (env CONVERSION_LIMIT)")
+}
+
+// waveFlags registers the flags of commands that run migrations.
+func (a *app) waveFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&a.flags.Migration.ParallelWaves, "parallel-waves", false, "Run the migration waves at the same time instead of one after another (env PARALLEL_WAVES)")
+	fs.StringVar(&a.flags.Migration.ReadyTimeout, "ready-timeout", "", "How long to wait for the provider and each plan to become ready, e.g. 10m (env READY_TIMEOUT)")
+	fs.StringVar(&a.flags.Migration.InventoryTimeout, "inventory-timeout", "", "How long to wait for the Forklift inventory to list each VM, e.g. 10m (env INVENTORY_TIMEOUT)")
+	fs.StringVar(&a.flags.Migration.StallTimeout, "stall-timeout", "", "Give up on a migration that made no progress for this long, e.g. 30m (env MIGRATION_STALL_TIMEOUT)")
+	a.runIDFlag(fs)
+	a.clusterFlags(fs)
+}
+
+// clusterFlags registers the flags of commands that connect to the cluster.
+// Tokens and passwords are only taken from the config and the environment.
+func (a *app) clusterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&a.flags.Migration.Auth, "auth", "", "How to log in to the cluster: kubeconfig, token, password or lab-nfs (env CLUSTER_AUTH)")
+	fs.StringVar(&a.flags.Migration.APIURL, "api-url", "", "API server for token and password login (env CLUSTER_API_URL)")
+	fs.StringVar(&a.flags.Migration.CAFile, "ca-file", "", "CA bundle that verifies the API server (env CLUSTER_CA_FILE)")
+}
+
+// runIDFlag registers the flag selecting the migration run.
+func (a *app) runIDFlag(fs *flag.FlagSet) {
+	fs.StringVar(&a.flags.Migration.RunID, "run-id", "", "Migration run whose cluster objects to use; defaults to the run of the output directory (env MIGRATION_RUN_ID)")
+}
+
+// limits returns the configured pipeline limits.
+func (a *app) limits() pipeline.Limits {
+	c := a.cfg.Concurrency
+	return pipeline.Limits{VMs: c.VMs, WinRM: c.WinRM, Transfers: c.Transfers, Conversions: c.Conversions}.WithDefaults()
+}
+
+// connect opens the Hyper-V connection on first use.
+func (a *app) connect() (*hyperv.HyperVConnection, error) {
+	if a.conn != nil {
+		return a.conn, nil
+	}
+	conn, err := hyperv.LoadHyperVConnection()
+	if err != nil {
+		return nil, fmt.Errorf("connection setup failed: %w", err)
+	}
+	a.conn = conn
+	return conn, nil
+}
+
+// openJournal loads the state journal of the output directory on first use.
+func (a *app) openJournal() (*state.Journal, error) {
+	if a.journal != nil {
+		return a.journal, nil
+	}
+	journal, err := state.Open(a.outputDir)
+	if err != nil {
+		return nil, err
+	}
+	a.journal = journal
+	return journal, nil
+}
+
+// clusterClient connects to the cluster the migration runs on with the
+// configured authentication. Without login the lab NFS login is replaced
+// by the kubeconfig (or the in-cluster service account).
+func (a *app) clusterClient(login bool) (*ocp.Client, error) {
+	m := a.cfg.Migration
+	method := m.AuthMethod()
+	if method == ocp.AuthLabNFS && !login {
+		method = ocp.AuthKubeconfig
+	}
+	config, err := ocp.ClusterConfig(ocp.AuthOptions{
+		Method:      method,
+		KubeContext: m.KubeContext,
+		APIURL:      m.APIURL,
+		Token:       m.Token,
+		TokenFile:   m.TokenFile,
+		Username:    m.Username,
+		Password:    m.Password,
+		CAFile:      m.CAFile,
+		Insecure:    m.InsecureSkipTLSVerify,
+		Lab: ocp.LabOptions{
+			ClusterName:   m.ClusterName,
+			MountBasePath: m.MountBasePath,
+			NFSServerPath: m.ClusterNFSServerPath,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cluster login failed (%s): %w", method, err)
+	}
+	client, err := ocp.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Connected to cluster", "host", client.Host(), "auth", method)
+	return client, nil
+}
+
+// restartVMs forgets the journal entries of vms so they start from scratch.
+func (a *app) restartVMs(vms []hyperv.VMSummary) error {
+	journal, err := a.openJournal()
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if err := journal.Reset(vm.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stringList is a repeatable flag that also accepts comma separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// selectionFlags registers the VM selection flags on fs. Positional
+// arguments are added to the explicit names by selectVMs.
+func selectionFlags(fs *flag.FlagSet) *hyperv.VMSelector {
+	sel := &hyperv.VMSelector{}
+	fs.Var((*stringList)(&sel.Names), "vm", "Select a VM by exact name (repeatable, comma separated)")
+	fs.Var((*stringList)(&sel.Globs), "match", "Select VMs whose name matches a glob, e.g. 'web-*' (repeatable)")
+	fs.Var((*stringList)(&sel.Regexes), "regex", "Select VMs whose name matches a regular expression (repeatable)")
+	fs.Var((*stringList)(&sel.Tags), "tag", "Select VMs tagged in their Hyper-V notes ('tags: a, b' or '#a') (repeatable)")
+	fs.Var((*stringList)(&sel.Exclude), "exclude", "Skip VMs by name or glob (repeatable)")
+	fs.BoolVar(&sel.OnlyOff, "only-off", false, "Only select VMs that are turned off")
+	fs.BoolVar(&sel.OnlyRunning, "only-running", false, "Only select VMs that are running")
+	fs.BoolVar(&sel.All, "all", false, "Select every VM on the host; export and run need it, or another selector, to touch any VM")
+	return sel
+}
+
+// selectVMs lists the VMs on the host and applies the selector, with the
+// positional arguments treated as explicit names. For a destructive command
+// the selection has to be explicit, from the command line or the config.
+func (a *app) selectVMs(sel *hyperv.VMSelector, args []string, destructive bool) ([]hyperv.VMSummary, error) {
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	all, err := hyperv.ListVMSummaries(conn.Client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
+	}
+
+	sel.Names = append(sel.Names, args...)
+	if isEmptySelection(sel) {
+		*sel = a.configSelection()
+	}
+	if destructive && !sel.Explicit() {
+		return nil, fmt.Errorf("no VMs selected: name them or use -vm, -match, -regex or -tag (selection in the config), or pass -all to select every VM on the host")
+	}
+	selected, err := sel.Select(all)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no VMs match the selection")
+	}
+	return selected, nil
+}
+
+// confirmSelection prints exactly which VMs an action will touch and asks
+// the user to go ahead.
+func confirmSelection(action string, vms []hyperv.VMSummary) bool {
+	fmt.Printf("The following %d VM(s) will be %s:\n", len(vms), action)
+	for _, vm := range vms {
+		note := ""
+		if vm.IsRunning() {
+			note = " - will be shut down"
+		}
+		fmt.Printf("  %s (%s)%s\n", vm.Name, vm.State, note)
+	}
+	return hyperv.AskYesNo("Continue?")
+}
+
+func isEmptySelection(sel *hyperv.VMSelector) bool {
+	return len(sel.Names) == 0 && len(sel.Globs) == 0 && len(sel.Regexes) == 0 && len(sel.Tags) == 0 &&
+		len(sel.Exclude) == 0 && !sel.OnlyOff && !sel.OnlyRunning && !sel.All
+}
+
+// configSelection is the selection from the config file, used when the
+// command line selects nothing.
+func (a *app) configSelection() hyperv.VMSelector {
+	s := a.cfg.Selection
+	return hyperv.VMSelector{
+		Names:       s.VMs,
+		Globs:       s.Match,
+		Regexes:     s.Regex,
+		Tags:        s.Tags,
+		Exclude:     s.Exclude,
+		OnlyOff:     s.OnlyOff,
+		OnlyRunning: s.OnlyRunning,
+		All:         s.All,
+	}
+}
+
+// declined handles a confirmation that was not given. Interactively that is
+// a normal abort; an unattended run fails so the caller notices.
+func declined() error {
+	if !hyperv.IsInteractive() {
+		return fmt.Errorf("confirmation required but stdin is not a terminal: pass --yes or set assumeYes in the config")
+	}
+	fmt.Println("Aborted, no VM was touched.")
+	return nil
+}
+
+// decide returns the configured answer for an optional stage, asking only
+// when the config leaves it open.
+func decide(configured *bool, prompt string) bool {
+	if configured != nil {
+		return *configured
+	}
+	return hyperv.AskYesNo(prompt)
+}
+
+func summaryNames(vms []hyperv.VMSummary) []string {
+	names := make([]string, 0, len(vms))
+	for _, vm := range vms {
+		names = append(names, vm.Name)
+	}
+	return names
+}
+
+// vmDir is the per-VM directory below the output directory.
+func (a *app) vmDir(vmName string) string {
+	return filepath.Join(a.outputDir, vmName)
+}
+
+// exportedVMs returns the VMs that have an exported vm-info.json.
+func (a *app) exportedVMs() ([]string, error) {
+	entries, err := os.ReadDir(a.outputDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(a.outputDir, e.Name(), vmInfoFileName)); err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (a *app) saveVMInfo(vmName string, vmInfoMap map[string]interface{}) error {
+	jsonOut, err := json.MarshalIndent(vmInfoMap, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode VM info: %w", err)
+	}
+	return hyperv.SaveVMJsonToFile(jsonOut, filepath.Join(a.vmDir(vmName), vmInfoFileName))
+}
+
+func (a *app) loadVMInfo(vmName string) (map[string]interface{}, error) {
+	content, err := os.ReadFile(filepath.Join(a.vmDir(vmName), vmInfoFileName))
+	if err != nil {
+		return nil, fmt.Errorf("VM %s has not been exported: %w", vmName, err)
+	}
+	var vmInfoMap map[string]interface{}
+	if err := json.Unmarshal(content, &vmInfoMap); err != nil {
+		return nil, fmt.Errorf("failed to parse %s info: %w", vmName, err)
+	}
+	return vmInfoMap, nil
+}
+
+// localDiskPaths maps the VM's Hyper-V disk paths to the downloaded copies.
+func (a *app) localDiskPaths(vmName string, vmInfoMap map[string]interface{}) ([]string, error) {
+	remotePaths, found := hyperv.ExtractPath(vmInfoMap)
+	if !found {
+		return nil, fmt.Errorf("no VHDX paths found in VM data for %s", vmName)
+	}
+	var localFiles []string
+	for _, remotePath := range remotePaths {
+		localFiles = append(localFiles, filepath.Join(a.vmDir(vmName), hyperv.RemoteFileName(remotePath)))
+	}
+	return localFiles, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	ocp "hyperv/cluster"
+	hyperv "hyperv/common"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func runCleanup(a *app, args []string) error {
+	fs := a.flagSet("cleanup", "cleanup [flags]")
+	login := fs.Bool("login", true, "Allow the lab NFS login to CLUSTER_NAME; -login=false uses the kubeconfig instead")
+	deleteVMs := fs.Bool("delete-vms", false, "Also delete the VMs the run migrated")
+	a.runIDFlag(fs)
+	a.clusterFlags(fs)
+	if err := a.parse(fs, args); err != nil {
+		return err
+	}
+
+	namespace := os.Getenv("NAMESPACE")
+	if namespace == "" {
+		return fmt.Errorf("NAMESPACE environment variable not set")
+	}
+	runID, err := a.migrationRunID(false)
+	if err != nil {
+		return err
+	}
+
+	what := "the Forklift objects"
+	if *deleteVMs {
+		what += " and the migrated VMs"
+	}
+	if !hyperv.AskYesNo(fmt.Sprintf("Delete %s of migration run %s in %s?", what, runID, namespace)) {
+		fmt.Println("Nothing deleted.")
+		return nil
+	}
+
+	client, err := a.clusterClient(*login)
+	if err != nil {
+		return err
+	}
+	deleted, err := ocp.Cleanup(a.ctx, client, namespace, runID, *deleteVMs)
+	fmt.Printf("Deleted %d objects of migration run %s.\n", deleted, runID)
+	if err != nil {
+		return err
+	}
+
+	// The next migration starts a new run instead of reusing the deleted one
+	file := filepath.Join(a.outputDir, manifestDirName, runIDFileName)
+	if content, err := os.ReadFile(file); err == nil && ocp.DNSLabel(strings.TrimSpace(string(content))) == runID {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	ocp "hyperv/cluster"
+	hyperv "hyperv/common"
+	"hyperv/logging"
+	"hyperv/ova"
+	"hyperv/preflight"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// planDirName holds dry-run plans below the output directory. Dot
+// directories are skipped by the NFS and object storage uploads.
+const planDirName = ".plan"
+
+// dryRunPlan is everything a run would do, without doing any of it.
+type dryRunPlan struct {
+	GeneratedAt time.Time        `json:"generatedAt"`
+	Command     string           `json:"command"`
+	OutputDir   string           `json:"outputDir"`
+	PlanDir     string           `json:"planDir"`
+	Upload      string           `json:"upload,omitempty"`
+	Migration   string           `json:"migration,omitempty"`
+	VMs         []vmPlan         `json:"vms"`
+	Waves       []wavePlan       `json:"waves,omitempty"`
+	Transfer    transferEstimate `json:"transfer"`
+	Warnings    []string         `json:"warnings,omitempty"`
+}
+
+type vmPlan struct {
+	Name     string        `json:"name"`
+	State    string        `json:"state"`
+	ShutDown bool          `json:"shutDown"`
+	GuestOS  string        `json:"guestOS"`
+	OSType   string        `json:"osType"`
+	OVFOSID  int           `json:"ovfOsId"`
+	CPUs     int64         `json:"cpus"`
+	MemoryMB int64         `json:"memoryMB"`
+	Disks    []diskPlan    `json:"disks"`
+	Networks []networkPlan `json:"networks"`
+	OVF      string        `json:"ovf,omitempty"`
+	Wave     string        `json:"wave,omitempty"`
+	Steps    []string      `json:"steps"`
+}
+
+// wavePlan is the Forklift plan one wave of VMs would be migrated with.
+type wavePlan struct {
+	Name      string         `json:"name"`
+	VMs       []string       `json:"vms"`
+	Resources []ocp.Manifest `json:"resources"`
+	Steps     []string       `json:"steps"`
+}
+
+type diskPlan struct {
+	Source       string `json:"source"`
+	Local        string `json:"local"`
+	VirtualSize  uint64 `json:"virtualSize"`
+	FileSize     uint64 `json:"fileSize"`
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+// dryRunStorageClass stands in for the cluster's default StorageClass,
+// which a dry run does not look up.
+const dryRunStorageClass = "<cluster default>"
+
+type networkPlan struct {
+	Adapter     string `json:"adapter"`
+	Switch      string `json:"switch,omitempty"`
+	VLAN        int    `json:"vlan,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	// network is the OVF network of the adapter.
+	network string
+}
+
+// transferEstimate is the number of bytes each stage moves.
+type transferEstimate struct {
+	Download uint64 `json:"download"`
+	Upload   uint64 `json:"upload"`
+	Total    uint64 `json:"total"`
+}
+
+// planStages says which stages of a command the plan covers.
+type planStages struct {
+	pack    bool
+	upload  bool
+	migrate bool
+}
+
+// buildPlan inventories the jobs and builds the plan for them: disk sizes,
+// guest OS, the OVF and, for a migration, the Forklift YAML are generated
+// below the plan directory. No VM is shut down, nothing is copied and
+// nothing is applied to the cluster.
+func (a *app) buildPlan(conn *hyperv.HyperVConnection, command string, vms []hyperv.VMSummary, jobs []exportJob, stages planStages) (*dryRunPlan, error) {
+	plan := &dryRunPlan{
+		GeneratedAt: time.Now().UTC(),
+		Command:     command,
+		OutputDir:   a.outputDir,
+		PlanDir:     filepath.Join(a.outputDir, planDirName),
+		Warnings:    a.planWarnings,
+	}
+	if stages.upload {
+		plan.Upload = a.plannedUpload()
+	}
+	if stages.migrate {
+		plan.Migration = "ask"
+		if enabled := a.cfg.Migration.Enabled; enabled != nil {
+			plan.Migration = "no"
+			if *enabled {
+				plan.Migration = "yes"
+			}
+		}
+	}
+
+	states := make(map[string]string)
+	for _, vm := range vms {
+		states[vm.Name] = vm.State
+	}
+
+	for _, job := range jobs {
+		vp, err := a.planVM(conn, plan, job, states[job.name], stages)
+		if err != nil {
+			return nil, err
+		}
+		plan.VMs = append(plan.VMs, *vp)
+
+		for _, d := range vp.Disks {
+			plan.Transfer.Download += d.FileSize
+			if stages.upload && plan.Upload != "none" {
+				plan.Transfer.Upload += d.FileSize
+			}
+		}
+	}
+	plan.Transfer.Total = plan.Transfer.Download + plan.Transfer.Upload
+
+	if stages.pack && stages.migrate && plan.Migration != "no" {
+		if err := a.planWaves(plan, jobs); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := plan.save(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// plannedUpload describes where run would upload to.
+func (a *app) plannedUpload() string {
+	switch dest := strings.ToLower(a.cfg.Destination.Type); dest {
+	case "nfs":
+		return "nfs " + a.cfg.Destination.NFS.Path
+	case "s3":
+		return fmt.Sprintf("s3 %s/%s", a.cfg.Destination.S3.Bucket, a.cfg.Destination.S3.Prefix)
+	case "none":
+		return "none"
+	}
+	return "ask"
+}
+
+func (a *app) planVM(conn *hyperv.HyperVConnection, plan *dryRunPlan, job exportJob, state string, stages planStages) (*vmPlan, error) {
+	vp := &vmPlan{Name: job.name, State: state, ShutDown: state != "" && state != "Off"}
+	if v, ok := job.vmInfoMap["ProcessorCount"].(float64); ok {
+		vp.CPUs = int64(v)
+	}
+	if v, ok := job.vmInfoMap["MemoryStartup"].(float64); ok {
+		vp.MemoryMB = int64(v / 1024 / 1024)
+	}
+
+	guestOSMap, err := guestOSInfo(logging.VM(job.name), conn, job.name)
+	if err != nil {
+		return nil, err
+	}
+	job.vmInfoMap["GuestOSInfo"] = guestOSMap
+	if caption, ok := guestOSMap["Caption"].(string); ok {
+		vp.GuestOS = caption
+	}
+
+	if vp.ShutDown {
+		vp.Steps = append(vp.Steps, fmt.Sprintf("shut down %s (currently %s)", job.name, state))
+	} else {
+		vp.Steps = append(vp.Steps, fmt.Sprintf("%s is already off, no shutdown", job.name))
+	}
+
+	planVMDir := filepath.Join(plan.PlanDir, job.name)
+	if err := os.MkdirAll(planVMDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create plan directory: %w", err)
+	}
+
+	var diskFiles []ova.DiskFile
+	var planDiskPaths []string
+	for _, remotePath := range job.remotePaths {
+		name := hyperv.RemoteFileName(remotePath)
+		d := diskPlan{Source: remotePath, Local: filepath.Join(a.vmDir(job.name), name)}
+		info, err := hyperv.GetVHDInfo(conn.Client, remotePath)
+		if err != nil {
+			slog.Warn("Failed to get disk size", logging.KeyVM, job.name, logging.KeyDisk, remotePath, "error", err)
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s: size of %s unknown", job.name, name))
+		} else {
+			d.VirtualSize, d.FileSize = info.Size, info.FileSize
+		}
+		vp.Disks = append(vp.Disks, d)
+		vp.Steps = append(vp.Steps, fmt.Sprintf("download %s (%s) to %s", remotePath, preflight.FormatBytes(d.FileSize), d.Local))
+
+		planPath := filepath.Join(planVMDir, name)
+		planDiskPaths = append(planDiskPaths, planPath)
+		diskFiles = append(diskFiles, ova.DiskFile{Path: planPath, Capacity: int64(d.VirtualSize)})
+	}
+
+	for _, adapter := range ova.Adapters(job.vmInfoMap) {
+		vp.Networks = append(vp.Networks, networkPlan{Adapter: adapter.Name, Switch: adapter.Switch, VLAN: adapter.VLAN, network: adapter.Network()})
+	}
+
+	if !stages.pack {
+		return vp, nil
+	}
+
+	env, err := ova.BuildEnvelope(job.vmInfoMap, diskFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OVF for %s: %w", job.name, err)
+	}
+	vp.OSType = env.VirtualSystem.OperatingSystem.OsType
+	vp.OVFOSID = env.VirtualSystem.OperatingSystem.ID
+	ovf, err := ova.MarshalOvf(env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal OVF for %s: %w", job.name, err)
+	}
+	vp.OVF = ova.OvfPath(job.name, planDiskPaths)
+	if err := os.WriteFile(vp.OVF, ovf, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write OVF for %s: %w", job.name, err)
+	}
+	vp.Steps = append(vp.Steps, fmt.Sprintf("write OVF %s (preview in %s)",
+		ova.OvfPath(job.name, []string{vp.Disks[0].Local}), vp.OVF))
+
+	if stages.upload {
+		switch plan.Upload {
+		case "none":
+		case "ask":
+			vp.Steps = append(vp.Steps, "ask whether to copy to the NFS share and object storage")
+		default:
+			vp.Steps = append(vp.Steps, "upload disks and OVF to "+plan.Upload)
+		}
+	}
+
+	return vp, nil
+}
+
+// planWaves groups the VMs of the plan into migration waves and renders the
+// Forklift YAML of each wave below the plan directory.
+func (a *app) planWaves(plan *dryRunPlan, jobs []exportJob) error {
+	namespace := os.Getenv("NAMESPACE")
+	if namespace == "" {
+		namespace = "<unset>"
+		plan.Warnings = append(plan.Warnings, "NAMESPACE is not set, the migration would fail")
+	}
+	nfsURL := os.Getenv("OVA_PROVIDER_NFS_SERVER_PATH")
+	if nfsURL == "" {
+		nfsURL = "<unset>"
+		plan.Warnings = append(plan.Warnings, "OVA_PROVIDER_NFS_SERVER_PATH is not set, the migration would fail")
+	}
+
+	var members []waveMember
+	for _, job := range jobs {
+		members = append(members, memberOf(job.name, filepath.Join(plan.PlanDir, job.name), job.vmInfoMap))
+	}
+	vmPlans := make(map[string]*vmPlan)
+	for i := range plan.VMs {
+		vmPlans[plan.VMs[i].Name] = &plan.VMs[i]
+	}
+
+	runID, err := a.migrationRunID(false)
+	if err != nil {
+		return err
+	}
+	rules := a.mappingRules()
+	rules.DefaultStorageClass = dryRunStorageClass
+	for _, wave := range groupWaves(a.cfg.Migration.Waves, members) {
+		rendered, err := ocp.RenderOvaPlan(runID, wave, rules, namespace, nfsURL, nil)
+		if err != nil {
+			return fmt.Errorf("failed to render migration of wave %s: %w", wave.Name, err)
+		}
+		if err := rendered.WriteManifests(filepath.Join(plan.PlanDir, manifestDirName, wave.Name)); err != nil {
+			return err
+		}
+
+		wp := wavePlan{Name: wave.Name, VMs: wave.VMNames(), Resources: rendered.Manifests}
+		if plan.Migration == "ask" {
+			wp.Steps = append(wp.Steps, "ask whether to migrate")
+		}
+		for _, m := range rendered.Manifests {
+			wp.Steps = append(wp.Steps, fmt.Sprintf("apply %s %s/%s (%s)", m.Kind, m.Namespace, m.Name, m.File))
+			if m.Kind == "Provider" {
+				wp.Steps = append(wp.Steps, "look up the VM, network and disk IDs in the provider inventory")
+			}
+		}
+		wp.Steps = append(wp.Steps, "wait for the migration to complete")
+		plan.Waves = append(plan.Waves, wp)
+
+		for _, r := range rendered.VMs {
+			vp := vmPlans[r.Name]
+			vp.Wave = wave.Name
+			vp.Steps = append(vp.Steps, "migrate in wave "+wave.Name)
+			for i := range vp.Disks {
+				for _, d := range r.Storage {
+					if d.SourceName == filepath.Base(vp.Disks[i].Local) {
+						vp.Disks[i].StorageClass = d.Destination.String()
+						break
+					}
+				}
+			}
+			for i := range vp.Networks {
+				for _, n := range r.Networks {
+					if n.SourceName == vp.Networks[i].network || n.SourceName == vp.Networks[i].Adapter {
+						vp.Networks[i].Destination = n.Destination.String()
+						break
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// save writes plan.json and the human readable plan.txt to the plan directory.
+func (p *dryRunPlan) save() error {
+	if err := os.MkdirAll(p.PlanDir, 0755); err != nil {
+		return fmt.Errorf("failed to create plan directory: %w", err)
+	}
+	out, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode plan: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(p.PlanDir, "plan.json"), out, 0644); err != nil {
+		return fmt.Errorf("failed to write plan: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(p.PlanDir, "plan.txt"), []byte(p.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write plan: %w", err)
+	}
+	return nil
+}
+
+func (p *dryRunPlan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Dry run of '%s' at %s, nothing was changed.\n", p.Command, p.GeneratedAt.Format(time.RFC3339))
+	for _, vm := range p.VMs {
+		fmt.Fprintf(&b, "\nVM %s (%s), %d CPU(s), %d MB\n", vm.Name, vm.State, vm.CPUs, vm.MemoryMB)
+		fmt.Fprintf(&b, "  Guest OS: %s", vm.GuestOS)
+		if vm.OSType != "" {
+			fmt.Fprintf(&b, " -> %s (OVF id %d)", vm.OSType, vm.OVFOSID)
+		}
+		b.WriteString("\n")
+		for _, d := range vm.Disks {
+			fmt.Fprintf(&b, "  Disk %s: virtual %s, file %s", hyperv.RemoteFileName(d.Source),
+				preflight.FormatBytes(d.VirtualSize), preflight.FormatBytes(d.FileSize))
+			if d.StorageClass != "" {
+				fmt.Fprintf(&b, " -> storage class %s", d.StorageClass)
+			}
+			b.WriteString("\n")
+		}
+		for _, n := range vm.Networks {
+			fmt.Fprintf(&b, "  Network %s", n.Adapter)
+			if n.Switch != "" {
+				fmt.Fprintf(&b, " on %s", n.Switch)
+			}
+			if n.VLAN > 0 {
+				fmt.Fprintf(&b, " VLAN %d", n.VLAN)
+			}
+			if n.Destination != "" {
+				fmt.Fprintf(&b, " -> %s", n.Destination)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("  Steps:\n")
+		for i, step := range vm.Steps {
+			fmt.Fprintf(&b, "    %d. %s\n", i+1, step)
+		}
+	}
+	for _, w := range p.Waves {
+		fmt.Fprintf(&b, "\nWave %s: %s\n", w.Name, strings.Join(w.VMs, ", "))
+		b.WriteString("  Steps:\n")
+		for i, step := range w.Steps {
+			fmt.Fprintf(&b, "    %d. %s\n", i+1, step)
+		}
+	}
+	fmt.Fprintf(&b, "\nEstimated transfer: download %s, upload %s, total %s\n",
+		preflight.FormatBytes(p.Transfer.Download), preflight.FormatBytes(p.Transfer.Upload), preflight.FormatBytes(p.Transfer.Total))
+	for _, w := range p.Warnings {
+		fmt.Fprintf(&b, "Warning: %s\n", w)
+	}
+	fmt.Fprintf(&b, "Plan saved to %s\n", p.PlanDir)
+	return b.String()
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	hyperv "hyperv/common"
+	"hyperv/logging"
+	osutil "hyperv/os"
+	"hyperv/pipeline"
+	"hyperv/preflight"
+	"hyperv/state"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// exportJob is a VM that passed inventory and is ready to be exported.
+type exportJob struct {
+	name        string
+	vmInfoMap   map[string]interface{}
+	remotePaths []string
+}
+
+func runExport(a *app, args []string) error {
+	fs := a.flagSet("export", "export [flags] [VM names...]")
+	sel := selectionFlags(fs)
+	a.concurrencyFlags(fs)
+	fs.BoolVar(&a.dryRun, "dry-run", false, "Inventory and plan the export without shutting down or copying anything")
+	restart := fs.Bool("restart", false, "Ignore the state journal and export the selected VMs from scratch")
+	if err := a.parse(fs, args); err != nil {
+		return err
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		return err
+	}
+	vms, err := a.selectVMs(sel, fs.Args(), true)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if *restart && !a.dryRun {
+		if err := a.restartVMs(vms); err != nil {
+			return err
+		}
+	}
+
+	jobs, err := a.prepareExport(conn, summaryNames(vms))
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("none of the selected VMs can be exported")
+	}
+	if a.dryRun {
+		plan, err := a.buildPlan(conn, "export", vms, jobs, planStages{})
+		if err != nil {
+			return err
+		}
+		fmt.Print(plan)
+		return nil
+	}
+	if !confirmSelection("shut down and exported", jobSummaries(vms, jobs)) {
+		return declined()
+	}
+
+	result := a.runJobs(jobs, func(ctx context.Context, job exportJob) error {
+		_, err := a.exportVM(ctx, conn, job)
+		return err
+	})
+	fmt.Println("Export summary:")
+	result.Print()
+	a.writeReport("export", jobs, result, result.Err())
+	return result.Err()
+}
+
+// runJobs runs fn for every job in the bounded VM pool.
+func (a *app) runJobs(jobs []exportJob, fn func(ctx context.Context, job exportJob) error) *pipeline.Result {
+	byName := make(map[string]exportJob, len(jobs))
+	var names []string
+	for _, job := range jobs {
+		byName[job.name] = job
+		names = append(names, job.name)
+	}
+	return pipeline.Run(a.ctx, a.limits().VMs, names, func(ctx context.Context, name string) error {
+		logger := logging.VM(name)
+		err := fn(logging.WithLogger(ctx, logger), byName[name])
+		if err != nil {
+			logger.Error("VM failed", "error", err)
+		}
+		return err
+	})
+}
+
+// jobSummaries returns the summaries of the VMs that made it into jobs.
+func jobSummaries(vms []hyperv.VMSummary, jobs []exportJob) []hyperv.VMSummary {
+	inJobs := make(map[string]bool)
+	for _, job := range jobs {
+		inJobs[job.name] = true
+	}
+	var summaries []hyperv.VMSummary
+	for _, vm := range vms {
+		if inJobs[vm.Name] {
+			summaries = append(summaries, vm)
+		}
+	}
+	return summaries
+}
+
+// prepareExport inventories every VM before touching any of them and runs
+// the disk space preflight over the whole selection.
+func (a *app) prepareExport(conn *hyperv.HyperVConnection, names []string) ([]exportJob, error) {
+	var jobs []exportJob
+	var requirements []preflight.VMRequirement
+	// unsized lists the VMs whose disks could not all be sized, so the
+	// space check would count too little for them
+	var unsized []string
+	for _, vmName := range names {
+		fmt.Printf("Fetching info for VM: %s\n", vmName)
+
+		// Get VM info
+		infoResult, err := hyperv.PerformVMAction(conn.Client, vmName, hyperv.GetVMInfo)
+		if err != nil {
+			slog.Error("Failed to get VM info", logging.KeyVM, vmName, "error", err)
+			continue
+		}
+		vmInfoMap := infoResult.(map[string]interface{})
+
+		// Extract disk paths from guest vm
+		remotePaths, found := hyperv.ExtractPath(vmInfoMap)
+		if !found || len(remotePaths) == 0 {
+			slog.Warn("No VHDX paths found in VM data", logging.KeyVM, vmName)
+			continue
+		}
+
+		jobs = append(jobs, exportJob{name: vmName, vmInfoMap: vmInfoMap, remotePaths: remotePaths})
+		if !a.dryRun {
+			if journal, err := a.openJournal(); err != nil {
+				return nil, err
+			} else if err := journal.Advance(vmName, state.StageInventoried); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err := preflight.CollectVM(conn.Client, vmName, remotePaths, a.vmDir(vmName))
+		if err != nil {
+			slog.Warn("Failed to get disk sizes", logging.KeyVM, vmName, "error", err)
+			unsized = append(unsized, fmt.Sprintf("%s: %v, the space it needs is not counted", vmName, err))
+		}
+		requirements = append(requirements, req)
+	}
+
+	if mode := preflight.ModeFromEnv(); mode != preflight.ModeOff {
+		destinations := []preflight.Destination{{Name: "output directory", Path: a.outputDir}}
+		if nfsPath := os.Getenv("OVA_PROVIDER_NFS_SERVER_PATH"); nfsPath != "" {
+			if info, err := os.Stat(nfsPath); err == nil && info.IsDir() {
+				destinations = append(destinations, preflight.Destination{Name: "NFS destination", Path: nfsPath, ViaSudo: true})
+			}
+		}
+
+		result := preflight.Check(requirements, destinations)
+		result.Problems = append(result.Problems, unsized...)
+		result.Print()
+		if !result.OK() {
+			switch {
+			case a.dryRun:
+				a.planWarnings = append(a.planWarnings, "preflight checks failed, a real run would stop here")
+			case mode == preflight.ModeStrict:
+				return nil, fmt.Errorf("preflight checks failed; set PREFLIGHT_MODE=warn to continue anyway")
+			default:
+				fmt.Println("Preflight checks failed, continuing because PREFLIGHT_MODE=warn")
+			}
+		}
+	}
+
+	return jobs, nil
+}
+
+// exportVM collects the guest OS, shuts the VM down, saves its info and
+// downloads its disks. It returns the local disk paths.
+// Stages already recorded in the state journal are skipped, so a rerun
+// after a crash resumes with the first disk that was not downloaded.
+// WinRM calls and downloads wait for a slot in the limiter, and ctx stops
+// the export before the next step.
+func (a *app) exportVM(ctx context.Context, conn *hyperv.HyperVConnection, job exportJob) (localFiles []string, err error) {
+	vmName := job.name
+	logger := logging.FromContext(ctx).With(logging.KeyStage, "export")
+
+	journal, err := a.openJournal()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			journal.Fail(vmName, err)
+		}
+	}()
+
+	// Each VM gets its own directory so same-named disks from different VMs don't collide
+	vmDir := a.vmDir(vmName)
+	if err := os.MkdirAll(vmDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory for %s: %w", vmName, err)
+	}
+
+	if journal.Reached(vmName, state.StageShutDown) {
+		// The guest is off by now, the saved info still has its OS
+		if saved, err := a.loadVMInfo(vmName); err == nil {
+			job.vmInfoMap = saved
+		}
+		logger.Info("VM was already shut down, resuming the download")
+	} else {
+		var guestOSMap map[string]interface{}
+		if err := a.limiter.WinRM(ctx, func() (err error) {
+			guestOSMap, err = guestOSInfo(logger, conn, vmName)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		job.vmInfoMap["GuestOSInfo"] = guestOSMap
+
+		// The VM info is what the package stage builds the OVF from
+		if err := a.saveVMInfo(vmName, job.vmInfoMap); err != nil {
+			return nil, fmt.Errorf("failed to save VM info for %s: %w", vmName, err)
+		}
+
+		// Perform VM action: shutdown
+		if err := a.limiter.WinRM(ctx, func() error {
+			logger.Info("Shutting down VM")
+			_, err := hyperv.PerformVMAction(conn.Client, vmName, hyperv.Shutdown)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("failed to shut down VM %s: %w", vmName, err)
+		}
+		if err := journal.Advance(vmName, state.StageShutDown); err != nil {
+			return nil, err
+		}
+	}
+
+	// Process each hard drive and collect local file paths
+	for _, remotePath := range job.remotePaths {
+		// Extract just the filename from Windows path (handle both / and \ separators)
+		originalFileName := hyperv.RemoteFileName(remotePath)
+		localFile := filepath.Join(vmDir, originalFileName)
+
+		if disk, ok := journal.Downloaded(vmName, remotePath); ok && disk.Local == localFile {
+			logger.Info("Disk already downloaded", logging.KeyDisk, remotePath, "sha256", disk.SHA256)
+			localFiles = append(localFiles, localFile)
+			continue
+		}
+
+		var digest string
+		var elapsed time.Duration
+		if err := a.limiter.Transfer(ctx, func() (err error) {
+			start := time.Now()
+			digest, err = hyperv.CopyRemoteFileWithProgress(ctx, conn.User, conn.Password,
+				conn.HostIP, conn.SSHPort, remotePath, localFile)
+			elapsed = time.Since(start)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("SCP transfer failed for %s (disk %s): %w", vmName, originalFileName, err)
+		}
+
+		info, err := os.Stat(localFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat downloaded disk %s: %w", localFile, err)
+		}
+		if err := journal.DiskDone(vmName, state.Disk{
+			Source:          remotePath,
+			Local:           localFile,
+			Size:            info.Size(),
+			SHA256:          digest,
+			DownloadedAt:    time.Now().UTC(),
+			TransferSeconds: elapsed.Seconds(),
+		}); err != nil {
+			return nil, err
+		}
+
+		localFiles = append(localFiles, localFile)
+	}
+
+	if err := journal.Advance(vmName, state.StageDownloaded); err != nil {
+		return nil, err
+	}
+	return localFiles, nil
+}
+
+// guestOSInfo asks the guest for its OS. A VM that is already off can still
+// be exported, so an unreachable guest yields an unknown OS.
+func guestOSInfo(logger *slog.Logger, conn *hyperv.HyperVConnection, vmName string) (map[string]interface{}, error) {
+	guestOSMap := map[string]interface{}{
+		"Caption":        "Unknown",
+		"Version":        "",
+		"OSArchitecture": "64-bit",
+	}
+	guestInfoJson, err := hyperv.GetGuestOSInfoFromVM(conn.Client, vmName, conn.User, conn.Password)
+	if err != nil {
+		logger.Warn("VM may be OFF or unreachable, exporting with an unknown guest OS", "error", err)
+		return guestOSMap, nil
+	}
+	guestOSMap, err = osutil.ParseGuestOSInfo(guestInfoJson)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse guest OS info for %s: %w", vmName, err)
+	}
+	return guestOSMap, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	hyperv "hyperv/common"
+	osutil "hyperv/os"
+	"hyperv/preflight"
+	"os"
+)
+
+// vmDetails is the inspect view of a single VM.
+type vmDetails struct {
+	Name           string                 `json:"name"`
+	ProcessorCount int                    `json:"processorCount"`
+	MemoryStartup  uint64                 `json:"memoryStartup"`
+	Disks          []hyperv.VHDInfo       `json:"disks"`
+	Networks       []string               `json:"networks"`
+	GuestOS        map[string]interface{} `json:"guestOS,omitempty"`
+	GuestOSError   string                 `json:"guestOSError,omitempty"`
+}
+
+func runInspect(a *app, args []string) error {
+	fs := a.flagSet("inspect", "inspect [flags] [VM names...]")
+	sel := selectionFlags(fs)
+	asJSON := fs.Bool("json", false, "Print the details as JSON")
+	if err := a.parse(fs, args); err != nil {
+		return err
+	}
+
+	vms, err := a.selectVMs(sel, fs.Args(), false)
+	if err != nil {
+		return err
+	}
+	names := summaryNames(vms)
+	conn, err := a.connect()
+	if err != nil {
+		return err
+	}
+
+	var details []vmDetails
+	for _, vmName := range names {
+		d, err := inspectVM(conn, vmName)
+		if err != nil {
+			return err
+		}
+		details = append(details, d)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(details)
+	}
+
+	for _, d := range details {
+		fmt.Printf("VM: %s\n", d.Name)
+		fmt.Printf("  CPUs:   %d\n", d.ProcessorCount)
+		fmt.Printf("  Memory: %s\n", preflight.FormatBytes(d.MemoryStartup))
+		for _, disk := range d.Disks {
+			fmt.Printf("  Disk:   %s (virtual %s, physical %s)\n", disk.Path, preflight.FormatBytes(disk.Size), preflight.FormatBytes(disk.FileSize))
+		}
+		for _, network := range d.Networks {
+			fmt.Printf("  NIC:    %s\n", network)
+		}
+		if d.GuestOS != nil {
+			fmt.Printf("  Guest:  %v (%v)\n", d.GuestOS["Caption"], d.GuestOS["OSArchitecture"])
+		} else {
+			fmt.Printf("  Guest:  unknown (%s)\n", d.GuestOSError)
+		}
+	}
+	return nil
+}
+
+func inspectVM(conn *hyperv.HyperVConnection, vmName string) (vmDetails, error) {
+	d := vmDetails{Name: vmName}
+
+	infoResult, err := hyperv.PerformVMAction(conn.Client, vmName, hyperv.GetVMInfo)
+	if err != nil {
+		return d, fmt.Errorf("failed to get VM info for %s: %w", vmName, err)
+	}
+	vmInfoMap := infoResult.(map[string]interface{})
+
+	if v, ok := vmInfoMap["ProcessorCount"].(float64); ok {
+		d.ProcessorCount = int(v)
+	}
+	if v, ok := vmInfoMap["MemoryStartup"].(float64); ok {
+		d.MemoryStartup = uint64(v)
+	}
+
+	remotePaths, _ := hyperv.ExtractPath(vmInfoMap)
+	for _, remotePath := range remotePaths {
+		info, err := hyperv.GetVHDInfo(conn.Client, remotePath)
+		if err != nil {
+			info = &hyperv.VHDInfo{Path: remotePath}
+		}
+		d.Disks = append(d.Disks, *info)
+	}
+
+	if adapters, ok := vmInfoMap["NetworkAdapters"].([]interface{}); ok {
+		for _, a := range adapters {
+			if adapter, ok := a.(map[string]interface{}); ok {
+				name, _ := adapter["Name"].(string)
+				switchName, _ := adapter["SwitchName"].(string)
+				d.Networks = append(d.Networks, fmt.Sprintf("%s (switch %q)", name, switchName))
+			}
+		}
+	}
+
+	guestInfoJson, err := hyperv.GetGuestOSInfoFromVM(conn.Client, vmName, conn.User, conn.Password)
+	if err == nil {
+		d.GuestOS, err = osutil.ParseGuestOSInfo(guestInfoJson)
+	}
+	if err != nil {
+		d.GuestOSError = fmt.Sprintf("VM may be OFF or unreachable: %v", err)
+	}
+
+	return d, nil
+}
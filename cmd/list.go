@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func runList(a *app, args []string) error {
+	fs := a.flagSet("list", "list [flags] [VM names...]")
+	sel := selectionFlags(fs)
+	asJSON := fs.Bool("json", false, "Print the VMs as JSON")
+	if err := a.parse(fs, args); err != nil {
+		return err
+	}
+
+	vms, err := a.selectVMs(sel, fs.Args(), false)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(vms)
+	}
+	for _, vm := range vms {
+		tags := ""
+		if t := vm.Tags(); len(t) > 0 {
+			tags = " [" + strings.Join(t, ", ") + "]"
+		}
+		fmt.Printf("%s (%s)%s\n", vm.Name, vm.State, tags)
+	}
+	return nil
+}
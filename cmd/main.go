@@ -1,18 +1,16 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	ocp "hyperv/cluster"
-	hyperv "hyperv/common"
+	"hyperv/logging"
 	nfs "hyperv/nfs"
-	osutil "hyperv/os"
-	"hyperv/ova"
-	"log"
+	"hyperv/progress"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strings"
-	"sync"
+	"syscall"
 )
 
 //Make sure to have quemu installed:
@@ -37,147 +35,132 @@ import (
 // # Allow through firewall
 // New-NetFirewallRule -Name sshd -DisplayName 'OpenSSH Server (sshd)' -Enabled True -Direction Inbound -Protocol TCP -Action Allow -LocalPort 22
 
+// command is a single stage of the migration that can run on its own.
+type command struct {
+	name    string
+	summary string
+	run     func(a *app, args []string) error
+}
+
+var commands = []command{
+	{"list", "List the VMs on the Hyper-V host", runList},
+	{"inspect", "Show VM details, disks and guest OS", runInspect},
+	{"export", "Shut down VMs and download their disks", runExport},
+	{"package", "Generate OVF descriptors for exported VMs", runPackage},
+	{"upload", "Copy exported VMs to the NFS share or object storage", runUpload},
+	{"migrate", "Create the Forklift provider and plan and run the migration", runMigrate},
+	{"cleanup", "Delete the cluster objects of a migration run", runCleanup},
+	{"status", "Show local export state and the cluster migration status", runStatus},
+	{"serve", "Publish the output directory over HTTP(S)", runServe},
+	{"run", "Export, package, upload and migrate in one pass (default)", runAll},
+}
+
 func main() {
 
 	//Detect special flag to only run the CopyFilesNfsServer (under sudo)
 	if len(os.Args) >= 4 && os.Args[1] == "--copy-files" {
-		fmt.Println("ARGS:", os.Args)
+		// sudo may reset the environment, the defaults apply then
+		if _, err := logging.Setup(logging.Options{Level: os.Getenv("LOG_LEVEL"), Format: os.Getenv("LOG_FORMAT")}, progress.Default.Writer()); err != nil {
+			slog.Warn("Invalid logging settings, using the defaults", "error", err)
+		}
+		slog.Debug("Running the NFS copy helper", "args", os.Args)
 		srcDir := os.Args[2]
 		dstDir := os.Args[3]
-		if err := nfs.CopyFilesNfsServer(srcDir, dstDir); err != nil {
-			log.Fatalf("Copy failed: %v", err)
+		vms := os.Args[4:]
+
+		// The parent counts the copied bytes in its metrics
+		stopReports := nfs.ReportCopyProgress(os.Stdout)
+
+		// Don't leave half written files on the share when interrupted
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			nfs.RemovePartials()
+			stopReports()
+			os.Exit(130)
+		}()
+
+		err := nfs.CopyFilesNfsServer(srcDir, dstDir, vms)
+		stopReports()
+		if err != nil {
+			slog.Error("Copy failed", "error", err)
+			os.Exit(1)
 		}
 		os.Exit(0)
 	}
-	connections, err := hyperv.LoadHyperVConnection()
-	if err != nil {
-		log.Fatalf("Connection setup failed: %v", err)
+
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	if name == "--serve" {
+		// kept for scripts written against the old flag
+		name = "serve"
+	}
+	if name == "help" || name == "-h" || name == "--help" {
+		usage()
+		return
 	}
 
-	// Get vm list
-	vmNames, err := hyperv.PerformVMAction(connections.Client, "", hyperv.ListVMs)
-	if err != nil {
-		log.Fatalf("Failed to list VMs: %v", err)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		// The first Ctrl-C stops new work and lets running steps clean up,
+		// a second one exits immediately. The signals get a channel of their
+		// own so the context ending after the command is not taken for one.
+		ctx, cancel := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			signal.Stop(signals)
+			fmt.Fprintln(os.Stderr, "\nInterrupted, stopping after cleanup. Press Ctrl-C again to exit immediately.")
+			cancel()
+		}()
+
+		a, err := newApp(ctx)
+		if err != nil {
+			slog.Error("Setup failed", "error", err)
+			os.Exit(1)
+		}
+		err = cmd.run(a, args)
+		signal.Stop(signals)
+		cancel()
+		if err != nil {
+			slog.Error(cmd.name+" failed", "error", err)
+			a.close()
+			os.Exit(1)
+		}
+		a.close()
+		return
 	}
 
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [VM names...]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", filepath.Base(os.Args[0]))
+}
+
+// resolveOutputDir returns the absolute path of the project output directory.
+func resolveOutputDir() (string, error) {
 	outputDir, err := filepath.Abs("output")
 	if err != nil {
-		log.Fatalf("Failed to get absolute path for output directory: %v", err)
+		return "", err
 	}
 
 	// If "cmd" is in the path, remove it to get project root output
 	if filepath.Base(filepath.Dir(outputDir)) == "cmd" {
 		outputDir = filepath.Join(filepath.Dir(filepath.Dir(outputDir)), "output")
 	}
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		log.Fatalf("failed to create output directory: %v", err)
-	}
-	names := vmNames.([]string)
-
-	var wg sync.WaitGroup
-	for _, vmName := range names {
-		wg.Add(1)
-
-		go func(vmName string) {
-			defer wg.Done()
-
-			fmt.Printf("Fetching info for VM: %s\n", vmName)
-
-			// Get VM info
-			infoResult, err := hyperv.PerformVMAction(connections.Client, vmName, hyperv.GetVMInfo)
-			if err != nil {
-				log.Printf("Failed to get VM info: %v", err)
-				return
-			}
-
-			vmInfoMap := infoResult.(map[string]interface{})
-
-			// Extract disk paths from guest vm
-			remotePaths, found := hyperv.ExtractPath(vmInfoMap)
-			if !found || len(remotePaths) == 0 {
-				log.Printf("No VHDX paths found in VM data for %s", vmName)
-				return
-			}
-
-			//Get guest OS info
-			guestInfoJson, err := hyperv.GetGuestOSInfoFromVM(connections.Client, vmName, connections.User, connections.Password)
-			if err != nil {
-				log.Printf("VM '%s' may be OFF or unreachable: %v", vmName, err)
-				return
-			}
-
-			guestOSMap, err := osutil.ParseGuestOSInfo(guestInfoJson)
-			if err != nil {
-				log.Printf("Failed to parse guest OS info for %s: %v", vmName, err)
-				return
-			}
-			vmInfoMap["GuestOSInfo"] = guestOSMap
-
-			// Perform VM action: shutdown
-			fmt.Printf("Shutting down VM '%s'...\n", vmName)
-			if _, err := hyperv.PerformVMAction(connections.Client, vmName, hyperv.Shutdown); err != nil {
-				log.Printf("Failed to shut down VM %s: %v", vmName, err)
-				return
-			}
-
-			//If you want to save the VM info to a file, set the SAVE_VM_INFO environment variable to true
-			if os.Getenv("SAVE_VM_INFO") == "true" {
-				jsonOut, _ := json.MarshalIndent(infoResult, "", "  ")
-				if err := hyperv.SaveVMJsonToFile(jsonOut, filepath.Join(outputDir, vmName+".json")); err != nil {
-					log.Printf("Failed to save JSON for %s: %v", vmName, err)
-					return
-				}
-			}
-
-			// Process each hard drive and collect local file paths
-			var localFiles []string
-			for _, remotePath := range remotePaths {
-				// Extract just the filename from Windows path (handle both / and \ separators)
-				originalFileName := remotePath
-				if idx := strings.LastIndex(originalFileName, "\\"); idx != -1 {
-					originalFileName = originalFileName[idx+1:]
-				} else if idx := strings.LastIndex(originalFileName, "/"); idx != -1 {
-					originalFileName = originalFileName[idx+1:]
-				}
-				localFile := filepath.Join(outputDir, originalFileName)
-
-				if err := hyperv.CopyRemoteFileWithProgress(connections.User, connections.Password,
-					connections.HostIP, connections.SSHPort, remotePath, localFile); err != nil {
-					log.Printf("SCP transfer failed for %s (disk %s): %v", vmName, originalFileName, err)
-					return
-				}
-
-				localFiles = append(localFiles, localFile)
-			}
-
-			// Format as unified OVA with all disks
-			if err := ova.FormatFromHyperV(vmInfoMap, localFiles); err != nil {
-				log.Printf("Failed to format OVF for %s: %v", vmName, err)
-				return
-			}
-
-		}(vmName) // capture loop variable
-	}
-	wg.Wait()
-	fmt.Println("All VMs processed successfully.")
-
-	if hyperv.AskYesNo("Would you like to copy OVA files to the NFS server?") {
-		if err := nfs.CopyToNFSServer(outputDir); err != nil {
-			log.Fatalf("Copy failed: %v", err)
-		}
-	} else {
-		fmt.Println("Skipping copy to NFS server.")
-	}
-
-	if hyperv.AskYesNo("Would you like to create an  OVA provider and perform a migration?") {
-		if err := ocp.LoginToCluster(); err != nil {
-			log.Fatalf("Cluster login failed: %v", err)
-		}
-
-		if err := ocp.RunOvaMigration(names[0], outputDir); err != nil {
-			log.Fatalf("Migration failed: %v", err)
-		}
-	} else {
-		fmt.Println("Skipping OVA provider creation and migration.")
-	}
+	return outputDir, nil
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	ocp "hyperv/cluster"
+	"hyperv/state"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+func runMigrate(a *app, args []string) error {
+	fs := a.flagSet("migrate", "migrate [flags] [VM names...]")
+	login := fs.Bool("login", true, "Allow the lab NFS login to CLUSTER_NAME; -login=false uses the kubeconfig instead")
+	dryRun := fs.Bool("dry-run", false, "Write the Forklift YAML of every wave without applying it")
+	onlyWave := fs.String("wave", "", "Migrate only the VMs of this wave")
+	a.waveFlags(fs)
+	if err := a.parse(fs, args); err != nil {
+		return err
+	}
+
+	vmNames := fs.Args()
+	if len(vmNames) == 0 {
+		var err error
+		if vmNames, err = a.pendingMigrations(); err != nil {
+			return err
+		}
+		if len(vmNames) == 0 {
+			return fmt.Errorf("no copied VMs are waiting for migration")
+		}
+	}
+	waves, err := a.waves(vmNames)
+	if err != nil {
+		return err
+	}
+	if *onlyWave != "" {
+		waves = slices.DeleteFunc(waves, func(w ocp.Wave) bool { return w.Name != *onlyWave })
+		if len(waves) == 0 {
+			return fmt.Errorf("none of the VMs is in wave %q", *onlyWave)
+		}
+	}
+
+	if *dryRun {
+		runID, err := a.migrationRunID(false)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Dry run of migration run %s, nothing was applied.\n", runID)
+		rules := a.mappingRules()
+		rules.DefaultStorageClass = dryRunStorageClass
+		for _, wave := range waves {
+			rendered, err := ocp.RenderOvaPlan(runID, wave, rules, os.Getenv("NAMESPACE"), os.Getenv("OVA_PROVIDER_NFS_SERVER_PATH"), nil)
+			if err != nil {
+				return err
+			}
+			if err := rendered.WriteManifests(filepath.Join(a.outputDir, manifestDirName, wave.Name)); err != nil {
+				return err
+			}
+			fmt.Printf("Wave %s (%s) would create:\n", wave.Name, strings.Join(wave.VMNames(), ", "))
+			for _, m := range rendered.Manifests {
+				fmt.Printf("  %s %s/%s (%s)\n", m.Kind, m.Namespace, m.Name, m.File)
+			}
+		}
+		return nil
+	}
+
+	client, err := a.clusterClient(*login)
+	if err != nil {
+		return err
+	}
+	return a.migrateWaves(client, waves, a.cfg.Migration.ParallelWaves)
+}
+
+// pendingMigrations returns the exported VMs that were copied but not
+// migrated yet.
+func (a *app) pendingMigrations() ([]string, error) {
+	exported, err := a.exportedVMs()
+	if err != nil {
+		return nil, err
+	}
+	journal, err := a.openJournal()
+	if err != nil {
+		return nil, err
+	}
+	var pending []string
+	for _, name := range exported {
+		if journal.Reached(name, state.StageCopied) && !journal.Reached(name, state.StageMigrated) {
+			pending = append(pending, name)
+		}
+	}
+	return pending, nil
+}
@@ -16,6 +16,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	hyperv "hyperv/common"
 	"hyperv/ova"
 )
 
@@ -113,9 +114,9 @@ func listVMs() ([]string, error) {
 func getVMInfo(vmName string) (map[string]interface{}, error) {
 	// Get basic VM info
 	cmd := fmt.Sprintf(`
-		$vm = Get-VM -Name '%s'
-		$disks = Get-VMHardDiskDrive -VMName '%s' | Select-Object -Property Path
-		$nics = Get-VMNetworkAdapter -VMName '%s' | Select-Object -Property Name
+		$vm = Get-VM -Name %[1]s
+		$disks = Get-VMHardDiskDrive -VMName %[1]s | Select-Object -Property Path
+		$nics = Get-VMNetworkAdapter -VMName %[1]s | Select-Object -Property Name
 		
 		@{
 			Name = $vm.Name
@@ -124,7 +125,7 @@ func getVMInfo(vmName string) (map[string]interface{}, error) {
 			HardDrives = @($disks)
 			NetworkAdapters = @($nics)
 		} | ConvertTo-Json -Depth 3
-	`, vmName, vmName, vmName)
+	`, hyperv.PSQuote(vmName))
 
 	out, err := runPS(cmd)
 	if err != nil {
@@ -145,7 +146,7 @@ func getGuestOSInfo(vmName string) map[string]interface{} {
 	// This reads OS info that HyperV collects via integration services
 	cmd := fmt.Sprintf(`
 		$ErrorActionPreference = 'SilentlyContinue'
-		$vm = Get-WmiObject -Namespace root\virtualization\v2 -Class Msvm_ComputerSystem -Filter "ElementName='%s'"
+		$vm = Get-WmiObject -Namespace root\virtualization\v2 -Class Msvm_ComputerSystem | Where-Object { $_.ElementName -eq %s }
 		if ($vm) {
 			$kvp = $vm.GetRelated('Msvm_KvpExchangeComponent')
 			if ($kvp -and $kvp.GuestIntrinsicExchangeItems) {
@@ -173,7 +174,7 @@ func getGuestOSInfo(vmName string) map[string]interface{} {
 		} else {
 			$null
 		}
-	`, vmName)
+	`, hyperv.PSQuote(vmName))
 
 	out, err := runPS(cmd)
 	if err != nil || strings.TrimSpace(out) == "" || strings.TrimSpace(out) == "null" {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"hyperv/logging"
+	"hyperv/metrics"
+	"hyperv/ova"
+	"log/slog"
+	"os"
+	"time"
+)
+
+func runPackage(a *app, args []string) error {
+	fs := a.flagSet("package", "package [flags] [VM names...]")
+	if err := a.parse(fs, args); err != nil {
+		return err
+	}
+
+	names := fs.Args()
+	if len(names) == 0 {
+		exported, err := a.exportedVMs()
+		if err != nil {
+			return fmt.Errorf("failed to scan output directory: %w", err)
+		}
+		names = exported
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no exported VMs found in %s", a.outputDir)
+	}
+
+	var failed int
+	for _, vmName := range names {
+		if err := a.packageVM(vmName); err != nil {
+			slog.Error("Failed to package VM", logging.KeyVM, vmName, logging.KeyStage, "package", "error", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d VMs could not be packaged", failed, len(names))
+	}
+	return nil
+}
+
+// packageVM writes the OVF for an exported VM next to its disks.
+func (a *app) packageVM(vmName string) error {
+	vmInfoMap, err := a.loadVMInfo(vmName)
+	if err != nil {
+		return err
+	}
+	localFiles, err := a.localDiskPaths(vmName, vmInfoMap)
+	if err != nil {
+		return err
+	}
+	for _, localFile := range localFiles {
+		if _, err := os.Stat(localFile); err != nil {
+			return fmt.Errorf("disk %s has not been downloaded: %w", localFile, err)
+		}
+	}
+
+	// Format as unified OVA with all disks
+	start := time.Now()
+	if err := ova.FormatFromHyperV(vmInfoMap, localFiles); err != nil {
+		return fmt.Errorf("failed to format OVF for %s: %w", vmName, err)
+	}
+	metrics.PackageSeconds.Observe(time.Since(start).Seconds())
+
+	journal, err := a.openJournal()
+	if err != nil {
+		return err
+	}
+	return journal.SetOVF(vmName, ova.OvfPath(vmName, localFiles))
+}
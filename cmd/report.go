@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	hyperv "hyperv/common"
+	osutil "hyperv/os"
+	"hyperv/ova"
+	"hyperv/pipeline"
+	"hyperv/report"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// writeReport writes the JSON and HTML report of this run for jobs. It is
+// called on the way out, so failures are reported as well as successes.
+func (a *app) writeReport(command string, jobs []exportJob, result *pipeline.Result, runErr error) {
+	journal, err := a.openJournal()
+	if err != nil {
+		slog.Error("Failed to write report", "error", err)
+		return
+	}
+
+	r := &report.Report{
+		RunID:     a.runID,
+		Command:   command,
+		Host:      a.cfg.Connection.Host,
+		StartedAt: a.startedAt,
+		EndedAt:   time.Now().UTC(),
+		Status:    "ok",
+	}
+	if runErr != nil {
+		r.Status = "failed"
+		r.Error = runErr.Error()
+	}
+
+	for _, job := range jobs {
+		entry := journal.Get(job.name)
+		vm := report.VM{
+			Name:        job.name,
+			OVF:         entry.OVF,
+			Destination: entry.Destination,
+			Plan:        entry.Plan,
+			Migration:   entry.Migration,
+			Stage:       string(entry.Stage),
+			Status:      vmStatus(job.name, result),
+			Error:       entry.Error,
+		}
+		if vm.Error != "" {
+			vm.Status = "failed"
+		}
+
+		// The saved info has the guest OS, the inventory only the hardware
+		vmInfoMap := job.vmInfoMap
+		if saved, err := a.loadVMInfo(job.name); err == nil {
+			vmInfoMap = saved
+		}
+		if v, ok := vmInfoMap["ProcessorCount"].(float64); ok {
+			vm.CPUs = int64(v)
+		}
+		if v, ok := vmInfoMap["MemoryStartup"].(float64); ok {
+			vm.MemoryMB = int64(v / 1024 / 1024)
+		}
+		if guest, ok := vmInfoMap["GuestOSInfo"].(map[string]interface{}); ok {
+			caption, _ := guest["Caption"].(string)
+			arch, _ := guest["OSArchitecture"].(string)
+			vm.GuestOS = caption
+			vm.OSType = osutil.MapCaptionToOsType(caption, arch)
+		}
+
+		for _, remotePath := range job.remotePaths {
+			disk := report.Disk{
+				Source: remotePath,
+				Local:  filepath.Join(a.vmDir(job.name), hyperv.RemoteFileName(remotePath)),
+			}
+			for _, d := range entry.Disks {
+				if d.Source != remotePath {
+					continue
+				}
+				disk.Local = d.Local
+				disk.SHA256 = d.SHA256
+				disk.PhysicalSize = uint64(d.Size)
+				disk.TransferSeconds = d.TransferSeconds
+				if d.TransferSeconds > 0 {
+					disk.BytesPerSecond = float64(d.Size) / d.TransferSeconds
+				}
+			}
+			if info, err := os.Stat(disk.Local); err == nil {
+				disk.PhysicalSize = uint64(info.Size())
+				if size, err := ova.GetVHDXVirtualSize(disk.Local); err == nil {
+					disk.VirtualSize = size
+				}
+			}
+			vm.Disks = append(vm.Disks, disk)
+		}
+
+		r.VMs = append(r.VMs, vm)
+	}
+
+	htmlPath, err := r.Write(filepath.Join(a.outputDir, report.DirName))
+	if err != nil {
+		slog.Error("Failed to write report", "error", err)
+		return
+	}
+	fmt.Printf("Report written to %s\n", htmlPath)
+}
+
+// vmStatus is the outcome of name in result: ok, failed or skipped.
+func vmStatus(name string, result *pipeline.Result) string {
+	if result == nil {
+		return "skipped"
+	}
+	for _, f := range result.Failed {
+		if f.Name == name {
+			return "failed"
+		}
+	}
+	for _, n := range result.Skipped {
+		if n == name {
+			return "skipped"
+		}
+	}
+	return "ok"
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	hyperv "hyperv/common"
+	"hyperv/state"
+	"os"
+	"slices"
+	"strings"
+)
+
+// runAll is the original single-pass flow: export and package every VM,
+// then offer to upload the result and run the migration.
+func runAll(a *app, args []string) (err error) {
+	fs := a.flagSet("run", "run [flags] [VM names...]")
+	sel := selectionFlags(fs)
+	a.concurrencyFlags(fs)
+	fs.BoolVar(&a.dryRun, "dry-run", false, "Plan every step, generate the OVF and Forklift YAML, but change nothing")
+	a.waveFlags(fs)
+	restart := fs.Bool("restart", false, "Ignore the state journal and start the selected VMs from scratch")
+	if err := a.parse(fs, args); err != nil {
+		return err
+	}
+
+	// Unattended runs must not discover a missing secret halfway through
+	if !hyperv.IsInteractive() {
+		if missing := a.cfg.MissingSecrets(os.Geteuid() != 0); len(missing) > 0 {
+			if !a.dryRun {
+				return fmt.Errorf("missing required secrets: %s", strings.Join(missing, "; "))
+			}
+			for _, m := range missing {
+				a.planWarnings = append(a.planWarnings, "missing "+m)
+			}
+		}
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		return err
+	}
+	vms, err := a.selectVMs(sel, fs.Args(), true)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(a.outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	journal, err := a.openJournal()
+	if err != nil {
+		return err
+	}
+	if *restart && !a.dryRun {
+		if err := a.restartVMs(vms); err != nil {
+			return err
+		}
+	}
+
+	jobs, err := a.prepareExport(conn, summaryNames(vms))
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("none of the selected VMs can be exported")
+	}
+	if a.dryRun {
+		plan, err := a.buildPlan(conn, "run", vms, jobs, planStages{pack: true, upload: true, migrate: true})
+		if err != nil {
+			return err
+		}
+		fmt.Print(plan)
+		return nil
+	}
+	if !confirmSelection("shut down, exported and packaged", jobSummaries(vms, jobs)) {
+		return declined()
+	}
+
+	result := a.runJobs(jobs, func(ctx context.Context, job exportJob) error {
+		if _, err := a.exportVM(ctx, conn, job); err != nil {
+			return fmt.Errorf("export failed: %w", err)
+		}
+
+		if journal.Reached(job.name, state.StageOVFWritten) {
+			if ovfPath := journal.Get(job.name).OVF; ovfPath != "" {
+				if _, err := os.Stat(ovfPath); err == nil {
+					fmt.Printf("OVF of %s already written: %s\n", job.name, ovfPath)
+					return nil
+				}
+			}
+		}
+
+		// Format as unified OVA with all disks
+		if err := a.limiter.Convert(ctx, func() error { return a.packageVM(job.name) }); err != nil {
+			return fmt.Errorf("failed to format OVF: %w", err)
+		}
+		return nil
+	})
+	reported := jobs
+	defer func() { a.writeReport("run", reported, result, err) }()
+	fmt.Println("Export summary:")
+	result.Print()
+	if err := a.ctx.Err(); err != nil {
+		return fmt.Errorf("interrupted before upload: %w", err)
+	}
+	if len(result.Succeeded) == 0 {
+		return result.Err()
+	}
+
+	// Only the VMs that made it through export and packaging go further
+	var done []exportJob
+	for _, job := range jobs {
+		if slices.Contains(result.Succeeded, job.name) {
+			done = append(done, job)
+		}
+	}
+	jobs = done
+
+	if allReached(journal, jobs, state.StageCopied) {
+		fmt.Println("All VMs were already copied, skipping upload.")
+	} else if err := a.upload(result.Succeeded); err != nil {
+		return err
+	}
+
+	var pending []string
+	for _, job := range jobs {
+		if journal.Reached(job.name, state.StageMigrated) {
+			fmt.Printf("%s was already migrated, skipping migration.\n", job.name)
+			continue
+		}
+		pending = append(pending, job.name)
+	}
+	if len(pending) == 0 {
+		return result.Err()
+	}
+	if decide(a.cfg.Migration.Enabled, "Would you like to create an  OVA provider and perform a migration?") {
+		waves, err := a.waves(pending)
+		if err != nil {
+			return err
+		}
+		client, err := a.clusterClient(true)
+		if err != nil {
+			return err
+		}
+		if err := a.migrateWaves(client, waves, a.cfg.Migration.ParallelWaves); err != nil {
+			return errors.Join(err, result.Err())
+		}
+	} else {
+		fmt.Println("Skipping OVA provider creation and migration.")
+	}
+	return result.Err()
+}
+
+// upload copies the directories of vmNames to the configured destination, or
+// asks for each destination when none is configured.
+func (a *app) upload(vmNames []string) error {
+	switch strings.ToLower(a.cfg.Destination.Type) {
+	case "nfs":
+		return a.uploadTo("nfs", vmNames)
+	case "s3":
+		return a.uploadTo("s3", vmNames)
+	case "none":
+		fmt.Println("No destination configured, skipping upload.")
+		return nil
+	}
+
+	if hyperv.AskYesNo("Would you like to copy OVA files to the NFS server?") {
+		if err := a.uploadTo("nfs", vmNames); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("Skipping copy to NFS server.")
+	}
+
+	if os.Getenv("S3_BUCKET") != "" {
+		if hyperv.AskYesNo("Would you like to upload OVA files to object storage?") {
+			if err := a.uploadTo("s3", vmNames); err != nil {
+				return err
+			}
+		} else {
+			fmt.Println("Skipping upload to object storage.")
+		}
+	}
+	return nil
+}
+
+// allReached reports whether every job has completed stage.
+func allReached(journal *state.Journal, jobs []exportJob, stage state.Stage) bool {
+	for _, job := range jobs {
+		if !journal.Reached(job.name, stage) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"hyperv/serve"
+)
+
+func runServe(a *app, args []string) error {
+	fs := a.flagSet("serve", "serve [flags] [directory]")
+	if err := a.parse(fs, args); err != nil {
+		return err
+	}
+
+	// Publish the output directory over HTTP(S) for importers that pull by URL
+	root := a.outputDir
+	if fs.NArg() > 0 {
+		root = fs.Arg(0)
+	}
+	server, err := serve.NewServer(serve.OptionsFromEnv(root))
+	if err != nil {
+		return fmt.Errorf("serve failed: %w", err)
+	}
+	if err := server.ListenAndServe(a.ctx); err != nil {
+		return fmt.Errorf("serve failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	ocp "hyperv/cluster"
+	hyperv "hyperv/common"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+func runStatus(a *app, args []string) error {
+	fs := a.flagSet("status", "status [flags]")
+	cluster := fs.Bool("cluster", false, "Also show the migration status from the cluster")
+	a.clusterFlags(fs)
+	if err := a.parse(fs, args); err != nil {
+		return err
+	}
+
+	names, err := a.exportedVMs()
+	if err != nil {
+		return fmt.Errorf("failed to scan output directory: %w", err)
+	}
+	journal, err := a.openJournal()
+	if err != nil {
+		return err
+	}
+	// VMs that were only inventoried or shut down have no vm-info.json yet
+	for _, vm := range journal.All() {
+		if !slices.Contains(names, vm.Name) {
+			names = append(names, vm.Name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Printf("No exported VMs in %s\n", a.outputDir)
+	}
+
+	for _, vmName := range names {
+		entry := journal.Get(vmName)
+		stage := string(entry.Stage)
+		if stage == "" {
+			stage = "unknown"
+		}
+		if entry.Error != "" {
+			stage += ", last error: " + entry.Error
+		}
+
+		vmInfoMap, err := a.loadVMInfo(vmName)
+		if err != nil {
+			fmt.Printf("%s: stage %s\n", vmName, stage)
+			continue
+		}
+		localFiles, err := a.localDiskPaths(vmName, vmInfoMap)
+		if err != nil {
+			fmt.Printf("%s: %v\n", vmName, err)
+			continue
+		}
+
+		downloaded := 0
+		for _, localFile := range localFiles {
+			if _, err := os.Stat(localFile); err == nil {
+				downloaded++
+			}
+		}
+
+		ovfState := "missing"
+		if len(localFiles) > 0 {
+			ovfPath := hyperv.RemoveFileExtension(localFiles[0]) + ".ovf"
+			if _, err := os.Stat(ovfPath); err == nil {
+				ovfState = filepath.Base(ovfPath)
+			}
+		}
+
+		migration := ""
+		if entry.Migration != "" {
+			migration = ", migration " + entry.Migration
+		}
+		fmt.Printf("%s: stage %s, disks %d/%d downloaded, OVF %s%s\n", vmName, stage, downloaded, len(localFiles), ovfState, migration)
+	}
+
+	if *cluster {
+		var migrations []string
+		for _, vm := range journal.All() {
+			if vm.Migration != "" && !slices.Contains(migrations, vm.Migration) {
+				migrations = append(migrations, vm.Migration)
+			}
+		}
+		if len(migrations) == 0 {
+			fmt.Println("No migrations were started.")
+			return nil
+		}
+		client, err := a.clusterClient(false)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			if err := ocp.PrintMigrationStatus(a.ctx, client, migration); err != nil {
+				return fmt.Errorf("failed to get migration status: %w", err)
+			}
+		}
+	}
+	return nil
+}
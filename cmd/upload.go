@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	nfs "hyperv/nfs"
+	s3 "hyperv/s3"
+	"hyperv/state"
+	"os"
+)
+
+func runUpload(a *app, args []string) error {
+	fs := a.flagSet("upload", "upload [flags] [VM names...]")
+	to := fs.String("to", "", "Destination: nfs or s3 (default destination.type from the config, else nfs)")
+	if err := a.parse(fs, args); err != nil {
+		return err
+	}
+	if *to == "" {
+		*to = a.cfg.Destination.Type
+	}
+	if *to == "" || *to == "none" {
+		*to = "nfs"
+	}
+
+	vmNames := fs.Args()
+	if len(vmNames) == 0 {
+		var err error
+		if vmNames, err = a.packagedVMs(); err != nil {
+			return err
+		}
+		if len(vmNames) == 0 {
+			return fmt.Errorf("no packaged VMs to upload")
+		}
+	}
+	return a.uploadTo(*to, vmNames)
+}
+
+// packagedVMs returns the VMs of the state journal that have an OVF.
+func (a *app) packagedVMs() ([]string, error) {
+	journal, err := a.openJournal()
+	if err != nil {
+		return nil, err
+	}
+	var packaged []string
+	for _, vm := range journal.All() {
+		if journal.Reached(vm.Name, state.StageOVFWritten) {
+			packaged = append(packaged, vm.Name)
+		}
+	}
+	return packaged, nil
+}
+
+// uploadTo copies the directories of vmNames to destination (nfs or s3) and
+// records those of them that were packaged as copied in the state journal.
+func (a *app) uploadTo(destination string, vmNames []string) error {
+	var target string
+	switch destination {
+	case "nfs":
+		if err := nfs.CopyToNFSServer(a.outputDir, vmNames); err != nil {
+			return fmt.Errorf("copy failed: %w", err)
+		}
+		target = "nfs:" + os.Getenv("OVA_PROVIDER_NFS_SERVER_PATH")
+	case "s3":
+		if err := s3.CopyToObjectStorage(a.ctx, a.outputDir, vmNames); err != nil {
+			return fmt.Errorf("upload failed: %w", err)
+		}
+		target = fmt.Sprintf("s3://%s/%s", os.Getenv("S3_BUCKET"), os.Getenv("S3_PREFIX"))
+	default:
+		return fmt.Errorf("unknown destination %q (expected nfs or s3)", destination)
+	}
+
+	journal, err := a.openJournal()
+	if err != nil {
+		return err
+	}
+	for _, name := range vmNames {
+		if journal.Reached(name, state.StageOVFWritten) {
+			if err := journal.SetCopied(name, target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
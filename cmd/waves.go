@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	ocp "hyperv/cluster"
+	hyperv "hyperv/common"
+	"hyperv/config"
+	"hyperv/logging"
+	"hyperv/ova"
+	"hyperv/state"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// waveTagPrefix marks the Hyper-V tag that puts a VM in a wave when the
+	// config does not place it, e.g. "tags: wave-db".
+	waveTagPrefix = "wave-"
+	// defaultWave holds the VMs that are in no other wave.
+	defaultWave = "default"
+	// manifestDirName holds the Forklift manifests of each wave below the
+	// output directory; like every dot directory it is never uploaded.
+	manifestDirName = ".migration"
+	// runIDFileName keeps the migration run ID of the output directory, so
+	// reruns reuse the cluster objects of the first attempt.
+	runIDFileName = "run-id"
+)
+
+// waveMember is a VM to be placed in a wave.
+type waveMember struct {
+	name     string
+	dir      string
+	tags     []string
+	adapters []ova.Adapter
+	drives   []ova.Drive
+}
+
+// memberOf returns the wave member of vmName with the tags of its notes,
+// its network adapters and its drives.
+func memberOf(vmName, dir string, vmInfoMap map[string]interface{}) waveMember {
+	notes, _ := vmInfoMap["Notes"].(string)
+	return waveMember{
+		name:     vmName,
+		dir:      dir,
+		tags:     hyperv.VMSummary{Name: vmName, Notes: notes}.Tags(),
+		adapters: ova.Adapters(vmInfoMap),
+		drives:   ova.Drives(vmInfoMap),
+	}
+}
+
+// groupWaves puts every member into the first configured wave it matches,
+// else into the wave named by its wave-<name> tag, else into the default
+// wave. Configured waves come first in config order, then the tag waves by
+// name, then the default wave.
+func groupWaves(waves []config.WaveConfig, members []waveMember) []ocp.Wave {
+	byName := make(map[string]*ocp.Wave)
+	add := func(wave string, m waveMember) {
+		w, ok := byName[wave]
+		if !ok {
+			w = &ocp.Wave{Name: wave}
+			byName[wave] = w
+		}
+		w.VMs = append(w.VMs, ocp.WaveVM{Name: m.name, Dir: m.dir, Adapters: m.adapters, Drives: m.drives})
+	}
+
+	var tagged []string
+	for _, m := range members {
+		if wave, ok := configuredWave(waves, m); ok {
+			add(wave, m)
+			continue
+		}
+		wave := defaultWave
+		for _, tag := range m.tags {
+			if name, ok := strings.CutPrefix(tag, waveTagPrefix); ok && config.ValidWaveName(name) {
+				wave = name
+				break
+			}
+		}
+		if wave != defaultWave {
+			tagged = append(tagged, wave)
+		}
+		add(wave, m)
+	}
+
+	var sorted []string
+	seen := make(map[string]bool)
+	appendWave := func(name string) {
+		if _, ok := byName[name]; ok && !seen[name] {
+			seen[name] = true
+			sorted = append(sorted, name)
+		}
+	}
+	for _, w := range waves {
+		appendWave(w.Name)
+	}
+	sort.Strings(tagged)
+	for _, name := range tagged {
+		appendWave(name)
+	}
+	appendWave(defaultWave)
+
+	result := make([]ocp.Wave, 0, len(sorted))
+	for _, name := range sorted {
+		result = append(result, *byName[name])
+	}
+	return result
+}
+
+func configuredWave(waves []config.WaveConfig, m waveMember) (string, bool) {
+	for _, w := range waves {
+		for _, pattern := range w.VMs {
+			if ok, _ := path.Match(pattern, m.name); ok {
+				return w.Name, true
+			}
+		}
+		if w.Tag != "" && slices.Contains(m.tags, strings.ToLower(w.Tag)) {
+			return w.Name, true
+		}
+	}
+	return "", false
+}
+
+// waves groups the exported VMs vmNames into migration waves.
+func (a *app) waves(vmNames []string) ([]ocp.Wave, error) {
+	var members []waveMember
+	for _, name := range vmNames {
+		vmInfoMap, err := a.loadVMInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, memberOf(name, a.vmDir(name), vmInfoMap))
+	}
+	return groupWaves(a.cfg.Migration.Waves, members), nil
+}
+
+// migrateWaves migrates every wave, one after another or all at once, and
+// records the outcome of each VM in the state journal.
+func (a *app) migrateWaves(client *ocp.Client, waves []ocp.Wave, parallel bool) error {
+	journal, err := a.openJournal()
+	if err != nil {
+		return err
+	}
+	runID, err := a.migrationRunID(true)
+	if err != nil {
+		return err
+	}
+	slog.Info("Migration run", "run_id", runID)
+
+	errs := make([]error, len(waves))
+	run := func(i int) {
+		errs[i] = a.migrateWave(client, journal, runID, waves[i])
+	}
+	if parallel {
+		var wg sync.WaitGroup
+		for i := range waves {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				run(i)
+			}()
+		}
+		wg.Wait()
+	} else {
+		for i := range waves {
+			if err := a.ctx.Err(); err != nil {
+				errs[i] = fmt.Errorf("wave %s not started: %w", waves[i].Name, err)
+				continue
+			}
+			run(i)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// migrationRunID returns the ID naming the cluster objects of the
+// migration: the configured one, else the one recorded in the output
+// directory. Without either, the ID of this run is used and, when save is
+// set, recorded for the next runs.
+func (a *app) migrationRunID(save bool) (string, error) {
+	if id := a.cfg.Migration.RunID; id != "" {
+		return ocp.DNSLabel(id), nil
+	}
+	file := filepath.Join(a.outputDir, manifestDirName, runIDFileName)
+	content, err := os.ReadFile(file)
+	if err == nil && strings.TrimSpace(string(content)) != "" {
+		return ocp.DNSLabel(strings.TrimSpace(string(content))), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read migration run ID: %w", err)
+	}
+
+	id := ocp.DNSLabel(a.runID)
+	if save {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(file, []byte(id+"\n"), 0644); err != nil {
+			return "", fmt.Errorf("failed to record migration run ID: %w", err)
+		}
+	}
+	return id, nil
+}
+
+// mappingRules converts the configured network and storage rules for the
+// cluster package.
+func (a *app) mappingRules() ocp.MappingRules {
+	var rules ocp.MappingRules
+	for _, r := range a.cfg.Migration.Networks {
+		dest := ocp.DestinationNetwork{Type: r.Target}
+		if r.Target == ocp.NetworkMultus {
+			dest.Namespace, dest.Name, _ = strings.Cut(r.NAD, "/")
+			if dest.Name == "" {
+				dest.Namespace, dest.Name = "", r.NAD
+			}
+		}
+		rules.Networks = append(rules.Networks, ocp.NetworkRule{Switch: r.Switch, Adapter: r.Adapter, VLAN: r.VLAN, Destination: dest})
+	}
+	for _, r := range a.cfg.Migration.Storage {
+		// Validate already parsed the sizes
+		minSize, _ := config.ParseSize(r.MinSize)
+		maxSize, _ := config.ParseSize(r.MaxSize)
+		rules.Storage = append(rules.Storage, ocp.StorageRule{
+			VM:         r.VM,
+			Path:       r.Path,
+			Controller: r.Controller,
+			MinSize:    minSize,
+			MaxSize:    maxSize,
+			Destination: ocp.DestinationStorage{
+				StorageClass: r.StorageClass,
+				VolumeMode:   r.VolumeMode,
+				AccessMode:   r.AccessMode,
+			},
+		})
+	}
+	return rules
+}
+
+// migrateWave runs the plan of one wave and records every VM's outcome.
+func (a *app) migrateWave(client *ocp.Client, journal *state.Journal, runID string, wave ocp.Wave) error {
+	logger := slog.With("wave", wave.Name, logging.KeyStage, "migrate")
+	plan, migration := ocp.MigrationNames(runID, wave.Name)
+	for _, vm := range wave.VMs {
+		if err := journal.SetMigration(vm.Name, plan, migration); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Migrating wave", "vms", strings.Join(wave.VMNames(), ", "))
+	results, err := ocp.RunOvaPlan(a.ctx, client, runID, wave, a.mappingRules(), filepath.Join(a.outputDir, manifestDirName, wave.Name))
+	if err != nil {
+		for _, vm := range wave.VMs {
+			journal.Fail(vm.Name, err)
+		}
+		return fmt.Errorf("wave %s: %w", wave.Name, err)
+	}
+
+	var failed []error
+	for _, vm := range wave.VMs {
+		if vmErr := results[vm.Name]; vmErr != nil {
+			journal.Fail(vm.Name, vmErr)
+			logger.Error("VM migration failed", logging.KeyVM, vm.Name, "error", vmErr)
+			failed = append(failed, fmt.Errorf("%s: %w", vm.Name, vmErr))
+			continue
+		}
+		if err := journal.Advance(vm.Name, state.StageMigrated); err != nil {
+			return err
+		}
+		logger.Info("VM migrated", logging.KeyVM, vm.Name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("wave %s: %w", wave.Name, errors.Join(failed...))
+	}
+	return nil
+}
@@ -3,12 +3,19 @@ package common
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hyperv/logging"
+	"hyperv/metrics"
+	"hyperv/progress"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/bramvdbogaerde/go-scp"
 	"github.com/bramvdbogaerde/go-scp/auth"
@@ -23,13 +30,13 @@ const (
 	ListVMs   VMAction = "list"
 	GetVMInfo VMAction = "info"
 
-	Shutdown VMAction = "Stop-VM -Name '%s' -Force -Confirm:$false"
-	Start    VMAction = "Start-VM -Name '%s'"
-	Save     VMAction = "Save-VM -Name '%s'"
-	Pause    VMAction = "Suspend-VM -Name '%s'"
-	Resume   VMAction = "Resume-VM -Name '%s'"
-	Remove   VMAction = "Remove-VM -Name '%s' -Force -Confirm:$false"
-	Restart  VMAction = "Restart-VM -Name '%s' -Force -Confirm:$false"
+	Shutdown VMAction = "Stop-VM -Name %s -Force -Confirm:$false"
+	Start    VMAction = "Start-VM -Name %s"
+	Save     VMAction = "Save-VM -Name %s"
+	Pause    VMAction = "Suspend-VM -Name %s"
+	Resume   VMAction = "Resume-VM -Name %s"
+	Remove   VMAction = "Remove-VM -Name %s -Force -Confirm:$false"
+	Restart  VMAction = "Restart-VM -Name %s -Force -Confirm:$false"
 )
 
 type PSOptions struct {
@@ -39,6 +46,13 @@ type PSOptions struct {
 	AsJSON    bool
 }
 
+// VHDInfo holds the sizes Hyper-V reports for a virtual disk file.
+type VHDInfo struct {
+	Path     string `json:"Path"`
+	Size     uint64 `json:"Size"`     // virtual size in bytes
+	FileSize uint64 `json:"FileSize"` // physical size on the host in bytes
+}
+
 type HyperVConnection struct {
 	Client   *winrm.Client
 	HostIP   string
@@ -66,6 +80,9 @@ func runPSCommand(client *winrm.Client, baseCommand string, opts PSOptions) (int
 
 	var stdout, stderr bytes.Buffer
 	exitCode, err := client.Run(psCommand, &stdout, &stderr)
+	if err != nil || exitCode != 0 {
+		metrics.WinRMErrors.Inc()
+	}
 	if err != nil {
 		return nil, fmt.Errorf("command failed: %w\nSTDERR: %s\nSTDOUT: %s", err, stderr.String(), stdout.String())
 	}
@@ -85,24 +102,25 @@ func runPSCommand(client *winrm.Client, baseCommand string, opts PSOptions) (int
 }
 
 func performVMAction(client *winrm.Client, vmName string, action VMAction) error {
-	fmt.Printf("Executing VM action: %s on '%s'\n", strings.Fields(string(action))[0], vmName)
+	logger := slog.With(logging.KeyVM, vmName, "action", strings.Fields(string(action))[0])
+	logger.Info("Executing VM action")
 
-	cmd := fmt.Sprintf(string(action), vmName)
+	cmd := fmt.Sprintf(string(action), PSQuote(vmName))
 	_, err := runPSCommand(client, cmd, PSOptions{})
 	if err != nil {
 		return fmt.Errorf("VM action failed (%s): %w", action, err)
 	}
 
-	fmt.Printf("Action %s completed successfully on '%s'\n", strings.Fields(string(action))[0], vmName)
+	logger.Info("VM action completed")
 	return nil
 }
 
 func GetGuestOSInfoFromVM(client *winrm.Client, vmName, guestUser, guestPassword string) (interface{}, error) {
-	psCmd := fmt.Sprintf(`$secpasswd = ConvertTo-SecureString '%s' -AsPlainText -Force; `+
-		`$cred = New-Object System.Management.Automation.PSCredential('%s', $secpasswd); `+
-		`Invoke-Command -VMName '%s' -Credential $cred -ScriptBlock { `+
+	psCmd := fmt.Sprintf(`$secpasswd = ConvertTo-SecureString %s -AsPlainText -Force; `+
+		`$cred = New-Object System.Management.Automation.PSCredential(%s, $secpasswd); `+
+		`Invoke-Command -VMName %s -Credential $cred -ScriptBlock { `+
 		`Get-CimInstance Win32_OperatingSystem | Select Caption, Version, OSArchitecture }`,
-		guestPassword, guestUser, vmName)
+		PSQuote(guestPassword), PSQuote(guestUser), PSQuote(vmName))
 
 	return runPSCommand(client, psCmd, PSOptions{
 		AsJSON:    true,
@@ -112,13 +130,30 @@ func GetGuestOSInfoFromVM(client *winrm.Client, vmName, guestUser, guestPassword
 }
 
 func getVMInfo(client *winrm.Client, vmName string) (interface{}, error) {
-	return runPSCommand(client, fmt.Sprintf("Get-VM -Name '%s'", vmName), PSOptions{
+	return runPSCommand(client, fmt.Sprintf("Get-VM -Name %s", PSQuote(vmName)), PSOptions{
 		AsJSON:    true,
 		ParseJSON: true,
 		Depth:     3,
 	})
 }
 
+// GetVHDInfo asks Hyper-V for the virtual and physical size of a disk file.
+func GetVHDInfo(client *winrm.Client, path string) (*VHDInfo, error) {
+	out, err := runPSCommand(client, fmt.Sprintf("Get-VHD -Path %s | Select Path, Size, FileSize", PSQuote(path)), PSOptions{
+		AsJSON:   true,
+		Compress: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var info VHDInfo
+	if err := json.Unmarshal([]byte(out.(string)), &info); err != nil {
+		return nil, fmt.Errorf("failed to parse Get-VHD output: %w\nRaw Output:\n%s", err, out)
+	}
+	return &info, nil
+}
+
 func getVMNames(client *winrm.Client) ([]string, error) {
 	out, err := runPSCommand(client, "Get-VM | Select -ExpandProperty Name", PSOptions{})
 	if err != nil {
@@ -147,10 +182,14 @@ func PerformVMAction(client *winrm.Client, vmName string, action VMAction) (inte
 }
 
 // CopyRemoteFileWithProgress connects via SSH, copies a file from the remote host, and shows progress.
-func CopyRemoteFileWithProgress(user, password, host, sshPort, remotePath, localFilename string) error {
+// It returns the SHA256 of the downloaded data. A failed or cancelled
+// download removes the partial local file.
+func CopyRemoteFileWithProgress(ctx context.Context, user, password, host, sshPort, remotePath, localFilename string) (digest string, err error) {
+	logger := logging.FromContext(ctx).With(logging.KeyStage, "download", logging.KeyDisk, remotePath)
+
 	clientConfig, err := auth.PasswordKey(user, password, ssh.InsecureIgnoreHostKey())
 	if err != nil {
-		return fmt.Errorf("failed to create SSH client config: %w", err)
+		return "", fmt.Errorf("failed to create SSH client config: %w", err)
 	}
 
 	// Build SSH address
@@ -158,45 +197,40 @@ func CopyRemoteFileWithProgress(user, password, host, sshPort, remotePath, local
 
 	scpClient := scp.NewClient(sshAddr, &clientConfig)
 	if err := scpClient.Connect(); err != nil {
-		return fmt.Errorf("failed to connect to SSH: %w", err)
+		return "", fmt.Errorf("failed to connect to SSH: %w", err)
 	}
 	defer scpClient.Close()
 
 	file, err := os.Create(localFilename)
 	if err != nil {
-		return fmt.Errorf("failed to create local file: %w", err)
+		return "", fmt.Errorf("failed to create local file: %w", err)
 	}
-	defer file.Close()
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(localFilename)
+		}
+	}()
 
-	done := make(chan struct{})
-	go showProgress(file.Name(), done)
+	logger.Info("Downloading disk", "local", localFilename)
 
-	err = scpClient.CopyFromRemote(context.Background(), file, remotePath)
-	close(done) // stop the progress ticker
+	// The local directory is named after the VM
+	task := progress.Start(progress.Download, filepath.Join(filepath.Base(filepath.Dir(localFilename)), RemoteFileName(remotePath)), 0)
+	defer task.Done()
+	passThru := func(r io.Reader, total int64) io.Reader {
+		task.SetTotal(total)
+		return task.Reader(r)
+	}
 
+	// Hash while downloading so the journal can record the digest for free
+	hash := sha256.New()
+	err = scpClient.CopyFromRemotePassThru(ctx, io.MultiWriter(file, hash), remotePath, passThru)
 	if err != nil {
-		return fmt.Errorf("failed to copy from remote: %w", err)
+		return "", fmt.Errorf("failed to copy from remote: %w", err)
 	}
 
-	fmt.Println("\n Download complete.")
-	return nil
-}
-
-func showProgress(filename string, done <-chan struct{}) {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-done:
-			fmt.Print("\r") // clear line on exit
-			return
-		case <-ticker.C:
-			fi, err := os.Stat(filename)
-			if err == nil {
-				fmt.Printf("\rDownloading... %d bytes      ", fi.Size())
-			}
-		}
-	}
+	logger.Info("Download complete", "local", localFilename)
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 // LoadHyperVConnection loads environment variables and returns:
@@ -205,7 +239,8 @@ func showProgress(filename string, done <-chan struct{}) {
 // - SSH host string (ip:port)
 // - user and password
 func LoadHyperVConnection() (*HyperVConnection, error) {
-	if err := godotenv.Load(); err != nil {
+	// The settings may come from the config file or the environment alone
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("error loading .env file: %w", err)
 	}
 
@@ -233,7 +268,7 @@ func LoadHyperVConnection() (*HyperVConnection, error) {
 		return nil, fmt.Errorf("failed to create WinRM client: %v", err)
 	}
 
-	fmt.Printf("Connected to Hyper-V at %s (SSH) and WinRM port %d\n", hostIP, winrmPort)
+	slog.Info("Connected to Hyper-V", "host", hostIP, "sshPort", sshPort, "winrmPort", winrmPort)
 	return &HyperVConnection{
 		Client:   client,
 		HostIP:   hostIP,
@@ -0,0 +1,188 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/masterzen/winrm"
+)
+
+// VMSummary is the inventory needed to decide whether a VM is selected.
+type VMSummary struct {
+	Name  string `json:"Name"`
+	State string `json:"State"`
+	Notes string `json:"Notes"`
+}
+
+// IsRunning reports whether Hyper-V considers the VM on.
+func (v VMSummary) IsRunning() bool {
+	return v.State != "Off"
+}
+
+// Tags returns the tags recorded in the VM's Hyper-V notes, either as a
+// "tags: a, b" line or as #hashtags, lowercased.
+func (v VMSummary) Tags() []string {
+	var tags []string
+	for _, line := range strings.Split(v.Notes, "\n") {
+		line = strings.TrimSpace(line)
+		if key, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(strings.TrimSpace(key), "tags") {
+			for _, t := range strings.Split(value, ",") {
+				if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+					tags = append(tags, t)
+				}
+			}
+			continue
+		}
+		for _, word := range strings.Fields(line) {
+			if strings.HasPrefix(word, "#") && len(word) > 1 {
+				tags = append(tags, strings.ToLower(strings.TrimRight(word[1:], ",.;")))
+			}
+		}
+	}
+	return tags
+}
+
+// VMSelector narrows the VMs on the host down to the ones a run may touch.
+// Names, globs, regular expressions and tags are alternatives: a VM matching
+// any of them is included. With none of them set every VM is included.
+// Excludes (names or globs) and the power state filters are applied last.
+type VMSelector struct {
+	Names       []string
+	Globs       []string
+	Regexes     []string
+	Tags        []string
+	Exclude     []string
+	OnlyOff     bool
+	OnlyRunning bool
+	// All asks for every VM on the host on purpose; see Explicit.
+	All bool
+}
+
+func (s VMSelector) hasIncludes() bool {
+	return len(s.Names) > 0 || len(s.Globs) > 0 || len(s.Regexes) > 0 || len(s.Tags) > 0
+}
+
+// Explicit reports whether the selector names the VMs it wants, or asks for
+// all of them with All. Commands that shut VMs down refuse selectors that
+// don't, so a forgotten filter can't take down a whole host; excludes and
+// power state filters alone don't count.
+func (s VMSelector) Explicit() bool {
+	return s.All || s.hasIncludes()
+}
+
+// Select applies the selector to vms, preserving their order. Explicit
+// names that don't exist on the host are an error so typos don't silently
+// shrink a migration wave.
+func (s VMSelector) Select(vms []VMSummary) ([]VMSummary, error) {
+	if s.OnlyOff && s.OnlyRunning {
+		return nil, fmt.Errorf("only-off and only-running are mutually exclusive")
+	}
+
+	var regexes []*regexp.Regexp
+	for _, expr := range s.Regexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VM regex %q: %w", expr, err)
+		}
+		regexes = append(regexes, re)
+	}
+	for _, pattern := range append(append([]string(nil), s.Globs...), s.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid VM pattern %q: %w", pattern, err)
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, vm := range vms {
+		known[vm.Name] = true
+	}
+	for _, name := range s.Names {
+		if !known[name] {
+			return nil, fmt.Errorf("VM %q not found on the Hyper-V host", name)
+		}
+	}
+
+	var selected []VMSummary
+	for _, vm := range vms {
+		if s.hasIncludes() && !s.includes(vm, regexes) {
+			continue
+		}
+		if matchesAny(vm.Name, s.Exclude) {
+			continue
+		}
+		if s.OnlyOff && vm.IsRunning() || s.OnlyRunning && !vm.IsRunning() {
+			continue
+		}
+		selected = append(selected, vm)
+	}
+	return selected, nil
+}
+
+func (s VMSelector) includes(vm VMSummary, regexes []*regexp.Regexp) bool {
+	for _, name := range s.Names {
+		if vm.Name == name {
+			return true
+		}
+	}
+	if matchesAny(vm.Name, s.Globs) {
+		return true
+	}
+	for _, re := range regexes {
+		if re.MatchString(vm.Name) {
+			return true
+		}
+	}
+	if len(s.Tags) > 0 {
+		vmTags := vm.Tags()
+		for _, want := range s.Tags {
+			for _, have := range vmTags {
+				if strings.EqualFold(want, have) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether name equals or glob-matches one of patterns.
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == name {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ListVMSummaries returns the name, power state and notes of every VM.
+func ListVMSummaries(client *winrm.Client) ([]VMSummary, error) {
+	out, err := runPSCommand(client, "Get-VM | Select Name, @{n='State';e={$_.State.ToString()}}, Notes", PSOptions{
+		AsJSON:   true,
+		Compress: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	raw := strings.TrimSpace(out.(string))
+	if raw == "" {
+		return nil, nil
+	}
+	// ConvertTo-Json emits a bare object when there is a single VM
+	if !strings.HasPrefix(raw, "[") {
+		raw = "[" + raw + "]"
+	}
+
+	var vms []VMSummary
+	if err := json.Unmarshal([]byte(raw), &vms); err != nil {
+		return nil, fmt.Errorf("failed to parse VM list: %w\nRaw Output:\n%s", err, raw)
+	}
+	return vms, nil
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestVMSelectorExplicit(t *testing.T) {
+	tests := []struct {
+		name string
+		sel  VMSelector
+		want bool
+	}{
+		{"nothing", VMSelector{}, false},
+		{"only excludes", VMSelector{Exclude: []string{"dc01"}}, false},
+		{"only power state", VMSelector{OnlyRunning: true}, false},
+		{"name", VMSelector{Names: []string{"web01"}}, true},
+		{"glob", VMSelector{Globs: []string{"web-*"}}, true},
+		{"regex", VMSelector{Regexes: []string{"^db"}}, true},
+		{"tag", VMSelector{Tags: []string{"prod"}}, true},
+		{"all", VMSelector{All: true, Exclude: []string{"dc01"}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.sel.Explicit(); got != tt.want {
+			t.Errorf("%s: Explicit() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVMSelectorSelect(t *testing.T) {
+	vms := []VMSummary{
+		{Name: "web-01", State: "Running"},
+		{Name: "web-02", State: "Off"},
+		{Name: "db-01", State: "Running", Notes: "tags: prod, db"},
+		{Name: "dc01", State: "Running", Notes: "#infra"},
+	}
+	tests := []struct {
+		name string
+		sel  VMSelector
+		want []string
+	}{
+		{"all", VMSelector{All: true}, []string{"web-01", "web-02", "db-01", "dc01"}},
+		{"all but excluded", VMSelector{All: true, Exclude: []string{"dc*"}}, []string{"web-01", "web-02", "db-01"}},
+		{"glob or tag", VMSelector{Globs: []string{"web-*"}, Tags: []string{"infra"}}, []string{"web-01", "web-02", "dc01"}},
+		{"running only", VMSelector{Globs: []string{"web-*"}, OnlyRunning: true}, []string{"web-01"}},
+		{"regex", VMSelector{Regexes: []string{"^db-[0-9]+$"}}, []string{"db-01"}},
+	}
+	for _, tt := range tests {
+		selected, err := tt.sel.Select(vms)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, vm := range selected {
+			got = append(got, vm.Name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: selected %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := (VMSelector{Names: []string{"web-03"}}).Select(vms); err == nil {
+		t.Error("unknown VM name was not an error")
+	}
+}
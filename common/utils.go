@@ -3,9 +3,12 @@ package common
 import (
 	"bufio"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"golang.org/x/term"
 )
 
 func ExtractPath(vm map[string]interface{}) ([]string, bool) {
@@ -30,17 +33,68 @@ func SaveVMJsonToFile(jsonOut []byte, filename string) error {
 	if err != nil {
 		return fmt.Errorf("failed to write JSON to file: %w", err)
 	}
-	fmt.Printf("JSON output saved to: %s\n", filename)
+	slog.Debug("JSON output saved", "path", filename)
 	return nil
 }
 
+// RemoteFileName returns the file name of a Windows or POSIX path on the Hyper-V host.
+func RemoteFileName(remotePath string) string {
+	if idx := strings.LastIndex(remotePath, "\\"); idx != -1 {
+		return remotePath[idx+1:]
+	}
+	if idx := strings.LastIndex(remotePath, "/"); idx != -1 {
+		return remotePath[idx+1:]
+	}
+	return remotePath
+}
+
+// PSQuote returns s as a single-quoted PowerShell string literal. Only
+// quotes need escaping there, by doubling them; PowerShell also takes the
+// typographic single quotes for one.
+func PSQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch r {
+		case '\'', '\u2018', '\u2019', '\u201a', '\u201b':
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
 func RemoveFileExtension(filename string) string {
 	ext := filepath.Ext(filename)
 	return strings.TrimSuffix(filename, ext)
 }
 
+// assumeYes makes AskYesNo answer yes without reading stdin.
+var assumeYes bool
+
+// SetAssumeYes makes every later AskYesNo answer yes, for unattended runs.
+func SetAssumeYes(yes bool) {
+	assumeYes = yes
+}
+
+// IsInteractive reports whether stdin is a terminal a prompt can read from.
+func IsInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// AskYesNo asks a yes/no question on stdin. With SetAssumeYes it answers
+// yes; without a terminal it answers no instead of blocking.
 func AskYesNo(prompt string) bool {
 	fmt.Print(prompt + " [y/N]: ")
+	if assumeYes {
+		fmt.Println("yes (--yes)")
+		return true
+	}
+	if !IsInteractive() {
+		fmt.Println("no (stdin is not a terminal, pass --yes to confirm)")
+		return false
+	}
 	reader := bufio.NewReader(os.Stdin)
 	answer, _ := reader.ReadString('\n')
 	answer = strings.TrimSpace(strings.ToLower(answer))
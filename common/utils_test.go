@@ -0,0 +1,18 @@
+package common
+
+import "testing"
+
+func TestPSQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{`C:\VMs\web01.vhdx`, `'C:\VMs\web01.vhdx'`},
+		{`C:\VMs\o'brien.vhdx`, `'C:\VMs\o''brien.vhdx'`},
+		{`C:\x'; Remove-Item C:\ -Recurse; '`, `'C:\x''; Remove-Item C:\ -Recurse; '''`},
+		{"C:\\it\u2019s.vhdx", "'C:\\it\u2019\u2019s.vhdx'"},
+		{`$env:TEMP\a.vhdx`, `'$env:TEMP\a.vhdx'`},
+	}
+	for _, tt := range tests {
+		if got := PSQuote(tt.in); got != tt.want {
+			t.Errorf("PSQuote(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,542 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"hyperv/logging"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the declarative form of every setting the tool reads. Values
+// come from the YAML file, are overridden by environment variables and then
+// by command line flags; Export publishes the result back to the
+// environment the individual packages read from.
+type Config struct {
+	Connection  ConnectionConfig  `json:"connection"`
+	Selection   SelectionConfig   `json:"selection"`
+	Output      OutputConfig      `json:"output"`
+	Destination DestinationConfig `json:"destination"`
+	Migration   MigrationConfig   `json:"migration"`
+	Concurrency ConcurrencyConfig `json:"concurrency"`
+	Logging     LoggingConfig     `json:"logging"`
+	Metrics     MetricsConfig     `json:"metrics"`
+	// AssumeYes answers every confirmation prompt with yes.
+	AssumeYes bool `json:"assumeYes"`
+}
+
+type ConnectionConfig struct {
+	Host      string `json:"host"`
+	User      string `json:"user"`
+	Password  string `json:"password"`
+	WinRMPort Port   `json:"winrmPort"`
+	SSHPort   Port   `json:"sshPort"`
+}
+
+type SelectionConfig struct {
+	VMs         []string `json:"vms"`
+	Match       []string `json:"match"`
+	Regex       []string `json:"regex"`
+	Tags        []string `json:"tags"`
+	Exclude     []string `json:"exclude"`
+	OnlyOff     bool     `json:"onlyOff"`
+	OnlyRunning bool     `json:"onlyRunning"`
+	// All selects every VM on the host when nothing else selects any.
+	All bool `json:"all"`
+}
+
+type OutputConfig struct {
+	Dir string `json:"dir"`
+	// Preflight is strict, warn or off.
+	Preflight string `json:"preflight"`
+}
+
+type DestinationConfig struct {
+	// Type is nfs, s3 or none. When empty the run asks interactively.
+	Type string    `json:"type"`
+	NFS  NFSConfig `json:"nfs"`
+	S3   S3Config  `json:"s3"`
+}
+
+type NFSConfig struct {
+	Path         string `json:"path"`
+	SudoPassword string `json:"sudoPassword"`
+}
+
+type S3Config struct {
+	Endpoint           string `json:"endpoint"`
+	Bucket             string `json:"bucket"`
+	AccessKeyID        string `json:"accessKeyId"`
+	SecretAccessKey    string `json:"secretAccessKey"`
+	Region             string `json:"region"`
+	Prefix             string `json:"prefix"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+type MigrationConfig struct {
+	// Enabled runs the migration after the upload; nil asks interactively.
+	Enabled              *bool  `json:"enabled"`
+	Namespace            string `json:"namespace"`
+	ClusterName          string `json:"clusterName"`
+	MountBasePath        string `json:"mountBasePath"`
+	ClusterNFSServerPath string `json:"clusterNfsServerPath"`
+	// KubeContext selects a kubeconfig context; empty uses the current one.
+	KubeContext string `json:"kubeContext"`
+	// Auth is how to log in to the cluster: kubeconfig, token, password or
+	// lab-nfs. Empty picks one from the settings given, see AuthMethod.
+	Auth string `json:"auth"`
+	// APIURL is the API server for token and password authentication.
+	APIURL string `json:"apiUrl"`
+	// Token, or the file holding it, e.g. of a service account.
+	Token     string `json:"token"`
+	TokenFile string `json:"tokenFile"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	// CAFile verifies the API server; empty uses the system roots.
+	CAFile string `json:"caFile"`
+	// InsecureSkipTLSVerify does not verify the API server at all.
+	InsecureSkipTLSVerify bool `json:"insecureSkipTlsVerify"`
+	// ForkliftNamespace is where Forklift runs; empty means openshift-mtv.
+	ForkliftNamespace string `json:"forkliftNamespace"`
+	// InventoryURL overrides the address of the Forklift inventory route.
+	InventoryURL string `json:"inventoryUrl"`
+	// ReadyTimeout bounds the wait for the provider and each plan to become
+	// ready, e.g. "10m"; empty means 10 minutes.
+	ReadyTimeout string `json:"readyTimeout"`
+	// InventoryTimeout bounds the wait for the Forklift inventory to list
+	// a VM, its networks and its disks, e.g. "10m"; empty means 10 minutes.
+	InventoryTimeout string `json:"inventoryTimeout"`
+	// StallTimeout gives up on a migration that made no progress for that
+	// long, e.g. "30m"; empty means 30 minutes.
+	StallTimeout string `json:"stallTimeout"`
+	// RunID names and labels the cluster objects of the migration; empty
+	// reuses the one of the output directory or starts a new one.
+	RunID string `json:"runId"`
+	// Waves groups the VMs into migrations of their own, run in order
+	// unless ParallelWaves is set.
+	Waves         []WaveConfig `json:"waves"`
+	ParallelWaves bool         `json:"parallelWaves"`
+	// Networks map the Hyper-V networks to networks in the cluster; the
+	// first matching rule wins and unmatched networks use the pod network.
+	Networks []NetworkRule `json:"networks"`
+	// Storage maps the disks to StorageClasses; the first matching rule
+	// wins and unmatched disks use the cluster's default StorageClass.
+	Storage []StorageRule `json:"storage"`
+}
+
+// WaveConfig is a named group of VMs migrated by one Forklift plan. A VM
+// belongs to the first wave it matches.
+type WaveConfig struct {
+	Name string `json:"name"`
+	// VMs are VM names or globs.
+	VMs []string `json:"vms"`
+	// Tag adds the VMs tagged with it in their Hyper-V notes.
+	Tag string `json:"tag"`
+}
+
+// NetworkRule maps the VM networks on the adapters it matches to a network
+// in the cluster. Empty criteria match any adapter.
+type NetworkRule struct {
+	// Switch and Adapter are globs on the virtual switch and adapter name.
+	Switch  string `json:"switch"`
+	Adapter string `json:"adapter"`
+	// VLAN is the access VLAN; 0 matches untagged adapters.
+	VLAN *int `json:"vlan"`
+	// Target is pod, multus or ignored.
+	Target string `json:"target"`
+	// NAD is the Multus network attachment definition, "namespace/name" or
+	// a name in the migration namespace.
+	NAD string `json:"nad"`
+}
+
+// StorageRule maps the disks it matches to a StorageClass and volume
+// settings. Empty criteria match any disk.
+type StorageRule struct {
+	// VM, Path and Controller are globs on the VM name, the disk path on
+	// the Hyper-V host and the drive position such as "SCSI 0:1".
+	VM         string `json:"vm"`
+	Path       string `json:"path"`
+	Controller string `json:"controller"`
+	// MinSize and MaxSize bound the virtual disk size, e.g. "100Gi".
+	MinSize string `json:"minSize"`
+	MaxSize string `json:"maxSize"`
+	// StorageClass is empty for the cluster's default StorageClass.
+	StorageClass string `json:"storageClass"`
+	// VolumeMode is Filesystem or Block; AccessMode is ReadWriteOnce,
+	// ReadWriteMany, ReadOnlyMany or ReadWriteOncePod. Empty leaves the
+	// choice to Forklift.
+	VolumeMode string `json:"volumeMode"`
+	AccessMode string `json:"accessMode"`
+}
+
+// ParseSize parses a disk size such as "100Gi" or "500G" into bytes; an
+// empty size is 0.
+func ParseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 100Gi)", size)
+	}
+	return q.Value(), nil
+}
+
+var waveNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,40}[a-z0-9])?$`)
+
+// ValidWaveName reports whether name can be part of the Forklift resource
+// names of a wave.
+func ValidWaveName(name string) bool {
+	return waveNamePattern.MatchString(name)
+}
+
+// ConcurrencyConfig limits parallel work; zero means the built-in default.
+type ConcurrencyConfig struct {
+	VMs         int `json:"vms"`
+	WinRM       int `json:"winrm"`
+	Transfers   int `json:"transfers"`
+	Conversions int `json:"conversions"`
+}
+
+type LoggingConfig struct {
+	// Level is debug, info, warn or error.
+	Level string `json:"level"`
+	// Format is text or json.
+	Format string `json:"format"`
+}
+
+type MetricsConfig struct {
+	// Listen is the address of the metrics and health endpoint, e.g.
+	// ":9090". Empty disables it.
+	Listen string `json:"listen"`
+}
+
+// Port accepts a port as a YAML number or string.
+type Port string
+
+func (p *Port) UnmarshalJSON(data []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err == nil {
+		*p = Port(n.String())
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("port must be a number or string: %w", err)
+	}
+	*p = Port(s)
+	return nil
+}
+
+// binding ties a string setting to the environment variable that has
+// always configured it.
+type binding struct {
+	env   string
+	value *string
+}
+
+func (c *Config) bindings() []binding {
+	return []binding{
+		{"HYPERV_HOST", &c.Connection.Host},
+		{"HYPERV_USER", &c.Connection.User},
+		{"HYPERV_PASS", &c.Connection.Password},
+		{"HYPERV_PORT", (*string)(&c.Connection.WinRMPort)},
+		{"SSH_PORT", (*string)(&c.Connection.SSHPort)},
+		{"OUTPUT_DIR", &c.Output.Dir},
+		{"PREFLIGHT_MODE", &c.Output.Preflight},
+		{"DESTINATION", &c.Destination.Type},
+		{"OVA_PROVIDER_NFS_SERVER_PATH", &c.Destination.NFS.Path},
+		{"NFS_SUDO_PASSWORD", &c.Destination.NFS.SudoPassword},
+		{"S3_ENDPOINT", &c.Destination.S3.Endpoint},
+		{"S3_BUCKET", &c.Destination.S3.Bucket},
+		{"S3_ACCESS_KEY_ID", &c.Destination.S3.AccessKeyID},
+		{"S3_SECRET_ACCESS_KEY", &c.Destination.S3.SecretAccessKey},
+		{"S3_REGION", &c.Destination.S3.Region},
+		{"S3_PREFIX", &c.Destination.S3.Prefix},
+		{"NAMESPACE", &c.Migration.Namespace},
+		{"CLUSTER_NAME", &c.Migration.ClusterName},
+		{"MOUNT_BASH_PATH", &c.Migration.MountBasePath},
+		{"CLUSTER_NFS_SERVER_PATH", &c.Migration.ClusterNFSServerPath},
+		{"KUBE_CONTEXT", &c.Migration.KubeContext},
+		{"CLUSTER_AUTH", &c.Migration.Auth},
+		{"CLUSTER_API_URL", &c.Migration.APIURL},
+		{"CLUSTER_TOKEN", &c.Migration.Token},
+		{"CLUSTER_TOKEN_FILE", &c.Migration.TokenFile},
+		{"CLUSTER_USERNAME", &c.Migration.Username},
+		{"CLUSTER_PASSWORD", &c.Migration.Password},
+		{"CLUSTER_CA_FILE", &c.Migration.CAFile},
+		{"FORKLIFT_NAMESPACE", &c.Migration.ForkliftNamespace},
+		{"FORKLIFT_INVENTORY_URL", &c.Migration.InventoryURL},
+		{"MIGRATION_RUN_ID", &c.Migration.RunID},
+		{"READY_TIMEOUT", &c.Migration.ReadyTimeout},
+		{"INVENTORY_TIMEOUT", &c.Migration.InventoryTimeout},
+		{"MIGRATION_STALL_TIMEOUT", &c.Migration.StallTimeout},
+		{"LOG_LEVEL", &c.Logging.Level},
+		{"LOG_FORMAT", &c.Logging.Format},
+		{"METRICS_ADDR", &c.Metrics.Listen},
+	}
+}
+
+// Load reads the YAML config at path. An empty path yields an empty config.
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ApplyEnv overrides the config with every environment variable that is set.
+func (c *Config) ApplyEnv() error {
+	for _, b := range c.bindings() {
+		if v, ok := os.LookupEnv(b.env); ok && v != "" {
+			*b.value = v
+		}
+	}
+
+	bools := []struct {
+		env   string
+		value *bool
+	}{
+		{"ASSUME_YES", &c.AssumeYes},
+		{"S3_INSECURE_SKIP_VERIFY", &c.Destination.S3.InsecureSkipVerify},
+		{"PARALLEL_WAVES", &c.Migration.ParallelWaves},
+		{"CLUSTER_INSECURE_SKIP_TLS_VERIFY", &c.Migration.InsecureSkipTLSVerify},
+	}
+	for _, b := range bools {
+		if v := os.Getenv(b.env); v != "" {
+			parsed, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", b.env, err)
+			}
+			*b.value = parsed
+		}
+	}
+
+	ints := []struct {
+		env   string
+		value *int
+	}{
+		{"PARALLEL_VMS", &c.Concurrency.VMs},
+		{"WINRM_LIMIT", &c.Concurrency.WinRM},
+		{"TRANSFER_LIMIT", &c.Concurrency.Transfers},
+		{"CONVERSION_LIMIT", &c.Concurrency.Conversions},
+	}
+	for _, i := range ints {
+		if v := os.Getenv(i.env); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", i.env, err)
+			}
+			*i.value = parsed
+		}
+	}
+
+	if v := os.Getenv("MIGRATE"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid MIGRATE: %w", err)
+		}
+		c.Migration.Enabled = &enabled
+	}
+	return nil
+}
+
+// Export publishes the final settings to the environment variables the
+// connection, upload and cluster code read.
+func (c *Config) Export() {
+	for _, b := range c.bindings() {
+		if *b.value != "" {
+			os.Setenv(b.env, *b.value)
+		}
+	}
+	if c.Destination.S3.InsecureSkipVerify {
+		os.Setenv("S3_INSECURE_SKIP_VERIFY", "true")
+	}
+	if c.Migration.InsecureSkipTLSVerify {
+		os.Setenv("CLUSTER_INSECURE_SKIP_TLS_VERIFY", "true")
+	}
+}
+
+// Validate checks the values that have a fixed set of choices.
+func (c *Config) Validate() error {
+	switch strings.ToLower(c.Destination.Type) {
+	case "", "nfs", "s3", "none":
+	default:
+		return fmt.Errorf("invalid destination type %q (expected nfs, s3 or none)", c.Destination.Type)
+	}
+	switch strings.ToLower(c.Output.Preflight) {
+	case "", "strict", "warn", "off":
+	default:
+		return fmt.Errorf("invalid preflight mode %q (expected strict, warn or off)", c.Output.Preflight)
+	}
+	if _, err := logging.ParseLevel(c.Logging.Level); err != nil {
+		return err
+	}
+	if !logging.ValidFormat(c.Logging.Format) {
+		return fmt.Errorf("invalid log format %q (expected text or json)", c.Logging.Format)
+	}
+	switch c.Migration.Auth {
+	case "", "kubeconfig", "token", "password", "lab-nfs":
+	default:
+		return fmt.Errorf("invalid cluster auth %q (expected kubeconfig, token, password or lab-nfs)", c.Migration.Auth)
+	}
+	if c.Migration.CAFile != "" && c.Migration.InsecureSkipTLSVerify {
+		return fmt.Errorf("cluster CA file and insecureSkipTlsVerify exclude each other")
+	}
+	for _, timeout := range []struct{ name, value string }{
+		{"ready timeout", c.Migration.ReadyTimeout},
+		{"inventory timeout", c.Migration.InventoryTimeout},
+		{"stall timeout", c.Migration.StallTimeout},
+	} {
+		if timeout.value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(timeout.value); err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q (expected a duration such as 10m)", timeout.name, timeout.value)
+		}
+	}
+	for i, rule := range c.Migration.Networks {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("network rule %d: %w", i+1, err)
+		}
+	}
+	for i, rule := range c.Migration.Storage {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("storage rule %d: %w", i+1, err)
+		}
+	}
+	waves := make(map[string]bool)
+	for _, w := range c.Migration.Waves {
+		if !ValidWaveName(w.Name) {
+			return fmt.Errorf("invalid wave name %q (expected lowercase letters, digits and dashes)", w.Name)
+		}
+		if waves[w.Name] {
+			return fmt.Errorf("wave %q is defined twice", w.Name)
+		}
+		waves[w.Name] = true
+		if len(w.VMs) == 0 && w.Tag == "" {
+			return fmt.Errorf("wave %q selects no VMs (expected vms or tag)", w.Name)
+		}
+	}
+	return nil
+}
+
+// validate checks the target of the rule and that its globs parse.
+func (r NetworkRule) validate() error {
+	for _, glob := range []string{r.Switch, r.Adapter} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", glob, err)
+		}
+	}
+	switch r.Target {
+	case "pod", "ignored":
+		if r.NAD != "" {
+			return fmt.Errorf("nad is only used with target multus")
+		}
+	case "multus":
+		if r.NAD == "" || strings.Count(r.NAD, "/") > 1 || strings.HasPrefix(r.NAD, "/") || strings.HasSuffix(r.NAD, "/") {
+			return fmt.Errorf("invalid nad %q (expected namespace/name or name)", r.NAD)
+		}
+	default:
+		return fmt.Errorf("invalid target %q (expected pod, multus or ignored)", r.Target)
+	}
+	return nil
+}
+
+// validate checks the globs, sizes and volume settings of the rule.
+func (r StorageRule) validate() error {
+	for _, glob := range []string{r.VM, r.Path, r.Controller} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", glob, err)
+		}
+	}
+	minSize, err := ParseSize(r.MinSize)
+	if err != nil {
+		return err
+	}
+	maxSize, err := ParseSize(r.MaxSize)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && minSize > maxSize {
+		return fmt.Errorf("minSize %s is larger than maxSize %s", r.MinSize, r.MaxSize)
+	}
+	switch r.VolumeMode {
+	case "", "Filesystem", "Block":
+	default:
+		return fmt.Errorf("invalid volumeMode %q (expected Filesystem or Block)", r.VolumeMode)
+	}
+	switch r.AccessMode {
+	case "", "ReadWriteOnce", "ReadWriteMany", "ReadOnlyMany", "ReadWriteOncePod":
+	default:
+		return fmt.Errorf("invalid accessMode %q (expected ReadWriteOnce, ReadWriteMany, ReadOnlyMany or ReadWriteOncePod)", r.AccessMode)
+	}
+	return nil
+}
+
+// MissingSecrets lists the secrets a full run will need but that are not
+// configured, so a non-interactive run fails before touching any VM instead
+// of blocking on a prompt later. needsSudo reports whether the NFS copy
+// has to go through sudo.
+func (c *Config) MissingSecrets(needsSudo bool) []string {
+	var missing []string
+	if c.Connection.Password == "" {
+		missing = append(missing, "Hyper-V password (connection.password or HYPERV_PASS)")
+	}
+	switch strings.ToLower(c.Destination.Type) {
+	case "nfs":
+		if needsSudo && c.Destination.NFS.SudoPassword == "" {
+			missing = append(missing, "sudo password for the NFS copy (destination.nfs.sudoPassword or NFS_SUDO_PASSWORD)")
+		}
+	case "s3":
+		if c.Destination.S3.SecretAccessKey == "" {
+			missing = append(missing, "object storage secret key (destination.s3.secretAccessKey or S3_SECRET_ACCESS_KEY)")
+		}
+	}
+	// Only a method chosen explicitly is sure to be used by this run
+	switch c.Migration.Auth {
+	case "token":
+		if c.Migration.Token == "" && c.Migration.TokenFile == "" {
+			missing = append(missing, "cluster token (migration.token, CLUSTER_TOKEN or CLUSTER_TOKEN_FILE)")
+		}
+	case "password":
+		if c.Migration.Password == "" {
+			missing = append(missing, "cluster password (migration.password or CLUSTER_PASSWORD)")
+		}
+	}
+	return missing
+}
+
+// AuthMethod returns how to log in to the cluster: the configured method,
+// else token or password when one is given, lab-nfs for a lab cluster
+// name, and the kubeconfig otherwise. Credentials win over the cluster
+// name, which a config may carry for the lab login alone.
+func (m MigrationConfig) AuthMethod() string {
+	switch {
+	case m.Auth != "":
+		return m.Auth
+	case m.Token != "" || m.TokenFile != "":
+		return "token"
+	case m.Username != "":
+		return "password"
+	case m.ClusterName != "":
+		return "lab-nfs"
+	}
+	return "kubeconfig"
+}
@@ -0,0 +1,225 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Attribute keys shared by every package, so the records of one VM can be
+// filtered out of a multi-VM run.
+const (
+	KeyVM    = "vm"
+	KeyStage = "stage"
+	KeyDisk  = "disk"
+)
+
+// DirName is the directory below the output directory the per-VM log files
+// are written to.
+const DirName = "logs"
+
+// Options configures Setup.
+type Options struct {
+	// Level is debug, info, warn or error; empty means info.
+	Level string
+	// Format is text or json; empty means text.
+	Format string
+	// Dir receives a <vm>.log file for every VM that is logged about.
+	// Empty disables the per-VM files.
+	Dir string
+}
+
+// ParseLevel parses a level name.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", s)
+	}
+	return level, nil
+}
+
+// ValidFormat reports whether format is a supported output format.
+func ValidFormat(format string) bool {
+	switch strings.ToLower(format) {
+	case "", "text", "json":
+		return true
+	}
+	return false
+}
+
+// Setup installs the default logger writing to w, and to the per-VM files
+// when opts.Dir is set. The returned function closes the per-VM files.
+func Setup(opts Options, w io.Writer) (func() error, error) {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	if !ValidFormat(opts.Format) {
+		return nil, fmt.Errorf("invalid log format %q (expected text or json)", opts.Format)
+	}
+
+	files := &vmFiles{dir: opts.Dir, level: level, format: opts.Format, open: make(map[string]*vmFile)}
+	slog.SetDefault(slog.New(&vmHandler{Handler: newHandler(w, level, opts.Format), files: files}))
+	return files.Close, nil
+}
+
+// VM returns the default logger with the VM attribute set.
+func VM(name string) *slog.Logger {
+	return slog.Default().With(KeyVM, name)
+}
+
+type ctxKey struct{}
+
+// WithLogger returns a copy of ctx carrying logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
+
+func newHandler(w io.Writer, level slog.Level, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if strings.ToLower(format) == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// vmHandler writes every record to the console handler and, when it carries
+// a VM attribute, also to that VM's log file.
+type vmHandler struct {
+	slog.Handler
+	files *vmFiles
+	// vm is set once a VM attribute was added with WithAttrs; ops replays
+	// the attributes and groups on the file handler.
+	vm  string
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *vmHandler) Handle(ctx context.Context, r slog.Record) error {
+	err := h.Handler.Handle(ctx, r)
+
+	vm := h.vm
+	if vm == "" {
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == KeyVM {
+				vm = a.Value.String()
+				return false
+			}
+			return true
+		})
+	}
+	if vm == "" {
+		return err
+	}
+
+	fh := h.files.handler(vm)
+	if fh == nil {
+		return err
+	}
+	for _, op := range h.ops {
+		fh = op(fh)
+	}
+	if ferr := fh.Handle(ctx, r.Clone()); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func (h *vmHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := h.with(h.Handler.WithAttrs(attrs), func(fh slog.Handler) slog.Handler { return fh.WithAttrs(attrs) })
+	for _, a := range attrs {
+		if a.Key == KeyVM {
+			next.vm = a.Value.String()
+		}
+	}
+	return next
+}
+
+func (h *vmHandler) WithGroup(name string) slog.Handler {
+	return h.with(h.Handler.WithGroup(name), func(fh slog.Handler) slog.Handler { return fh.WithGroup(name) })
+}
+
+func (h *vmHandler) with(inner slog.Handler, op func(slog.Handler) slog.Handler) *vmHandler {
+	return &vmHandler{
+		Handler: inner,
+		files:   h.files,
+		vm:      h.vm,
+		ops:     append(append([]func(slog.Handler) slog.Handler(nil), h.ops...), op),
+	}
+}
+
+type vmFile struct {
+	f       *os.File
+	handler slog.Handler
+}
+
+// vmFiles opens the per-VM log files on first use.
+type vmFiles struct {
+	dir    string
+	level  slog.Level
+	format string
+
+	mu     sync.Mutex
+	open   map[string]*vmFile
+	failed bool
+}
+
+// handler returns the handler of vm's log file, or nil when there is none.
+func (v *vmFiles) handler(vm string) slog.Handler {
+	if v.dir == "" {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if file, ok := v.open[vm]; ok {
+		return file.handler
+	}
+	if v.failed {
+		return nil
+	}
+
+	if err := os.MkdirAll(v.dir, 0755); err != nil {
+		v.failed = true
+		fmt.Fprintf(os.Stderr, "failed to create log directory %s: %v\n", v.dir, err)
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(v.dir, filepath.Base(vm)+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open log file of %s: %v\n", vm, err)
+		return nil
+	}
+	file := &vmFile{f: f, handler: newHandler(f, v.level, v.format)}
+	v.open[vm] = file
+	return file.handler
+}
+
+// Close closes every per-VM log file.
+func (v *vmFiles) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var firstErr error
+	for vm, file := range v.open {
+		if err := file.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(v.open, vm)
+	}
+	return firstErr
+}
@@ -0,0 +1,252 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The metrics every package reports to. They are always collected; they
+// are only visible when Serve is running.
+var (
+	TransferredBytes = NewCounter("hyperv_transferred_bytes_total",
+		"Bytes transferred, by kind of transfer (download, copy, upload).", "kind")
+	WinRMErrors = NewCounter("hyperv_winrm_errors_total",
+		"WinRM commands that failed or exited non-zero.")
+	PackageSeconds = NewHistogram("hyperv_package_duration_seconds",
+		"Time spent packaging a VM, i.e. writing its OVF descriptor.",
+		[]float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600})
+	ConversionSeconds = NewHistogram("hyperv_forklift_conversion_duration_seconds",
+		"Time Forklift spent converting the disks of a VM, from its ImageConversion pipeline step.",
+		[]float64{30, 60, 300, 900, 1800, 3600, 7200, 14400, 28800})
+	MigrationPhase = NewGauge("hyperv_forklift_vm_phase",
+		"Forklift migration phase per VM; the current phase is 1.", "vm", "phase")
+	MigrationStepProgress = NewGauge("hyperv_forklift_step_progress_ratio",
+		"Progress of each Forklift pipeline step per VM, from 0 to 1.", "vm", "step")
+)
+
+// metric is anything that can write itself in the text exposition format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// WriteText writes every metric in the Prometheus text format.
+func WriteText(w io.Writer) {
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// series holds the values of a metric by label values.
+type series struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	keys   map[string][]string
+}
+
+func newSeries(kind, name, help string, labels []string) *series {
+	return &series{name: name, help: help, kind: kind, labels: labels,
+		values: make(map[string]float64), keys: make(map[string][]string)}
+}
+
+func (s *series) update(labelValues []string, fn func(float64) float64) {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", s.name, len(s.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key]; !ok {
+		s.keys[key] = append([]string(nil), labelValues...)
+	}
+	s.values[key] = fn(s.values[key])
+}
+
+func (s *series) write(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.kind)
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", s.name, labelString(s.labels, s.keys[key]), formatValue(s.values[key]))
+	}
+}
+
+// Counter only goes up.
+type Counter struct{ *series }
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newSeries("counter", name, help, labels)}
+	register(c)
+	return c
+}
+
+// Add adds v, which must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	c.update(labelValues, func(old float64) float64 { return old + v })
+}
+
+// Value returns the current count of the series.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+// Inc adds one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is set to the current value.
+type Gauge struct{ *series }
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newSeries("gauge", name, help, labels)}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.update(labelValues, func(float64) float64 { return v })
+}
+
+// SetOnly sets the given series to v and every other series with the same
+// leading label values to zero, e.g. the current phase of one VM.
+func (g *Gauge) SetOnly(v float64, labelValues ...string) {
+	prefix := strings.Join(labelValues[:len(labelValues)-1], "\xff") + "\xff"
+	g.mu.Lock()
+	for key := range g.values {
+		if strings.HasPrefix(key, prefix) {
+			g.values[key] = 0
+		}
+	}
+	g.mu.Unlock()
+	g.Set(v, labelValues...)
+}
+
+// GaugeFunc reports values computed at scrape time, keyed by its single
+// label value.
+type GaugeFunc struct {
+	name, help, label string
+	fn                func() map[string]float64
+}
+
+func NewGaugeFunc(name, help, label string, fn func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, label: label, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	values := g.fn()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labelString([]string{g.label}, []string{key}), formatValue(values[key]))
+	}
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of observations and their sum.
+func (h *Histogram) Count() (uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count, h.sum
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatValue(h.sum), h.name, h.count)
+}
+
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func init() {
+	// Report zero instead of nothing before the first error
+	WinRMErrors.Add(0)
+}
@@ -1,28 +1,21 @@
 package nfs
 
 import (
+	"errors"
 	"fmt"
+	"hyperv/logging"
+	"hyperv/progress"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"syscall"
-	"time"
 
-	"golang.org/x/sys/unix"
 	"golang.org/x/term"
 )
 
-type ProgressReader struct {
-	Reader     io.Reader
-	Total      int64
-	ReadSoFar  int64
-	lastUpdate time.Time
-}
-
 func PromptPassword() (string, error) {
 	fmt.Print("Enter sudo password: ")
 	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
@@ -33,64 +26,6 @@ func PromptPassword() (string, error) {
 	return string(bytePassword), nil
 }
 
-func (pr *ProgressReader) printProgress() {
-	percent := float64(pr.ReadSoFar) / float64(pr.Total) * 100
-	fmt.Printf("\rCopying... %.2f%% (%d / %d bytes)", percent, pr.ReadSoFar, pr.Total)
-}
-
-func (pr *ProgressReader) Read(p []byte) (int, error) {
-	n, err := pr.Reader.Read(p)
-	pr.ReadSoFar += int64(n)
-
-	if time.Since(pr.lastUpdate) > 100*time.Millisecond {
-		pr.printProgress()
-		pr.lastUpdate = time.Now()
-	}
-	return n, err
-}
-
-func printProgress(done, total int64) {
-	percent := float64(done) / float64(total) * 100
-	fmt.Printf("\rCopying... %d/%d bytes (%.2f%%)", done, total, percent)
-}
-
-func copyFileEfficient(srcFile, dstFile *os.File) error {
-	srcFd := int(srcFile.Fd())
-	dstFd := int(dstFile.Fd())
-
-	info, err := srcFile.Stat()
-	if err != nil {
-		return err
-	}
-	size := info.Size()
-
-	var offset int64 = 0
-	const chunkSize = 32 * 1024 * 1024 // 32MB
-
-	start := time.Now()
-	for offset < size {
-		remain := size - offset
-		chunk := int(remain)
-		if chunk > chunkSize {
-			chunk = chunkSize
-		}
-
-		n, err := unix.Sendfile(dstFd, srcFd, &offset, chunk)
-		if err != nil {
-			return err
-		}
-		if n == 0 {
-			break
-		}
-
-		offset += int64(n)
-		printProgress(offset, size)
-	}
-	fmt.Print("\r") // clear progress line
-	fmt.Printf("Copied using sendfile in %v\n", time.Since(start))
-	return nil
-}
-
 func CreateInOutput(fullPath string) (*os.File, error) {
 	// Ensure the parent directory exists
 	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
@@ -112,101 +47,155 @@ func CopyFile(srcPath, dstPath string) error {
 	}
 	defer dstFile.Close()
 
-	// Try sendfile on Linux
-	if runtime.GOOS == "linux" {
-		err := copyFileEfficient(srcFile, dstFile)
-		if err == nil {
-			fmt.Printf("Copied %s to %s using sendfile\n", srcPath, dstPath)
-			return nil
-		}
-		fmt.Printf("sendfile failed, falling back to io.Copy: %v\n", err)
-	}
-
-	// Fall back to io.Copy with progress
 	srcInfo, err := srcFile.Stat()
 	if err != nil {
 		return fmt.Errorf("failed to stat source file: %w", err)
 	}
-	totalSize := srcInfo.Size()
+	// The source directory is named after the VM
+	task := progress.Start(progress.Copy, filepath.Join(filepath.Base(filepath.Dir(srcPath)), filepath.Base(srcPath)), srcInfo.Size())
+	defer task.Done()
 
-	progressReader := &ProgressReader{
-		Reader: srcFile,
-		Total:  totalSize,
+	// Try the sparse-aware kernel copy, which only Linux has
+	method, err := copyFileSparse(srcFile, dstFile, task)
+	if err == nil {
+		if err := dstFile.Sync(); err != nil {
+			return fmt.Errorf("failed to sync destination file: %w", err)
+		}
+		slog.Info("Copied file", logging.KeyDisk, srcPath, "destination", dstPath, "method", method)
+		return nil
+	}
+	if !errors.Is(err, errors.ErrUnsupported) {
+		slog.Warn("Sparse copy failed, falling back to io.Copy", logging.KeyDisk, srcPath, "error", err)
+		if _, err := srcFile.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind source file: %w", err)
+		}
+		if err := dstFile.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate destination file: %w", err)
+		}
+		if _, err := dstFile.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind destination file: %w", err)
+		}
+		task.Set(0)
 	}
 
-	_, err = io.Copy(dstFile, progressReader)
-	fmt.Println() // newline after final progress
-	if err != nil {
+	// Fall back to io.Copy with progress
+	if _, err := io.Copy(dstFile, task.Reader(srcFile)); err != nil {
 		return fmt.Errorf("failed to copy file: %w", err)
 	}
+	if err := dstFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync destination file: %w", err)
+	}
 
-	fmt.Printf("Copied %s to %s\n", srcPath, dstPath)
+	slog.Info("Copied file", logging.KeyDisk, srcPath, "destination", dstPath)
 	return nil
 }
 
-func CopyFilesNfsServer(srcDir, dstDir string) error {
-	return filepath.WalkDir(srcDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			// skip inaccessible files/directories
-			return nil
-		}
-		if d.IsDir() {
-			return nil
-		}
+// CopyFilesNfsServer mirrors the .vhdx and .ovf files under srcDir into dstDir
+// using a per-VM directory layout. Files whose destination already has the
+// same size and SHA256 are skipped; everything else is copied to a temporary
+// file, verified and atomically renamed into place. When vms is not empty
+// only the directories of those VMs are copied.
+func CopyFilesNfsServer(srcDir, dstDir string, vms []string) error {
+	entries, err := PlanSync(srcDir, vms)
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %w", srcDir, err)
+	}
 
-		ext := strings.ToLower(filepath.Ext(d.Name()))
-		if ext != ".vhdx" && ext != ".ovf" {
-			return nil
+	var copied, skipped int
+	for _, entry := range entries {
+		dstPath := filepath.Join(dstDir, entry.Rel)
+		if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", filepath.Dir(dstPath), err)
 		}
 
-		dstPath := filepath.Join(dstDir, d.Name())
-		if err := CopyFile(path, dstPath); err != nil {
+		logger := slog.With(logging.KeyVM, vmOf(entry.Rel), logging.KeyStage, "upload", logging.KeyDisk, entry.Src)
+		didCopy, err := syncFile(entry.Src, dstPath)
+		if err != nil {
+			logger.Error("NFS copy failed", "error", err)
 			return err
 		}
+		if !didCopy {
+			logger.Info("Skipped, destination is up to date", "destination", dstPath)
+			skipped++
+			continue
+		}
 
-		log.Printf("Copied %s to %s", path, dstPath)
-		return nil
-	})
+		logger.Info("Copied and verified", "destination", dstPath)
+		copied++
+	}
+
+	slog.Info("NFS sync complete", "copied", copied, "upToDate", skipped)
+	return nil
+}
+
+// vmOf returns the VM a path relative to the output directory belongs to.
+func vmOf(rel string) string {
+	first, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	return first
 }
 
-// runCopyWithSudo runs the current program itself with sudo and a special flag
-func RunCopyWithSudo(srcDir, dstDir, sudoPassword string) error {
+// runCopyWithSudo runs the current program itself with sudo and a special
+// flag. The VM names follow the source and destination directories.
+func RunCopyWithSudo(srcDir, dstDir, sudoPassword string, vms []string) error {
 	self, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("failed to get executable path: %w", err)
 	}
 
-	fmt.Printf("Executing: sudo -S  %s --copy-files %s %s\n", self, srcDir, dstDir)
+	slog.Debug("Running the NFS copy under sudo", "command", self, "source", srcDir, "destination", dstDir)
 
-	cmd := exec.Command("sudo", "-S", self, "--copy-files", srcDir, dstDir)
-	cmd.Stdout = os.Stdout
+	cmd := exec.Command("sudo", append([]string{"-S", self, "--copy-files", srcDir, dstDir}, vms...)...)
 	cmd.Stderr = os.Stderr
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return fmt.Errorf("failed to get stdin pipe: %w", err)
 	}
+	// The helper reports the bytes it copied on stdout; they are counted
+	// here, where the metrics are served
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
 
 	go func() {
 		defer stdin.Close()
 		io.WriteString(stdin, sudoPassword+"\n")
 	}()
 
-	return cmd.Run()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	(&progressReader{out: os.Stdout}).consume(stdout)
+	return cmd.Wait()
 }
 
-func CopyToNFSServer(srcPath string) error {
+// CopyToNFSServer copies the directories of vms under srcPath to
+// OVA_PROVIDER_NFS_SERVER_PATH, through sudo unless already root.
+func CopyToNFSServer(srcPath string, vms []string) error {
 	nfsServerPath := os.Getenv("OVA_PROVIDER_NFS_SERVER_PATH")
 	if nfsServerPath == "" {
 		return fmt.Errorf("NFS server path is required")
 	}
 
-	password, err := PromptPassword()
-	if err != nil {
-		return fmt.Errorf("password prompt failed: %w", err)
+	// Already privileged, e.g. in a container: no sudo round trip needed
+	if os.Geteuid() == 0 {
+		return CopyFilesNfsServer(srcPath, nfsServerPath, vms)
+	}
+
+	password := os.Getenv("NFS_SUDO_PASSWORD")
+	if password == "" {
+		if !term.IsTerminal(int(syscall.Stdin)) {
+			return fmt.Errorf("sudo password required for the NFS copy: set NFS_SUDO_PASSWORD or destination.nfs.sudoPassword")
+		}
+		var err error
+		password, err = PromptPassword()
+		if err != nil {
+			return fmt.Errorf("password prompt failed: %w", err)
+		}
 	}
 
-	if err := RunCopyWithSudo(srcPath, nfsServerPath, password); err != nil {
+	if err := RunCopyWithSudo(srcPath, nfsServerPath, password, vms); err != nil {
 		return fmt.Errorf("failed to copy files with sudo: %w", err)
 	}
 
@@ -0,0 +1,250 @@
+package nfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// SyncEntry is a single file to mirror to an export destination. Rel is the
+// destination path relative to the export root.
+type SyncEntry struct {
+	Src string
+	Rel string
+}
+
+// ovfRefs is the subset of an OVF descriptor needed to group disks by VM.
+type ovfRefs struct {
+	Files []struct {
+		Href string `xml:"href,attr"`
+	} `xml:"References>File"`
+	VirtualSystem struct {
+		Name string `xml:"Name"`
+	} `xml:"VirtualSystem"`
+}
+
+func isSyncedFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".vhdx" || ext == ".ovf"
+}
+
+// PlanSync decides where every .vhdx/.ovf under srcDir lands on the export.
+// Files that already live in a subdirectory keep their relative path. Files
+// at the top level are grouped into a per-VM directory: an OVF and the disks
+// it references go to <vm name>/, unreferenced disks go to <disk name>/.
+// When vms is not empty only the files of those VMs are planned.
+func PlanSync(srcDir string, vms []string) ([]SyncEntry, error) {
+	var entries []SyncEntry
+	var topLevel []string
+
+	err := filepath.WalkDir(srcDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			// skip inaccessible files/directories
+			return nil
+		}
+		if d.IsDir() {
+			// dot directories hold local state such as dry-run plans
+			if path != srcDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isSyncedFile(d.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if filepath.Dir(rel) == "." {
+			topLevel = append(topLevel, path)
+			return nil
+		}
+		entries = append(entries, SyncEntry{Src: path, Rel: rel})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vmDirs := make(map[string]string) // top-level file name -> VM directory
+	for _, path := range topLevel {
+		if strings.ToLower(filepath.Ext(path)) != ".ovf" {
+			continue
+		}
+		name := filepath.Base(path)
+		vmDir := strings.TrimSuffix(name, filepath.Ext(name))
+
+		refs, err := readOvfRefs(path)
+		if err != nil {
+			slog.Warn("Could not parse OVF", "path", path, "error", err)
+		} else {
+			if refs.VirtualSystem.Name != "" {
+				vmDir = sanitizeDirName(refs.VirtualSystem.Name)
+			}
+			for _, f := range refs.Files {
+				vmDirs[filepath.Base(f.Href)] = vmDir
+			}
+		}
+		vmDirs[name] = vmDir
+	}
+
+	for _, path := range topLevel {
+		name := filepath.Base(path)
+		vmDir, ok := vmDirs[name]
+		if !ok {
+			vmDir = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		entries = append(entries, SyncEntry{Src: path, Rel: filepath.Join(vmDir, name)})
+	}
+
+	if len(vms) > 0 {
+		selected := make(map[string]bool, len(vms))
+		for _, vm := range vms {
+			selected[vm] = true
+			selected[sanitizeDirName(vm)] = true
+		}
+		entries = slices.DeleteFunc(entries, func(e SyncEntry) bool { return !selected[vmOf(e.Rel)] })
+	}
+	return entries, nil
+}
+
+func readOvfRefs(path string) (*ovfRefs, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var refs ovfRefs
+	if err := xml.Unmarshal(content, &refs); err != nil {
+		return nil, err
+	}
+	return &refs, nil
+}
+
+// sanitizeDirName turns a VM name into a single safe path component.
+func sanitizeDirName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" || name == "." || name == ".." {
+		return "vm"
+	}
+	return name
+}
+
+// FileSHA256 returns the hex encoded SHA256 digest of the file at path.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// syncFile copies srcPath to dstPath unless dstPath already has the same size
+// and SHA256. The data is written to a temporary file next to dstPath,
+// verified, and renamed into place so readers never see a partial file.
+// It reports whether a copy was performed.
+func syncFile(srcPath, dstPath string) (bool, error) {
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat source file: %w", err)
+	}
+
+	srcSum, err := FileSHA256(srcPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to hash %s: %w", srcPath, err)
+	}
+
+	if dstInfo, err := os.Stat(dstPath); err == nil && dstInfo.Mode().IsRegular() && dstInfo.Size() == srcInfo.Size() {
+		dstSum, err := FileSHA256(dstPath)
+		if err == nil && dstSum == srcSum {
+			return false, nil
+		}
+	}
+
+	tmpPath := partialPath(dstPath)
+	partials.add(tmpPath)
+	defer partials.forget(tmpPath)
+	if err := CopyFile(srcPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+
+	tmpSum, err := FileSHA256(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to hash %s: %w", tmpPath, err)
+	}
+	if tmpSum != srcSum {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("checksum mismatch after copying %s: source %s, destination %s", srcPath, srcSum, tmpSum)
+	}
+
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("failed to move %s into place: %w", dstPath, err)
+	}
+
+	return true, nil
+}
+
+// partialPath is the temporary file syncFile writes dstPath to.
+func partialPath(dstPath string) string {
+	return filepath.Join(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+partialSuffix)
+}
+
+const partialSuffix = ".partial"
+
+// partials tracks the temporary files this process is writing, so an
+// interrupt only removes its own and never those of another copy.
+var partials = partialSet{paths: make(map[string]bool)}
+
+type partialSet struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+func (p *partialSet) add(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paths[path] = true
+}
+
+func (p *partialSet) forget(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.paths, path)
+}
+
+// RemovePartials deletes the temporary files of the copies this process
+// has in progress.
+func RemovePartials() {
+	partials.mu.Lock()
+	defer partials.mu.Unlock()
+	for path := range partials.paths {
+		if err := os.Remove(path); err == nil {
+			slog.Info("Removed partial file", "path", path)
+		}
+		delete(partials.paths, path)
+	}
+}
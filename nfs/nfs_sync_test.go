@@ -0,0 +1,160 @@
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeFiles creates every file of files under dir with its content.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func plannedRels(t *testing.T, srcDir string, vms []string) []string {
+	t.Helper()
+	entries, err := PlanSync(srcDir, vms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rels []string
+	for _, e := range entries {
+		rels = append(rels, filepath.ToSlash(e.Rel))
+	}
+	slices.Sort(rels)
+	return rels
+}
+
+func TestPlanSyncSelectedVMs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"web01/web01.ovf":  "ovf",
+		"web01/disk.vhdx":  "disk",
+		"db01/db01.ovf":    "ovf",
+		"db01/disk.vhdx":   "disk",
+		"failed/disk.vhdx": "partial export",
+	})
+
+	tests := []struct {
+		name string
+		vms  []string
+		want []string
+	}{
+		{"all", nil, []string{"db01/db01.ovf", "db01/disk.vhdx", "failed/disk.vhdx", "web01/disk.vhdx", "web01/web01.ovf"}},
+		{"one", []string{"web01"}, []string{"web01/disk.vhdx", "web01/web01.ovf"}},
+		{"unknown", []string{"app01"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := plannedRels(t, dir, tt.vms); !slices.Equal(got, tt.want) {
+				t.Errorf("planned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanSyncSkipsDotDirectories(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"web01/web01.ovf":            "ovf",
+		"web01/disk.vhdx":            "disk",
+		".plan/web01/web01.ovf":      "planned ovf",
+		".migration/wave1/plan.yaml": "yaml",
+		"web01/notes.txt":            "not synced",
+	})
+
+	want := []string{"web01/disk.vhdx", "web01/web01.ovf"}
+	if got := plannedRels(t, dir, nil); !slices.Equal(got, want) {
+		t.Errorf("planned %v, want %v", got, want)
+	}
+}
+
+func TestSyncFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		dst      *string // existing destination content, nil for none
+		wantCopy bool
+	}{
+		{"missing", nil, true},
+		{"up to date", ptr("disk data"), false},
+		{"same size, other data", ptr("disk DATA"), true},
+		{"other size", ptr("old"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src", "disk.vhdx")
+			dst := filepath.Join(dir, "dst", "disk.vhdx")
+			writeFiles(t, dir, map[string]string{"src/disk.vhdx": "disk data"})
+			if tt.dst != nil {
+				writeFiles(t, dir, map[string]string{"dst/disk.vhdx": *tt.dst})
+			}
+
+			copied, err := syncFile(src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if copied != tt.wantCopy {
+				t.Errorf("copied = %v, want %v", copied, tt.wantCopy)
+			}
+			if got, err := os.ReadFile(dst); err != nil || string(got) != "disk data" {
+				t.Errorf("destination has %q (%v), want %q", got, err, "disk data")
+			}
+			if _, err := os.Stat(partialPath(dst)); !os.IsNotExist(err) {
+				t.Errorf("partial file left behind: %v", err)
+			}
+			if len(partials.paths) != 0 {
+				t.Errorf("partial files still tracked: %v", partials.paths)
+			}
+		})
+	}
+}
+
+func TestSyncFileRenameFails(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk.vhdx")
+	writeFiles(t, dir, map[string]string{"disk.vhdx": "disk data", "dst/disk.vhdx/keep": "x"})
+	// A non-empty directory in the way makes the final rename fail
+	dst := filepath.Join(dir, "dst", "disk.vhdx")
+
+	if _, err := syncFile(src, dst); err == nil {
+		t.Fatal("syncFile succeeded, want a rename error")
+	}
+	if _, err := os.Stat(partialPath(dst)); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "keep")); err != nil {
+		t.Errorf("destination was touched: %v", err)
+	}
+}
+
+func TestRemovePartials(t *testing.T) {
+	dir := t.TempDir()
+	ours := partialPath(filepath.Join(dir, "web01", "disk.vhdx"))
+	theirs := partialPath(filepath.Join(dir, "db01", "disk.vhdx"))
+	writeFiles(t, dir, map[string]string{
+		"web01/.disk.vhdx" + partialSuffix: "ours",
+		"db01/.disk.vhdx" + partialSuffix:  "another copy",
+	})
+	partials.add(ours)
+
+	RemovePartials()
+	if _, err := os.Stat(ours); !os.IsNotExist(err) {
+		t.Errorf("own partial file kept: %v", err)
+	}
+	if _, err := os.Stat(theirs); err != nil {
+		t.Errorf("partial file of another copy removed: %v", err)
+	}
+}
+
+func ptr(s string) *string { return &s }
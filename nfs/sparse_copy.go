@@ -0,0 +1,11 @@
+package nfs
+
+// copyMethod records which kernel facility copied the data, for logging.
+type copyMethod string
+
+const (
+	methodClone         copyMethod = "FICLONE"
+	methodCopyFileRange copyMethod = "copy_file_range"
+	methodSendfile      copyMethod = "sendfile"
+	methodReadWrite     copyMethod = "read/write"
+)
@@ -0,0 +1,167 @@
+//go:build linux
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"hyperv/logging"
+	"hyperv/progress"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const copyChunkSize = 32 * 1024 * 1024 // 32MB
+
+// copyFileSparse copies srcFile into dstFile without materializing holes.
+// When both files live on the same filesystem it first tries a reflink
+// (FICLONE), then copy_file_range; otherwise, or if those are unsupported,
+// it uses sendfile and finally plain reads and writes. Only the data
+// segments reported by SEEK_DATA/SEEK_HOLE are copied; the destination is
+// truncated to the source size so the gaps stay sparse.
+func copyFileSparse(srcFile, dstFile *os.File, task *progress.Task) (copyMethod, error) {
+	srcFd := int(srcFile.Fd())
+	dstFd := int(dstFile.Fd())
+
+	var srcStat, dstStat unix.Stat_t
+	if err := unix.Fstat(srcFd, &srcStat); err != nil {
+		return "", fmt.Errorf("fstat source: %w", err)
+	}
+	if err := unix.Fstat(dstFd, &dstStat); err != nil {
+		return "", fmt.Errorf("fstat destination: %w", err)
+	}
+	size := srcStat.Size
+	sameFS := srcStat.Dev == dstStat.Dev
+
+	start := time.Now()
+	if sameFS {
+		if err := unix.IoctlFileClone(dstFd, srcFd); err == nil {
+			task.Set(size)
+			slog.Debug("Cloned file", logging.KeyDisk, srcFile.Name(), "method", methodClone, "elapsed", time.Since(start))
+			return methodClone, nil
+		}
+	}
+
+	if err := dstFile.Truncate(0); err != nil {
+		return "", fmt.Errorf("truncate destination: %w", err)
+	}
+	if err := dstFile.Truncate(size); err != nil {
+		return "", fmt.Errorf("size destination: %w", err)
+	}
+
+	method := methodSendfile
+	if sameFS {
+		method = methodCopyFileRange
+	}
+
+	var offset int64
+	for offset < size {
+		dataStart, holeStart, err := nextDataSegment(srcFd, offset, size)
+		if err != nil {
+			return "", err
+		}
+		if dataStart >= size {
+			break
+		}
+
+		method, err = copyRange(srcFile, dstFile, dataStart, holeStart-dataStart, task, method)
+		if err != nil {
+			return "", err
+		}
+		offset = holeStart
+	}
+
+	task.Set(size)
+	slog.Debug("Copied file", logging.KeyDisk, srcFile.Name(), "method", method, "elapsed", time.Since(start))
+	return method, nil
+}
+
+// nextDataSegment returns the [start, end) range of the next data segment at
+// or after offset. Filesystems without SEEK_DATA support report the rest of
+// the file as a single segment.
+func nextDataSegment(fd int, offset, size int64) (int64, int64, error) {
+	dataStart, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+	if err != nil {
+		if errors.Is(err, unix.ENXIO) {
+			// only a hole remains
+			return size, size, nil
+		}
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+			return offset, size, nil
+		}
+		return 0, 0, fmt.Errorf("seek data: %w", err)
+	}
+
+	holeStart, err := unix.Seek(fd, dataStart, unix.SEEK_HOLE)
+	if err != nil {
+		return 0, 0, fmt.Errorf("seek hole: %w", err)
+	}
+	if holeStart > size {
+		holeStart = size
+	}
+	return dataStart, holeStart, nil
+}
+
+// copyRange copies length bytes at off from src to the same offset in dst,
+// downgrading from copy_file_range to sendfile to read/write when the kernel
+// or filesystem refuses the faster method. It returns the method that was
+// last used so later segments don't retry a known failure.
+func copyRange(srcFile, dstFile *os.File, off, length int64, task *progress.Task, method copyMethod) (copyMethod, error) {
+	srcFd := int(srcFile.Fd())
+	dstFd := int(dstFile.Fd())
+
+	end := off + length
+	for off < end {
+		chunk := end - off
+		if chunk > copyChunkSize {
+			chunk = copyChunkSize
+		}
+
+		var n int
+		var err error
+		switch method {
+		case methodCopyFileRange:
+			roff, woff := off, off
+			n, err = unix.CopyFileRange(srcFd, &roff, dstFd, &woff, int(chunk), 0)
+			if err != nil && isUnsupported(err) {
+				method = methodSendfile
+				continue
+			}
+		case methodSendfile:
+			if _, err = unix.Seek(dstFd, off, io.SeekStart); err != nil {
+				return "", fmt.Errorf("seek destination: %w", err)
+			}
+			roff := off
+			n, err = unix.Sendfile(dstFd, srcFd, &roff, int(chunk))
+			if err != nil && isUnsupported(err) {
+				method = methodReadWrite
+				continue
+			}
+		default:
+			var written int64
+			written, err = io.Copy(io.NewOffsetWriter(dstFile, off), io.NewSectionReader(srcFile, off, chunk))
+			n = int(written)
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", method, err)
+		}
+		if n == 0 {
+			return "", fmt.Errorf("%s: unexpected end of file at offset %d", method, off)
+		}
+
+		off += int64(n)
+		task.Set(off)
+	}
+	return method, nil
+}
+
+func isUnsupported(err error) bool {
+	return errors.Is(err, unix.EXDEV) ||
+		errors.Is(err, unix.ENOSYS) ||
+		errors.Is(err, unix.EOPNOTSUPP) ||
+		errors.Is(err, unix.EINVAL)
+}
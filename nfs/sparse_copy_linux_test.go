@@ -0,0 +1,238 @@
+//go:build linux
+
+package nfs
+
+import (
+	"bytes"
+	"errors"
+	"hyperv/progress"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	sparseSize = 64 << 20
+	blockSize  = 4096
+)
+
+// sparseWrites are the data segments of the test image; everything else is
+// a hole. They are block aligned so the filesystem reports them exactly.
+var sparseWrites = []struct {
+	off  int64
+	size int
+}{
+	{0, 2 * blockSize},
+	{8 << 20, 16 * blockSize},
+	{40<<20 + blockSize, blockSize},
+	{sparseSize - blockSize, blockSize},
+}
+
+// createSparse writes the test image to dir.
+func createSparse(t *testing.T, dir string) *os.File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(dir, "src.vhdx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := f.Truncate(sparseSize); err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range sparseWrites {
+		if _, err := f.WriteAt(bytes.Repeat([]byte{byte('a' + i)}, w.size), w.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if segments := dataSegments(t, f); len(segments) != len(sparseWrites) {
+		t.Skipf("filesystem of %s does not report holes: %v", dir, segments)
+	}
+	return f
+}
+
+// createDest opens an empty destination in dir.
+func createDest(t *testing.T, dir string) *os.File {
+	t.Helper()
+	f, err := os.OpenFile(filepath.Join(dir, "dst.vhdx"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// tmpfsDir returns a directory on tmpfs, a different filesystem than the
+// test's temporary directory on most machines.
+func tmpfsDir(t *testing.T) string {
+	t.Helper()
+	var fs unix.Statfs_t
+	if err := unix.Statfs("/dev/shm", &fs); err != nil || fs.Type != unix.TMPFS_MAGIC {
+		t.Skip("no tmpfs at /dev/shm")
+	}
+	dir, err := os.MkdirTemp("/dev/shm", "sparse-copy-")
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// dataSegments lists the [start, end) data segments of f.
+func dataSegments(t *testing.T, f *os.File) [][2]int64 {
+	t.Helper()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segments [][2]int64
+	for off := int64(0); off < info.Size(); {
+		start, end, err := nextDataSegment(int(f.Fd()), off, info.Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if start >= info.Size() {
+			break
+		}
+		segments = append(segments, [2]int64{start, end})
+		off = end
+	}
+	return segments
+}
+
+// assertSameSparse checks that dst has the content and the holes of src.
+func assertSameSparse(t *testing.T, src, dst *os.File) {
+	t.Helper()
+	want, err := io.ReadAll(io.NewSectionReader(src, 0, sparseSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(io.NewSectionReader(dst, 0, 1<<40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("content differs: %d bytes copied, want %d", len(got), len(want))
+	}
+
+	if err := dst.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if srcSegs, dstSegs := dataSegments(t, src), dataSegments(t, dst); !slices.Equal(srcSegs, dstSegs) {
+		t.Errorf("data segments = %v, want %v", dstSegs, srcSegs)
+	}
+	var srcStat, dstStat unix.Stat_t
+	if err := unix.Fstat(int(src.Fd()), &srcStat); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Fstat(int(dst.Fd()), &dstStat); err != nil {
+		t.Fatal(err)
+	}
+	if dstStat.Blocks > srcStat.Blocks {
+		t.Errorf("destination allocates %d blocks, source %d", dstStat.Blocks, srcStat.Blocks)
+	}
+}
+
+func testTask(t *testing.T) *progress.Task {
+	task := progress.New(io.Discard, false).Start(progress.Copy, t.Name(), sparseSize)
+	t.Cleanup(task.Done)
+	return task
+}
+
+func TestCopyFileSparse(t *testing.T) {
+	tests := []struct {
+		name  string
+		dst   func(t *testing.T) string
+		cross bool
+		// methods the copy may end up with
+		methods []copyMethod
+	}{
+		{"same filesystem", func(t *testing.T) string { return t.TempDir() }, false,
+			[]copyMethod{methodClone, methodCopyFileRange, methodSendfile, methodReadWrite}},
+		{"across filesystems", tmpfsDir, true,
+			[]copyMethod{methodSendfile, methodReadWrite}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := createSparse(t, t.TempDir())
+			dst := createDest(t, tt.dst(t))
+			var srcStat, dstStat unix.Stat_t
+			if err := unix.Fstat(int(src.Fd()), &srcStat); err != nil {
+				t.Fatal(err)
+			}
+			if err := unix.Fstat(int(dst.Fd()), &dstStat); err != nil {
+				t.Fatal(err)
+			}
+			if tt.cross && srcStat.Dev == dstStat.Dev {
+				t.Skip("temporary directory is on tmpfs too")
+			}
+
+			method, err := copyFileSparse(src, dst, testTask(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Contains(tt.methods, method) {
+				t.Errorf("method = %s, want one of %v", method, tt.methods)
+			}
+			assertSameSparse(t, src, dst)
+		})
+	}
+}
+
+// TestCopyRangeFallback starts every segment with a method the files don't
+// allow or with a slower fallback directly, so each path is exercised no
+// matter what the kernel supports.
+func TestCopyRangeFallback(t *testing.T) {
+	tests := []struct {
+		name  string
+		dst   func(t *testing.T) string
+		start copyMethod
+		want  []copyMethod
+	}{
+		// copy_file_range refuses to copy between filesystems of
+		// different types with EXDEV
+		{"copy_file_range across filesystems", tmpfsDir, methodCopyFileRange, []copyMethod{methodSendfile, methodReadWrite}},
+		{"sendfile", func(t *testing.T) string { return t.TempDir() }, methodSendfile, []copyMethod{methodSendfile, methodReadWrite}},
+		{"read/write", func(t *testing.T) string { return t.TempDir() }, methodReadWrite, []copyMethod{methodReadWrite}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := createSparse(t, t.TempDir())
+			dst := createDest(t, tt.dst(t))
+			if err := dst.Truncate(sparseSize); err != nil {
+				t.Fatal(err)
+			}
+
+			task := testTask(t)
+			for _, seg := range dataSegments(t, src) {
+				method, err := copyRange(src, dst, seg[0], seg[1]-seg[0], task, tt.start)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Contains(tt.want, method) {
+					t.Errorf("method = %s, want one of %v", method, tt.want)
+				}
+			}
+			assertSameSparse(t, src, dst)
+		})
+	}
+}
+
+func TestIsUnsupported(t *testing.T) {
+	for _, err := range []error{unix.EXDEV, unix.ENOSYS, unix.EOPNOTSUPP, unix.EINVAL} {
+		if !isUnsupported(err) {
+			t.Errorf("isUnsupported(%v) = false", err)
+		}
+	}
+	for _, err := range []error{unix.EIO, unix.ENOSPC, errors.New("other")} {
+		if isUnsupported(err) {
+			t.Errorf("isUnsupported(%v) = true", err)
+		}
+	}
+}
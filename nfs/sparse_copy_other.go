@@ -0,0 +1,15 @@
+//go:build !linux
+
+package nfs
+
+import (
+	"errors"
+	"hyperv/progress"
+	"os"
+)
+
+// copyFileSparse needs FICLONE, copy_file_range and SEEK_DATA, which only
+// Linux has; CopyFile copies with io.Copy instead.
+func copyFileSparse(srcFile, dstFile *os.File, task *progress.Task) (copyMethod, error) {
+	return "", errors.ErrUnsupported
+}
@@ -0,0 +1,87 @@
+package nfs
+
+import (
+	"bufio"
+	"fmt"
+	"hyperv/metrics"
+	"hyperv/progress"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressLinePrefix starts the lines the sudo copy helper reports the bytes
+// it copied with, so the parent process can count them in its metrics.
+const progressLinePrefix = "hyperv-copy-progress "
+
+// progressReportInterval is how often the helper reports.
+const progressReportInterval = time.Second
+
+// ReportCopyProgress writes the bytes copied so far to w every second, for
+// the process that started this one with sudo. The returned function stops
+// the reports after a last one.
+func ReportCopyProgress(w io.Writer) func() {
+	var mu sync.Mutex
+	last := int64(-1)
+	report := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		copied := int64(metrics.TransferredBytes.Value(string(progress.Copy)))
+		if copied != last {
+			fmt.Fprintf(w, "%s%d\n", progressLinePrefix, copied)
+			last = copied
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				report()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			report()
+		})
+	}
+}
+
+// progressReader passes the output of the sudo copy helper on to out and
+// counts the bytes it reports as copied.
+type progressReader struct {
+	out    io.Writer
+	copied int64
+}
+
+// consume reads the helper's output from r until it ends.
+func (p *progressReader) consume(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, progressLinePrefix); ok {
+			if copied, err := strconv.ParseInt(value, 10, 64); err == nil {
+				if copied > p.copied {
+					metrics.TransferredBytes.Add(float64(copied-p.copied), string(progress.Copy))
+					p.copied = copied
+				}
+				continue
+			}
+		}
+		fmt.Fprintln(p.out, line)
+	}
+}
@@ -0,0 +1,46 @@
+package nfs
+
+import (
+	"bytes"
+	"hyperv/metrics"
+	"hyperv/progress"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProgressReader(t *testing.T) {
+	before := metrics.TransferredBytes.Value(string(progress.Copy))
+	var out bytes.Buffer
+	p := &progressReader{out: &out}
+	p.consume(strings.NewReader("Copying vm1\n" +
+		progressLinePrefix + "100\n" +
+		progressLinePrefix + "250\n" +
+		progressLinePrefix + "250\n" +
+		progressLinePrefix + "not a number\n" +
+		"Done\n"))
+
+	if got := metrics.TransferredBytes.Value(string(progress.Copy)) - before; got != 250 {
+		t.Errorf("counted %v bytes, want 250", got)
+	}
+	want := "Copying vm1\n" + progressLinePrefix + "not a number\nDone\n"
+	if out.String() != want {
+		t.Errorf("passed on %q, want %q", out.String(), want)
+	}
+}
+
+func TestReportCopyProgress(t *testing.T) {
+	var out bytes.Buffer
+	stop := ReportCopyProgress(&out)
+	task := progress.New(&bytes.Buffer{}, false).Start(progress.Copy, "vm1/disk.vhdx", 1000)
+	task.Set(1000)
+	task.Done()
+	stop()
+	stop()
+
+	total := int64(metrics.TransferredBytes.Value(string(progress.Copy)))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if last := lines[len(lines)-1]; last != progressLinePrefix+strconv.FormatInt(total, 10) {
+		t.Errorf("last report %q, want the total of %d bytes", last, total)
+	}
+}
@@ -0,0 +1,107 @@
+package ova
+
+import (
+	"fmt"
+	hyperv "hyperv/common"
+	"strings"
+)
+
+// Adapter is a network adapter of a Hyper-V VM: its name and where it is
+// connected.
+type Adapter struct {
+	Name   string
+	Switch string
+	// VLAN is the access VLAN; 0 when the adapter is untagged.
+	VLAN int
+}
+
+// Adapters reads the network adapters from the Get-VM output of a VM.
+// Adapters without a name are called "VM Network <n>".
+func Adapters(vm map[string]interface{}) []Adapter {
+	raw, _ := vm["NetworkAdapters"].([]interface{})
+	var adapters []Adapter
+	for i, a := range raw {
+		m, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		adapter := Adapter{Name: fmt.Sprintf("VM Network %d", i+1)}
+		if n, ok := m["Name"].(string); ok && n != "" {
+			adapter.Name = n
+		}
+		adapter.Switch, _ = m["SwitchName"].(string)
+		if vlan, ok := m["VlanSetting"].(map[string]interface{}); ok {
+			if id, ok := vlan["AccessVlanId"].(float64); ok {
+				adapter.VLAN = int(id)
+			}
+		}
+		adapters = append(adapters, adapter)
+	}
+	return adapters
+}
+
+// Network is the name of the OVF network of the adapter: its switch, with
+// the access VLAN when there is one, so Forklift sees one source network
+// per switch and VLAN. An adapter that is not connected keeps its own name.
+func (a Adapter) Network() string {
+	if a.Switch == "" {
+		return a.Name
+	}
+	if a.VLAN > 0 {
+		return fmt.Sprintf("%s VLAN %d", a.Switch, a.VLAN)
+	}
+	return a.Switch
+}
+
+// Drive is a virtual hard disk of a Hyper-V VM and where it is attached.
+type Drive struct {
+	// Path is the disk file on the Hyper-V host.
+	Path               string
+	ControllerType     string
+	ControllerNumber   int
+	ControllerLocation int
+}
+
+// controllerTypes are the names of Hyper-V's ControllerType values, which
+// ConvertTo-Json writes as numbers.
+var controllerTypes = []string{"IDE", "SCSI", "PMEM"}
+
+// Drives reads the hard disk drives from the Get-VM output of a VM.
+func Drives(vm map[string]interface{}) []Drive {
+	raw, _ := vm["HardDrives"].([]interface{})
+	var drives []Drive
+	for _, d := range raw {
+		m, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		drive := Drive{}
+		drive.Path, _ = m["Path"].(string)
+		switch t := m["ControllerType"].(type) {
+		case float64:
+			if int(t) >= 0 && int(t) < len(controllerTypes) {
+				drive.ControllerType = controllerTypes[int(t)]
+			}
+		case string:
+			drive.ControllerType = strings.ToUpper(t)
+		}
+		if n, ok := m["ControllerNumber"].(float64); ok {
+			drive.ControllerNumber = int(n)
+		}
+		if n, ok := m["ControllerLocation"].(float64); ok {
+			drive.ControllerLocation = int(n)
+		}
+		drives = append(drives, drive)
+	}
+	return drives
+}
+
+// FileName is the name of the disk file, as referenced by the OVF.
+func (d Drive) FileName() string {
+	return hyperv.RemoteFileName(d.Path)
+}
+
+// Position is where the drive is attached, e.g. "SCSI 0:1".
+func (d Drive) Position() string {
+	return fmt.Sprintf("%s %d:%d", d.ControllerType, d.ControllerNumber, d.ControllerLocation)
+}
@@ -1,10 +1,13 @@
 package ova
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	hyperv "hyperv/common"
+	"hyperv/logging"
 	osutil "hyperv/os"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -32,11 +35,70 @@ func GetOVFOperatingSystemID(osName string) int {
 	return 1 // Other
 }
 
+// DiskFile is a disk referenced by the OVF and its virtual size in bytes.
+type DiskFile struct {
+	Path     string
+	Capacity int64
+}
+
+// FormatFromHyperV writes the OVF for a VM next to its first downloaded disk.
 func FormatFromHyperV(vm interface{}, rawDiskPaths []string) error {
+	var disks []DiskFile
+	for _, diskPath := range rawDiskPaths {
+		diskCapacity := int64(10 * 1024 * 1024 * 1024) // fallback size
+		virtualSize, err := GetVHDXVirtualSize(diskPath)
+		if err != nil {
+			// Fallback to file size with warning
+			if stat, statErr := os.Stat(diskPath); statErr == nil {
+				diskCapacity = stat.Size()
+				slog.Warn("Could not read VHDX virtual size, using file size", logging.KeyStage, "package", logging.KeyDisk, diskPath, "error", err)
+			} else {
+				return fmt.Errorf("failed to get size of disk file %s: %w", diskPath, err)
+			}
+		} else {
+			diskCapacity = int64(virtualSize)
+		}
+		disks = append(disks, DiskFile{Path: diskPath, Capacity: diskCapacity})
+	}
+
+	env, err := BuildEnvelope(vm, disks)
+	if err != nil {
+		return err
+	}
+	ovf, err := MarshalOvf(env)
+	if err != nil {
+		return fmt.Errorf("failed to marshal OVF: %w", err)
+	}
+
+	ovfPath := OvfPath(env.VirtualSystem.Name, rawDiskPaths)
+	if err := os.WriteFile(ovfPath, ovf, 0644); err != nil {
+		return fmt.Errorf("failed to write OVF: %w", err)
+	}
+	slog.Info("OVF file written", logging.KeyVM, env.VirtualSystem.Name, logging.KeyStage, "package", "path", ovfPath)
+
+	return nil
+}
+
+// OvfPath is where the OVF for a VM is written: next to its first disk,
+// or named after the VM when it has none.
+func OvfPath(vmName string, rawDiskPaths []string) string {
+	var basePath string
+	if len(rawDiskPaths) > 0 {
+		basePath = rawDiskPaths[0]
+	} else {
+		// Fallback if no disk paths provided
+		basePath = vmName + ".vhdx"
+	}
+	return hyperv.RemoveFileExtension(basePath) + ".ovf"
+}
+
+// BuildEnvelope builds the OVF envelope from the Hyper-V VM info and the
+// disks, which don't need to exist locally.
+func BuildEnvelope(vm interface{}, diskFiles []DiskFile) (*Envelope, error) {
 
 	vmMap, ok := vm.(map[string]interface{})
 	if !ok {
-		return fmt.Errorf("invalid VM format: expected map[string]interface{}")
+		return nil, fmt.Errorf("invalid VM format: expected map[string]interface{}")
 	}
 
 	var (
@@ -90,31 +152,18 @@ func FormatFromHyperV(vm interface{}, rawDiskPaths []string) error {
 
 	// --- Hard Disks ---
 	if hdList, ok := vmMap["HardDrives"].([]interface{}); ok {
-		// Process each disk using the corresponding path from rawDiskPaths
+		// Process each disk using the corresponding disk file
 		for i := range hdList {
-			// Check if we have a corresponding disk path
-			if i >= len(rawDiskPaths) {
-				return fmt.Errorf("mismatch: VM has %d hard drives but only %d disk paths provided", len(hdList), len(rawDiskPaths))
+			// Check if we have a corresponding disk file
+			if i >= len(diskFiles) {
+				return nil, fmt.Errorf("mismatch: VM has %d hard drives but only %d disk paths provided", len(hdList), len(diskFiles))
 			}
 
-			diskPath := rawDiskPaths[i]
 			diskIndex := i + 1
 			fileRefID := fmt.Sprintf("file%d", diskIndex)
 
-			fileName := filepath.Base(diskPath)
-			diskCapacity := int64(10 * 1024 * 1024 * 1024) // fallback size
-			virtualSize, err := GetVHDXVirtualSize(diskPath)
-			if err != nil {
-				// Fallback to file size with warning
-				if stat, statErr := os.Stat(diskPath); statErr == nil {
-					diskCapacity = stat.Size()
-					fmt.Printf("Warning: Could not read VHDX virtual size for %s: %v, using file size\n", diskPath, err)
-				} else {
-					return fmt.Errorf("failed to get size of disk file %s: %w", diskPath, err)
-				}
-			} else {
-				diskCapacity = int64(virtualSize)
-			}
+			fileName := filepath.Base(diskFiles[i].Path)
+			diskCapacity := diskFiles[i].Capacity
 
 			files = append(files, File{
 				ID:   fileRefID,
@@ -146,37 +195,30 @@ func FormatFromHyperV(vm interface{}, rawDiskPaths []string) error {
 	}
 
 	// 4. Network Interfaces
-	if adapters, ok := vmMap["NetworkAdapters"].([]interface{}); ok {
-		for i, a := range adapters {
-
-			adapter, ok := a.(map[string]interface{})
-			if !ok {
-				continue
-			}
-
-			networkIndex := i + 1
-			networkName := fmt.Sprintf("VM Network %d", networkIndex)
-			if n, ok := adapter["Name"].(string); ok && n != "" {
-				networkName = n
-			}
-
+	// Adapters on the same switch and VLAN share one network
+	seenNetworks := make(map[string]bool)
+	for i, adapter := range Adapters(vmMap) {
+		networkIndex := i + 1
+		networkName := adapter.Network()
+		if !seenNetworks[networkName] {
+			seenNetworks[networkName] = true
 			networks = append(networks, Network{
 				Name:        networkName,
-				Description: fmt.Sprintf("Network interface %d", networkIndex),
+				Description: fmt.Sprintf("Network of %s", adapter.Name),
 			})
-
-			autoAlloc := true
-			hardwareItems = append(hardwareItems, Item{
-				InstanceID:          strconv.Itoa(itemInstanceID),
-				ResourceType:        10,
-				ResourceSubType:     "E1000",
-				ElementName:         fmt.Sprintf("Ethernet %d", networkIndex),
-				Description:         fmt.Sprintf("E1000 ethernet adapter on \"%s\"", networkName),
-				Connection:          networkName,
-				AutomaticAllocation: &autoAlloc,
-			})
-			itemInstanceID++
 		}
+
+		autoAlloc := true
+		hardwareItems = append(hardwareItems, Item{
+			InstanceID:          strconv.Itoa(itemInstanceID),
+			ResourceType:        10,
+			ResourceSubType:     "E1000",
+			ElementName:         fmt.Sprintf("Ethernet %d", networkIndex),
+			Description:         fmt.Sprintf("E1000 ethernet adapter on \"%s\"", networkName),
+			Connection:          networkName,
+			AutomaticAllocation: &autoAlloc,
+		})
+		itemInstanceID++
 	}
 
 	// --- Operating System ---
@@ -242,30 +284,94 @@ func FormatFromHyperV(vm interface{}, rawDiskPaths []string) error {
 		},
 	}
 
-	ovf, err := MarshalOvf(env)
+	return env, nil
+}
+
+func MarshalOvf(env *Envelope) ([]byte, error) {
+	body, err := xml.MarshalIndent(env, "", "  ")
 	if err != nil {
-		return fmt.Errorf("failed to marshal OVF: %w", err)
+		return nil, err
 	}
+	return []byte(xmlHeader + string(body)), nil
+}
 
-	// Use the first disk path as base for OVF filename, or VM name if available
-	var basePath string
-	if len(rawDiskPaths) > 0 {
-		basePath = rawDiskPaths[0]
-	} else {
-		// Fallback if no disk paths provided
-		basePath = vmName + ".vhdx"
+// ReadOvf parses the OVF descriptor at path.
+func ReadOvf(path string) (*Envelope, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	ovfPath := hyperv.RemoveFileExtension(basePath) + ".ovf"
-	os.WriteFile(ovfPath, ovf, 0644)
-	fmt.Println("OVF file written to:", ovfPath)
+	return UnmarshalOvf(content)
+}
 
-	return nil
+// UnmarshalOvf parses an OVF descriptor. The Envelope fields are tagged
+// with prefixed names such as ovf:href, which is how MarshalOvf writes
+// them; the decoder resolves prefixes to namespace URLs, so the names are
+// turned back into their prefixed form first.
+func UnmarshalOvf(content []byte) (*Envelope, error) {
+	var env Envelope
+	d := xml.NewTokenDecoder(&prefixedNames{d: xml.NewDecoder(bytes.NewReader(content)), prefixes: make(map[string]string)})
+	if err := d.Decode(&env); err != nil {
+		return nil, fmt.Errorf("failed to parse OVF: %w", err)
+	}
+	return &env, nil
 }
 
-func MarshalOvf(env *Envelope) ([]byte, error) {
-	body, err := xml.MarshalIndent(env, "", "  ")
+// prefixedNames passes on the tokens of d with the namespace of every
+// prefixed element and attribute written as its prefix again.
+type prefixedNames struct {
+	d *xml.Decoder
+	// prefixes maps the namespace URLs declared so far to their prefix;
+	// defaultNS is the one of unprefixed elements.
+	prefixes  map[string]string
+	defaultNS string
+}
+
+func (p *prefixedNames) Token() (xml.Token, error) {
+	tok, err := p.d.Token()
 	if err != nil {
-		return nil, err
+		return tok, err
 	}
-	return []byte(xmlHeader + string(body)), nil
+	switch t := tok.(type) {
+	case xml.StartElement:
+		for _, attr := range t.Attr {
+			switch {
+			case attr.Name.Space == "xmlns":
+				p.prefixes[attr.Value] = attr.Name.Local
+			case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+				p.defaultNS = attr.Value
+			}
+		}
+		t.Name = p.element(t.Name)
+		attrs := make([]xml.Attr, len(t.Attr))
+		for i, attr := range t.Attr {
+			attrs[i] = xml.Attr{Name: p.prefixed(attr.Name), Value: attr.Value}
+		}
+		t.Attr = attrs
+		return t, nil
+	case xml.EndElement:
+		t.Name = p.element(t.Name)
+		return t, nil
+	}
+	return tok, nil
+}
+
+// element leaves the names in the default namespace unprefixed.
+func (p *prefixedNames) element(name xml.Name) xml.Name {
+	if name.Space == p.defaultNS {
+		return xml.Name{Local: name.Local}
+	}
+	return p.prefixed(name)
+}
+
+func (p *prefixedNames) prefixed(name xml.Name) xml.Name {
+	if name.Space == "" {
+		return name
+	}
+	// An undeclared prefix is left in Space as it is
+	prefix, ok := p.prefixes[name.Space]
+	if !ok {
+		prefix = name.Space
+	}
+	return xml.Name{Local: prefix + ":" + name.Local}
 }
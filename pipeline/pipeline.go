@@ -0,0 +1,187 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Limits bounds how much of each kind of work runs at the same time, so a
+// large wave doesn't open one WinRM session and one SCP stream per VM
+// against a single Hyper-V host.
+type Limits struct {
+	// VMs is the number of VMs processed at once.
+	VMs int
+	// WinRM is the number of concurrent WinRM operations.
+	WinRM int
+	// Transfers is the number of concurrent disk downloads.
+	Transfers int
+	// Conversions is the number of concurrent OVF conversions.
+	Conversions int
+}
+
+// DefaultLimits are used for every limit that is not set.
+var DefaultLimits = Limits{VMs: 4, WinRM: 4, Transfers: 2, Conversions: 2}
+
+// WithDefaults fills the unset limits from DefaultLimits.
+func (l Limits) WithDefaults() Limits {
+	if l.VMs <= 0 {
+		l.VMs = DefaultLimits.VMs
+	}
+	if l.WinRM <= 0 {
+		l.WinRM = DefaultLimits.WinRM
+	}
+	if l.Transfers <= 0 {
+		l.Transfers = DefaultLimits.Transfers
+	}
+	if l.Conversions <= 0 {
+		l.Conversions = DefaultLimits.Conversions
+	}
+	return l
+}
+
+// Limiter hands out slots for each kind of work.
+type Limiter struct {
+	winrm       chan struct{}
+	transfers   chan struct{}
+	conversions chan struct{}
+}
+
+func NewLimiter(l Limits) *Limiter {
+	l = l.WithDefaults()
+	return &Limiter{
+		winrm:       make(chan struct{}, l.WinRM),
+		transfers:   make(chan struct{}, l.Transfers),
+		conversions: make(chan struct{}, l.Conversions),
+	}
+}
+
+// WinRM runs fn once a WinRM slot is free.
+func (l *Limiter) WinRM(ctx context.Context, fn func() error) error {
+	return run(ctx, l.winrm, fn)
+}
+
+// Transfer runs fn once a disk transfer slot is free.
+func (l *Limiter) Transfer(ctx context.Context, fn func() error) error {
+	return run(ctx, l.transfers, fn)
+}
+
+// Convert runs fn once a conversion slot is free.
+func (l *Limiter) Convert(ctx context.Context, fn func() error) error {
+	return run(ctx, l.conversions, fn)
+}
+
+// run waits for a slot in sem and runs fn. It gives up without running fn
+// when ctx is cancelled first.
+func run(ctx context.Context, sem chan struct{}, fn func() error) error {
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-sem }()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// Failure is a VM whose processing returned an error.
+type Failure struct {
+	Name string
+	Err  error
+}
+
+// Result is the outcome of a Run over a set of VMs.
+type Result struct {
+	Succeeded []string
+	Failed    []Failure
+	// Skipped VMs were never started because the run was cancelled.
+	Skipped []string
+}
+
+// OK reports whether every VM succeeded.
+func (r *Result) OK() bool {
+	return len(r.Failed) == 0 && len(r.Skipped) == 0
+}
+
+// Err aggregates the failures into one error, or returns nil.
+func (r *Result) Err() error {
+	if r.OK() {
+		return nil
+	}
+	var parts []string
+	for _, f := range r.Failed {
+		parts = append(parts, fmt.Sprintf("%s: %v", f.Name, f.Err))
+	}
+	if len(r.Skipped) > 0 {
+		parts = append(parts, fmt.Sprintf("not started: %s", strings.Join(r.Skipped, ", ")))
+	}
+	total := len(r.Succeeded) + len(r.Failed) + len(r.Skipped)
+	return fmt.Errorf("%d of %d VMs did not complete: %s", len(r.Failed)+len(r.Skipped), total, strings.Join(parts, "; "))
+}
+
+// Print writes a one line per VM summary.
+func (r *Result) Print() {
+	for _, name := range r.Succeeded {
+		fmt.Printf("  %s: ok\n", name)
+	}
+	for _, f := range r.Failed {
+		fmt.Printf("  %s: failed: %v\n", f.Name, f.Err)
+	}
+	for _, name := range r.Skipped {
+		fmt.Printf("  %s: not started\n", name)
+	}
+}
+
+// Run calls fn for every name with at most workers running at once. Once
+// ctx is cancelled no new name is started; the ones already running are
+// expected to honour ctx themselves.
+func Run(ctx context.Context, workers int, names []string, fn func(ctx context.Context, name string) error) *Result {
+	if workers <= 0 {
+		workers = DefaultLimits.VMs
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		result = &Result{}
+		sem    = make(chan struct{}, workers)
+	)
+
+	for i, name := range names {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			mu.Lock()
+			result.Skipped = append(result.Skipped, names[i:]...)
+			mu.Unlock()
+			break
+		}
+
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := fn(ctx, name)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Failed = append(result.Failed, Failure{Name: name, Err: err})
+			} else {
+				result.Succeeded = append(result.Succeeded, name)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	sort.Strings(result.Succeeded)
+	sort.Slice(result.Failed, func(a, b int) bool { return result.Failed[a].Name < result.Failed[b].Name })
+	return result
+}
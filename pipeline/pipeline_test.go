@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrency counts the calls running at once and the most seen.
+type concurrency struct {
+	running, most atomic.Int32
+}
+
+func (c *concurrency) do() {
+	n := c.running.Add(1)
+	defer c.running.Add(-1)
+	for {
+		most := c.most.Load()
+		if n <= most || c.most.CompareAndSwap(most, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+func vmNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("vm%02d", i)
+	}
+	return names
+}
+
+func TestRunLimitsWorkers(t *testing.T) {
+	var c concurrency
+	names := vmNames(10)
+	result := Run(context.Background(), 3, names, func(ctx context.Context, name string) error {
+		c.do()
+		return nil
+	})
+
+	if most := c.most.Load(); most > 3 {
+		t.Errorf("%d VMs ran at once, want at most 3", most)
+	}
+	if !result.OK() || !slices.Equal(result.Succeeded, names) {
+		t.Errorf("result = %+v, want every VM succeeded in order", result)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	names := vmNames(4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var calls atomic.Int32
+	result := Run(ctx, 2, names, func(ctx context.Context, name string) error {
+		calls.Add(1)
+		return nil
+	})
+	if calls.Load() != 0 || !slices.Equal(result.Skipped, names) {
+		t.Errorf("cancelled run called fn %d times, skipped %v", calls.Load(), result.Skipped)
+	}
+
+	// Cancelling while the first VM runs skips the rest; the running one
+	// still reports its own result
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	result = Run(ctx, 1, names, func(ctx context.Context, name string) error {
+		cancel()
+		return ctx.Err()
+	})
+	if len(result.Failed) != 1 || result.Failed[0].Name != "vm00" || !errors.Is(result.Failed[0].Err, context.Canceled) {
+		t.Errorf("failed = %+v, want vm00 cancelled", result.Failed)
+	}
+	if !slices.Equal(result.Skipped, names[1:]) {
+		t.Errorf("skipped = %v, want %v", result.Skipped, names[1:])
+	}
+}
+
+func TestResultErr(t *testing.T) {
+	tests := []struct {
+		name   string
+		result Result
+		want   string
+	}{
+		{name: "ok", result: Result{Succeeded: []string{"web01"}}},
+		{name: "failed", result: Result{Succeeded: []string{"web01"}, Failed: []Failure{{"db01", errors.New("disk missing")}}},
+			want: "1 of 2 VMs did not complete: db01: disk missing"},
+		{name: "failed and skipped",
+			result: Result{Failed: []Failure{{"db01", errors.New("disk missing")}, {"web01", errors.New("timeout")}}, Skipped: []string{"app01", "app02"}},
+			want:   "4 of 4 VMs did not complete: db01: disk missing; web01: timeout; not started: app01, app02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.result.Err()
+			if tt.want == "" {
+				if err != nil || !tt.result.OK() {
+					t.Errorf("Err() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("Err() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(Limits{WinRM: 2})
+
+	var c concurrency
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.WinRM(context.Background(), func() error {
+				c.do()
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	if most := c.most.Load(); most > 2 {
+		t.Errorf("%d WinRM operations ran at once, want at most 2", most)
+	}
+
+	// A cancelled context gives up on a full limiter without running fn
+	release := make(chan struct{})
+	var holding sync.WaitGroup
+	for range DefaultLimits.Transfers {
+		holding.Add(1)
+		go l.Transfer(context.Background(), func() error { holding.Done(); <-release; return nil })
+	}
+	holding.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	ran := false
+	if err := l.Transfer(ctx, func() error { ran = true; return nil }); !errors.Is(err, context.DeadlineExceeded) || ran {
+		t.Errorf("Transfer on a full limiter = %v, ran %v; want the deadline without running", err, ran)
+	}
+	close(release)
+}
@@ -0,0 +1,230 @@
+package preflight
+
+import (
+	"fmt"
+	hyperv "hyperv/common"
+	"hyperv/ova"
+	"hyperv/progress"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/masterzen/winrm"
+	"golang.org/x/sys/unix"
+)
+
+// Mode controls what happens when a preflight check fails.
+type Mode string
+
+const (
+	ModeStrict Mode = "strict" // refuse to start
+	ModeWarn   Mode = "warn"   // print the problems and carry on
+	ModeOff    Mode = "off"    // skip the checks entirely
+)
+
+// DiskRequirement is the space one VM disk needs once downloaded.
+type DiskRequirement struct {
+	Path        string
+	VirtualSize uint64
+	FileSize    uint64
+}
+
+// VMRequirement groups the disks of a single VM.
+type VMRequirement struct {
+	Name  string
+	Disks []DiskRequirement
+}
+
+func (v VMRequirement) VirtualSize() uint64 {
+	var total uint64
+	for _, d := range v.Disks {
+		total += d.VirtualSize
+	}
+	return total
+}
+
+func (v VMRequirement) FileSize() uint64 {
+	var total uint64
+	for _, d := range v.Disks {
+		total += d.FileSize
+	}
+	return total
+}
+
+// Destination is a local directory the run will write disks into.
+type Destination struct {
+	Name string
+	Path string
+	// ViaSudo marks destinations written by a sudo helper, where the
+	// current user lacking write access is not an error.
+	ViaSudo bool
+}
+
+// Result is the outcome of a preflight run.
+type Result struct {
+	VMs      []VMRequirement
+	Problems []string
+	Warnings []string
+}
+
+func (r *Result) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// ModeFromEnv reads PREFLIGHT_MODE, defaulting to strict.
+func ModeFromEnv() Mode {
+	switch Mode(strings.ToLower(os.Getenv("PREFLIGHT_MODE"))) {
+	case ModeWarn:
+		return ModeWarn
+	case ModeOff:
+		return ModeOff
+	default:
+		return ModeStrict
+	}
+}
+
+// CollectVM gathers the virtual and physical size of every disk of a VM.
+// Sizes come from Get-VHD on the Hyper-V host; if that fails and the disk
+// was already downloaded to localDir, the local VHDX metadata is used.
+func CollectVM(client *winrm.Client, vmName string, remotePaths []string, localDir string) (VMRequirement, error) {
+	req := VMRequirement{Name: vmName}
+	for _, remotePath := range remotePaths {
+		info, err := hyperv.GetVHDInfo(client, remotePath)
+		if err == nil {
+			req.Disks = append(req.Disks, DiskRequirement{
+				Path:        remotePath,
+				VirtualSize: info.Size,
+				FileSize:    info.FileSize,
+			})
+			continue
+		}
+
+		localFile := filepath.Join(localDir, hyperv.RemoteFileName(remotePath))
+		stat, statErr := os.Stat(localFile)
+		if statErr != nil {
+			return req, fmt.Errorf("failed to get size of %s: %w", remotePath, err)
+		}
+		virtualSize, vhdxErr := ova.GetVHDXVirtualSize(localFile)
+		if vhdxErr != nil {
+			virtualSize = uint64(stat.Size())
+		}
+		req.Disks = append(req.Disks, DiskRequirement{
+			Path:        remotePath,
+			VirtualSize: virtualSize,
+			FileSize:    uint64(stat.Size()),
+		})
+	}
+	return req, nil
+}
+
+// Check compares the size of all selected disks with the free space of
+// every destination and verifies that each destination is writable.
+// Destinations on the same filesystem are charged together. Not fitting
+// the physical size is a problem. Not fitting the virtual size is a
+// warning: dynamic disks of VMs that are still running can grow up to it
+// before they are shut down and downloaded.
+func Check(vms []VMRequirement, destinations []Destination) *Result {
+	result := &Result{VMs: vms}
+
+	var needed, virtual uint64
+	for _, vm := range vms {
+		needed += vm.FileSize()
+		virtual += max(vm.VirtualSize(), vm.FileSize())
+	}
+
+	// filesystem id -> bytes already charged
+	charged := make(map[uint64]uint64)
+	chargedVirtual := make(map[uint64]uint64)
+	for _, dest := range destinations {
+		dir, err := existingParent(dest.Path)
+		if err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s (%s): %v", dest.Name, dest.Path, err))
+			continue
+		}
+
+		if err := unix.Access(dir, unix.W_OK); err != nil {
+			msg := fmt.Sprintf("%s (%s) is not writable by the current user: %v", dest.Name, dir, err)
+			if dest.ViaSudo {
+				result.Warnings = append(result.Warnings, msg+" (copy runs through sudo)")
+			} else {
+				result.Problems = append(result.Problems, msg)
+			}
+		}
+
+		var st unix.Statfs_t
+		if err := unix.Statfs(dir, &st); err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s (%s): statfs failed: %v", dest.Name, dir, err))
+			continue
+		}
+		var fsStat unix.Stat_t
+		if err := unix.Stat(dir, &fsStat); err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s (%s): stat failed: %v", dest.Name, dir, err))
+			continue
+		}
+
+		free := st.Bavail * uint64(st.Bsize)
+		// Dev is an int32 on some platforms
+		dev := uint64(fsStat.Dev)
+		charged[dev] += needed
+		chargedVirtual[dev] += virtual
+		switch {
+		case charged[dev] > free:
+			result.Problems = append(result.Problems, fmt.Sprintf("%s (%s): needs %s but only %s is free",
+				dest.Name, dest.Path, FormatBytes(charged[dev]), FormatBytes(free)))
+		case chargedVirtual[dev] > free:
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s (%s): needs %s, but the disks can grow up to %s before their VMs are shut down and only %s is free",
+				dest.Name, dest.Path, FormatBytes(charged[dev]), FormatBytes(chargedVirtual[dev]), FormatBytes(free)))
+		}
+	}
+
+	return result
+}
+
+// existingParent returns path, or its closest existing ancestor when path
+// will be created later in the run.
+func existingParent(path string) (string, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if info, err := os.Stat(dir); err == nil {
+			if !info.IsDir() {
+				return "", fmt.Errorf("%s is not a directory", dir)
+			}
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no existing parent directory for %s", path)
+		}
+		dir = parent
+	}
+}
+
+// Print writes the per-VM breakdown followed by any warnings and problems.
+func (r *Result) Print() {
+	var totalVirtual, totalFile uint64
+	fmt.Println("Preflight disk space check:")
+	for _, vm := range r.VMs {
+		fmt.Printf("  VM %s: virtual %s, physical %s\n", vm.Name, FormatBytes(vm.VirtualSize()), FormatBytes(vm.FileSize()))
+		for _, d := range vm.Disks {
+			fmt.Printf("    %s: virtual %s, physical %s\n", hyperv.RemoteFileName(d.Path), FormatBytes(d.VirtualSize), FormatBytes(d.FileSize))
+		}
+		totalVirtual += vm.VirtualSize()
+		totalFile += vm.FileSize()
+	}
+	fmt.Printf("  Total: virtual %s, physical %s\n", FormatBytes(totalVirtual), FormatBytes(totalFile))
+
+	for _, w := range r.Warnings {
+		fmt.Printf("  Warning: %s\n", w)
+	}
+	for _, p := range r.Problems {
+		fmt.Printf("  Problem: %s\n", p)
+	}
+}
+
+// FormatBytes renders a byte count using binary units.
+func FormatBytes(n uint64) string {
+	return progress.FormatBytes(n)
+}
@@ -0,0 +1,60 @@
+package preflight
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	const huge = 1 << 60
+	tests := []struct {
+		name        string
+		disk        DiskRequirement
+		wantProblem string
+		wantWarning string
+	}{
+		{name: "fits", disk: DiskRequirement{VirtualSize: 2048, FileSize: 1024}},
+		{name: "physical size does not fit", disk: DiskRequirement{VirtualSize: huge, FileSize: huge},
+			wantProblem: "needs 1.0 EiB"},
+		{name: "virtual size does not fit", disk: DiskRequirement{VirtualSize: huge, FileSize: 1024},
+			wantWarning: "can grow up to 1.0 EiB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			vms := []VMRequirement{{Name: "vm1", Disks: []DiskRequirement{tt.disk}}}
+			result := Check(vms, []Destination{
+				{Name: "output directory", Path: dir},
+				{Name: "NFS destination", Path: dir + "/nfs/not-created-yet"},
+			})
+
+			assertOne(t, "problem", result.Problems, tt.wantProblem)
+			assertOne(t, "warning", result.Warnings, tt.wantWarning)
+		})
+	}
+}
+
+func TestCheckCharged(t *testing.T) {
+	// Both destinations share a filesystem, which the second one is
+	// charged for twice
+	dir := t.TempDir()
+	size := uint64(1) << 62
+	vms := []VMRequirement{{Name: "vm1", Disks: []DiskRequirement{{VirtualSize: size, FileSize: size}}}}
+	result := Check(vms, []Destination{{Name: "a", Path: dir}, {Name: "b", Path: dir}})
+	if len(result.Problems) != 2 || !strings.Contains(result.Problems[1], "needs 8.0 EiB") {
+		t.Errorf("problems = %q, want the second destination charged both copies", result.Problems)
+	}
+}
+
+func assertOne(t *testing.T, kind string, got []string, want string) {
+	t.Helper()
+	if want == "" {
+		if len(got) != 0 {
+			t.Errorf("%ss = %q, want none", kind, got)
+		}
+		return
+	}
+	if len(got) != 2 || !strings.Contains(got[0], want) {
+		t.Errorf("%ss = %q, want one per destination with %q", kind, got, want)
+	}
+}
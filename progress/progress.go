@@ -0,0 +1,303 @@
+package progress
+
+import (
+	"fmt"
+	"hyperv/metrics"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Kind is the sort of work a task tracks.
+type Kind string
+
+const (
+	Download Kind = "download"
+	Copy     Kind = "copy"
+	Upload   Kind = "upload"
+)
+
+const (
+	// liveInterval is how often the live view is redrawn on a terminal.
+	liveInterval = 500 * time.Millisecond
+	// plainInterval is how often a progress line is logged otherwise.
+	plainInterval = 10 * time.Second
+)
+
+// Default renders to stderr, live when stderr is a terminal.
+var Default = New(os.Stderr, term.IsTerminal(int(os.Stderr.Fd())))
+
+var _ = metrics.NewGaugeFunc("hyperv_transfer_rate_bytes_per_second",
+	"Average rate of the running transfers, by kind.", "kind", Default.Rates)
+
+// Start adds a task to the Default tracker.
+func Start(kind Kind, label string, total int64) *Task {
+	return Default.Start(kind, label, total)
+}
+
+// Task is one transfer. Its counters may be updated from any
+// goroutine.
+type Task struct {
+	Kind  Kind
+	Label string
+
+	tracker *Tracker
+	start   time.Time
+	total   atomic.Int64
+	done    atomic.Int64
+	ended   atomic.Bool
+}
+
+// SetTotal sets the expected size; zero means unknown.
+func (t *Task) SetTotal(n int64) { t.total.Store(n) }
+
+// Add counts n more bytes.
+func (t *Task) Add(n int64) {
+	t.done.Add(n)
+	metrics.TransferredBytes.Add(float64(n), string(t.Kind))
+}
+
+// Set sets the bytes done so far.
+func (t *Task) Set(n int64) {
+	if old := t.done.Swap(n); n > old {
+		metrics.TransferredBytes.Add(float64(n-old), string(t.Kind))
+	}
+}
+
+// Write counts p, so a task can sit in an io.MultiWriter.
+func (t *Task) Write(p []byte) (int, error) {
+	t.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Reader counts everything read from r.
+func (t *Task) Reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, t)
+}
+
+// Done removes the task from the view. Calling it again is harmless.
+func (t *Task) Done() {
+	if t.ended.Swap(true) {
+		return
+	}
+	t.tracker.remove(t)
+}
+
+// line formats the task for the view.
+func (t *Task) line() string {
+	done, total := t.done.Load(), t.total.Load()
+	elapsed := time.Since(t.start)
+	rate := float64(0)
+	if elapsed > 0 {
+		rate = float64(done) / elapsed.Seconds()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-8s %s  ", t.Kind, t.Label)
+	if total > 0 {
+		fmt.Fprintf(&b, "%5.1f%%  %s / %s", percent(done, total), FormatBytes(uint64(done)), FormatBytes(uint64(total)))
+	} else {
+		b.WriteString(FormatBytes(uint64(done)))
+	}
+	if rate > 0 {
+		fmt.Fprintf(&b, "  %s/s", FormatBytes(uint64(rate)))
+		if total > done {
+			fmt.Fprintf(&b, "  ETA %s", eta(total-done, rate))
+		}
+	}
+	return b.String()
+}
+
+// log writes the task as a structured record for non-terminal output.
+func (t *Task) log() {
+	done, total := t.done.Load(), t.total.Load()
+	args := []any{"kind", t.Kind, "task", t.Label, "bytes", done}
+	if total > 0 {
+		args = append(args, "total", total, "percent", fmt.Sprintf("%.1f", percent(done, total)))
+	}
+	if elapsed := time.Since(t.start).Seconds(); elapsed > 0 && done > 0 {
+		rate := float64(done) / elapsed
+		args = append(args, "rate", FormatBytes(uint64(rate))+"/s")
+		if total > done {
+			args = append(args, "eta", eta(total-done, rate))
+		}
+	}
+	slog.Info("Progress", args...)
+}
+
+// Tracker keeps the active tasks and renders them while there are any.
+type Tracker struct {
+	out  io.Writer
+	live bool
+
+	mu    sync.Mutex
+	tasks []*Task
+	// drawn is the number of lines of the live view on screen.
+	drawn int
+	stop  chan struct{}
+}
+
+// New returns a tracker writing to out. A live tracker redraws one line per
+// task in place; otherwise progress is logged periodically.
+func New(out io.Writer, live bool) *Tracker {
+	return &Tracker{out: out, live: live}
+}
+
+// Start adds a task and starts rendering if it is the first one.
+func (tr *Tracker) Start(kind Kind, label string, total int64) *Task {
+	t := &Task{Kind: kind, Label: label, tracker: tr, start: time.Now()}
+	t.total.Store(total)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.tasks = append(tr.tasks, t)
+	if tr.stop == nil {
+		tr.stop = make(chan struct{})
+		go tr.loop(tr.stop)
+	}
+	return t
+}
+
+func (tr *Tracker) remove(t *Task) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for i, task := range tr.tasks {
+		if task == t {
+			tr.tasks = append(tr.tasks[:i], tr.tasks[i+1:]...)
+			break
+		}
+	}
+	if len(tr.tasks) == 0 && tr.stop != nil {
+		close(tr.stop)
+		tr.stop = nil
+	}
+	if tr.live {
+		tr.clear()
+		tr.draw()
+	}
+}
+
+func (tr *Tracker) loop(stop <-chan struct{}) {
+	interval := plainInterval
+	if tr.live {
+		interval = liveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		tr.mu.Lock()
+		if tr.live {
+			tr.clear()
+			tr.draw()
+			tr.mu.Unlock()
+			continue
+		}
+		tasks := append([]*Task(nil), tr.tasks...)
+		tr.mu.Unlock()
+		for _, t := range tasks {
+			t.log()
+		}
+	}
+}
+
+// clear erases the live view; the caller holds tr.mu.
+func (tr *Tracker) clear() {
+	if tr.drawn == 0 {
+		return
+	}
+	fmt.Fprint(tr.out, strings.Repeat("\x1b[1A\x1b[2K", tr.drawn))
+	tr.drawn = 0
+}
+
+// draw writes one line per task; the caller holds tr.mu.
+func (tr *Tracker) draw() {
+	width := 0
+	if f, ok := tr.out.(*os.File); ok {
+		width, _, _ = term.GetSize(int(f.Fd()))
+	}
+
+	var b strings.Builder
+	for _, t := range tr.tasks {
+		line := t.line()
+		// A wrapped line would break the count of lines to erase
+		if width > 0 && len(line) >= width {
+			line = line[:width-1]
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	fmt.Fprint(tr.out, b.String())
+	tr.drawn = len(tr.tasks)
+}
+
+// Rates sums the average rate of the active tasks by kind.
+func (tr *Tracker) Rates() map[string]float64 {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	rates := make(map[string]float64)
+	for _, t := range tr.tasks {
+		if elapsed := time.Since(t.start).Seconds(); elapsed > 0 {
+			rates[string(t.Kind)] += float64(t.done.Load()) / elapsed
+		}
+	}
+	return rates
+}
+
+// Writer returns a writer to the tracker's output that moves the live view
+// out of the way, so log lines don't get mixed into it.
+func (tr *Tracker) Writer() io.Writer {
+	return viewWriter{tr}
+}
+
+type viewWriter struct{ tr *Tracker }
+
+func (w viewWriter) Write(p []byte) (int, error) {
+	w.tr.mu.Lock()
+	defer w.tr.mu.Unlock()
+	if !w.tr.live {
+		return w.tr.out.Write(p)
+	}
+	w.tr.clear()
+	n, err := w.tr.out.Write(p)
+	w.tr.draw()
+	return n, err
+}
+
+// FormatBytes renders n in binary units.
+func FormatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func percent(done, total int64) float64 {
+	p := float64(done) / float64(total) * 100
+	if p > 100 {
+		p = 100
+	}
+	return p
+}
+
+func eta(remaining int64, rate float64) time.Duration {
+	return (time.Duration(float64(remaining) / rate * float64(time.Second))).Round(time.Second)
+}
@@ -0,0 +1,147 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"hyperv/preflight"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DirName is the directory below the output directory reports are written to.
+const DirName = "reports"
+
+// Report describes one run for automation (JSON) and stakeholders (HTML).
+type Report struct {
+	RunID     string    `json:"runId"`
+	Command   string    `json:"command"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	VMs       []VM      `json:"vms"`
+}
+
+// VM is the outcome of one VM in the run.
+type VM struct {
+	Name        string `json:"name"`
+	CPUs        int64  `json:"cpus"`
+	MemoryMB    int64  `json:"memoryMB"`
+	GuestOS     string `json:"guestOS"`
+	OSType      string `json:"osType,omitempty"`
+	Disks       []Disk `json:"disks"`
+	OVF         string `json:"ovf,omitempty"`
+	Destination string `json:"destination,omitempty"`
+	Plan        string `json:"plan,omitempty"`
+	Migration   string `json:"migration,omitempty"`
+	Stage       string `json:"stage"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Disk is a transferred disk.
+type Disk struct {
+	Source          string  `json:"source"`
+	Local           string  `json:"local"`
+	VirtualSize     uint64  `json:"virtualSize"`
+	PhysicalSize    uint64  `json:"physicalSize"`
+	SHA256          string  `json:"sha256,omitempty"`
+	TransferSeconds float64 `json:"transferSeconds,omitempty"`
+	// BytesPerSecond is the download throughput.
+	BytesPerSecond float64 `json:"bytesPerSecond,omitempty"`
+}
+
+// Write saves the report as <runID>.json and <runID>.html in dir and
+// returns the path of the HTML file.
+func (r *Report) Write(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create report directory: %w", err)
+	}
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, r.RunID+".json"), content, 0644); err != nil {
+		return "", fmt.Errorf("failed to write report: %w", err)
+	}
+
+	htmlPath := filepath.Join(dir, r.RunID+".html")
+	f, err := os.Create(htmlPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to write report: %w", err)
+	}
+	defer f.Close()
+	if err := htmlReport.Execute(f, r); err != nil {
+		return "", fmt.Errorf("failed to render report: %w", err)
+	}
+	return htmlPath, nil
+}
+
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": preflight.FormatBytes,
+	"rate": func(bps float64) string {
+		if bps <= 0 {
+			return "-"
+		}
+		return preflight.FormatBytes(uint64(bps)) + "/s"
+	},
+	"seconds": func(s float64) string {
+		if s <= 0 {
+			return "-"
+		}
+		return (time.Duration(s * float64(time.Second))).Round(time.Second).String()
+	},
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05 MST") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Migration report {{.RunID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+.ok { color: #1a7f37; } .failed { color: #cf222e; } .skipped { color: #9a6700; }
+code { font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Migration report {{.RunID}}</h1>
+<table>
+<tr><th>Command</th><td>{{.Command}}</td></tr>
+<tr><th>Hyper-V host</th><td>{{.Host}}</td></tr>
+<tr><th>Started</th><td>{{time .StartedAt}}</td></tr>
+<tr><th>Ended</th><td>{{time .EndedAt}}</td></tr>
+<tr><th>Status</th><td class="{{.Status}}">{{.Status}}</td></tr>
+{{if .Error}}<tr><th>Error</th><td>{{.Error}}</td></tr>{{end}}
+</table>
+
+<h2>Summary</h2>
+<table>
+<tr><th>VM</th><th>CPUs</th><th>Memory</th><th>Guest OS</th><th>Stage</th><th>Status</th></tr>
+{{range .VMs}}<tr><td><a href="#vm-{{.Name}}">{{.Name}}</a></td><td>{{.CPUs}}</td><td>{{.MemoryMB}} MB</td><td>{{.GuestOS}}</td><td>{{.Stage}}</td><td class="{{.Status}}">{{.Status}}</td></tr>
+{{end}}</table>
+
+{{range .VMs}}
+<h2 id="vm-{{.Name}}">{{.Name}}</h2>
+<table>
+<tr><th>Guest OS</th><td>{{.GuestOS}}{{if .OSType}} ({{.OSType}}){{end}}</td></tr>
+<tr><th>OVF</th><td><code>{{.OVF}}</code></td></tr>
+<tr><th>Destination</th><td>{{.Destination}}</td></tr>
+<tr><th>Forklift plan</th><td>{{.Plan}}</td></tr>
+<tr><th>Forklift migration</th><td>{{.Migration}}</td></tr>
+<tr><th>Status</th><td class="{{.Status}}">{{.Status}}{{if .Error}}: {{.Error}}{{end}}</td></tr>
+</table>
+<table>
+<tr><th>Disk</th><th>Virtual</th><th>Physical</th><th>SHA256</th><th>Transfer</th><th>Throughput</th></tr>
+{{range .Disks}}<tr><td><code>{{.Source}}</code></td><td>{{bytes .VirtualSize}}</td><td>{{bytes .PhysicalSize}}</td><td><code>{{.SHA256}}</code></td><td>{{seconds .TransferSeconds}}</td><td>{{rate .BytesPerSecond}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
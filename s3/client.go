@@ -0,0 +1,236 @@
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegion   = "us-east-1"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Client talks to an S3-compatible endpoint (AWS, MinIO, ODF/NooBaa) using
+// path-style addressing and AWS Signature Version 4.
+type Client struct {
+	Endpoint  *url.URL
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	HTTP      *http.Client
+}
+
+// errorResponse is the XML error body returned by S3.
+type errorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// APIError is a non-2xx response from the object store.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("object storage returned HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("object storage returned HTTP %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// NewClientFromEnv builds a client from the S3_* environment variables.
+func NewClientFromEnv() (*Client, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	bucket := os.Getenv("S3_BUCKET")
+	accessKey := os.Getenv("S3_ACCESS_KEY_ID")
+	secretKey := os.Getenv("S3_SECRET_ACCESS_KEY")
+	if endpoint == "" || bucket == "" || accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("missing object storage settings in environment (S3_ENDPOINT/S3_BUCKET/S3_ACCESS_KEY_ID/S3_SECRET_ACCESS_KEY)")
+	}
+
+	return NewClient(endpoint, os.Getenv("S3_REGION"), bucket, accessKey, secretKey, os.Getenv("S3_INSECURE_SKIP_VERIFY") == "true")
+}
+
+// NewClient returns a client for bucket on the given endpoint URL.
+func NewClient(endpoint, region, bucket, accessKey, secretKey string, insecureSkipVerify bool) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: scheme must be http or https", endpoint)
+	}
+	if region == "" {
+		region = defaultRegion
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &Client{
+		Endpoint:  u,
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		HTTP:      &http.Client{Transport: transport},
+	}, nil
+}
+
+// do sends a signed request for key in the client's bucket. body may be nil;
+// payloadHash is the hex SHA256 of the body or unsignedPayload.
+func (c *Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, contentLength int64, payloadHash string) (*http.Response, error) {
+	u := *c.Endpoint
+	u.Path = strings.TrimSuffix(c.Endpoint.Path, "/") + "/" + c.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+	}
+	if payloadHash == "" {
+		payloadHash = emptyPayload
+	}
+	c.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		var e errorResponse
+		if data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil && xml.Unmarshal(data, &e) == nil {
+			apiErr.Code = e.Code
+			apiErr.Message = e.Message
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 Authorization header to req.
+func (c *Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var names []string
+	canonicalHeaders := make(map[string]string)
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if name != "host" && name != "content-md5" && name != "content-type" && !strings.HasPrefix(name, "x-amz-") {
+			continue
+		}
+		names = append(names, name)
+		canonicalHeaders[name] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	sort.Strings(names)
+
+	var headerBlock strings.Builder
+	for _, name := range names {
+		headerBlock.WriteString(name + ":" + canonicalHeaders[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headerBlock.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, c.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by key as SigV4 requires.
+func canonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything except unreserved characters, and
+// also keeps '/' unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
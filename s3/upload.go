@@ -0,0 +1,371 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hyperv/logging"
+	"hyperv/progress"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	nfs "hyperv/nfs"
+)
+
+const (
+	maxParts = 10000
+
+	// ChecksumMetadataKey is the user metadata key holding the object's SHA256.
+	ChecksumMetadataKey = "X-Amz-Meta-Sha256"
+)
+
+// minPartSize is the size of the parts of a multipart upload unless the file
+// needs larger ones; tests lower it to upload small files in parts.
+var minPartSize int64 = 64 * 1024 * 1024 // 64MB
+
+// uploadState is persisted next to the source file so an interrupted
+// multipart upload can be resumed by a later run.
+type uploadState struct {
+	Key      string `json:"key"`
+	UploadID string `json:"uploadId"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"partSize"`
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type listPartsResult struct {
+	IsTruncated          bool `xml:"IsTruncated"`
+	NextPartNumberMarker int  `xml:"NextPartNumberMarker"`
+	Parts                []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+		Size       int64  `xml:"Size"`
+	} `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// CopyToObjectStorage uploads the OVF descriptors and disks under srcDir to
+// the bucket configured by the S3_* environment variables, using the same
+// per-VM layout as the NFS export under the optional S3_PREFIX. Cancelling
+// ctx stops the upload; a multipart upload is resumed by the next call. When
+// vms is not empty only the directories of those VMs are uploaded.
+func CopyToObjectStorage(ctx context.Context, srcDir string, vms []string) error {
+	client, err := NewClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	entries, err := nfs.PlanSync(srcDir, vms)
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %w", srcDir, err)
+	}
+
+	logger := logging.FromContext(ctx).With(logging.KeyStage, "upload")
+	prefix := strings.Trim(os.Getenv("S3_PREFIX"), "/")
+	var uploaded, skipped int
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := path.Join(prefix, filepath.ToSlash(entry.Rel))
+		didUpload, err := client.UploadFile(ctx, entry.Src, key)
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", entry.Src, err)
+		}
+		if didUpload {
+			logger.Info("Uploaded file", logging.KeyDisk, entry.Src, "bucket", client.Bucket, "key", key)
+			uploaded++
+		} else {
+			logger.Info("Object is up to date", logging.KeyDisk, entry.Src, "bucket", client.Bucket, "key", key)
+			skipped++
+		}
+	}
+
+	logger.Info("Object storage upload complete", "uploaded", uploaded, "upToDate", skipped)
+	return nil
+}
+
+// UploadFile uploads localPath as key and stores its SHA256 in the object
+// metadata. An object that already carries the same checksum is skipped, and
+// an interrupted multipart upload of the same file is resumed. It reports
+// whether anything was uploaded.
+func (c *Client) UploadFile(ctx context.Context, localPath, key string) (bool, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return false, err
+	}
+	sum, err := nfs.FileSHA256(localPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to hash %s: %w", localPath, err)
+	}
+
+	if remoteSum, err := c.objectChecksum(ctx, key); err == nil && remoteSum == sum {
+		return false, nil
+	}
+
+	task := progress.Start(progress.Upload, key, info.Size())
+	defer task.Done()
+
+	partSize := partSizeFor(info.Size())
+	if info.Size() <= partSize {
+		return true, c.putObject(ctx, localPath, key, info.Size(), sum, task)
+	}
+	return true, c.multipartUpload(ctx, localPath, key, info.Size(), partSize, sum, task)
+}
+
+// objectChecksum returns the SHA256 stored in key's metadata.
+func (c *Client) objectChecksum(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil, 0, "")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get(ChecksumMetadataKey), nil
+}
+
+func (c *Client) putObject(ctx context.Context, localPath, key string, size int64, sum string, task *progress.Task) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	md5sum, err := md5Section(f, 0, size)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set(ChecksumMetadataKey, sum)
+	header.Set("Content-Md5", base64.StdEncoding.EncodeToString(md5sum))
+	resp, err := c.do(ctx, http.MethodPut, key, nil, header, task.Reader(io.NewSectionReader(f, 0, size)), size, unsignedPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) multipartUpload(ctx context.Context, localPath, key string, size, partSize int64, sum string, task *progress.Task) error {
+	statePath := filepath.Join(filepath.Dir(localPath), "."+filepath.Base(localPath)+".s3-upload.json")
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Resume a previous upload of the same content, if the store still has it
+	existing := make(map[int]string) // part number -> ETag
+	state, err := loadUploadState(statePath)
+	if err == nil && state.Key == key && state.SHA256 == sum && state.Size == size && state.PartSize == partSize {
+		existing, err = c.listParts(ctx, key, state.UploadID)
+		if err != nil {
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Code != "NoSuchUpload" {
+				return fmt.Errorf("failed to list uploaded parts: %w", err)
+			}
+			state = nil
+			existing = make(map[int]string)
+		} else {
+			logging.FromContext(ctx).Info("Resuming upload", logging.KeyDisk, localPath, "key", key, "parts", len(existing))
+		}
+	} else {
+		state = nil
+	}
+
+	if state == nil {
+		uploadID, err := c.createMultipartUpload(ctx, key, sum)
+		if err != nil {
+			return fmt.Errorf("failed to start multipart upload: %w", err)
+		}
+		state = &uploadState{Key: key, UploadID: uploadID, SHA256: sum, Size: size, PartSize: partSize}
+		if err := saveUploadState(statePath, state); err != nil {
+			return err
+		}
+	}
+
+	var parts []completedPart
+	partCount := int((size + partSize - 1) / partSize)
+	for partNumber := 1; partNumber <= partCount; partNumber++ {
+		offset := int64(partNumber-1) * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		md5sum, err := md5Section(f, offset, length)
+		if err != nil {
+			return err
+		}
+		etag := `"` + hex.EncodeToString(md5sum) + `"`
+
+		if existing[partNumber] != etag {
+			header := http.Header{}
+			header.Set("Content-Md5", base64.StdEncoding.EncodeToString(md5sum))
+			query := url.Values{
+				"partNumber": {strconv.Itoa(partNumber)},
+				"uploadId":   {state.UploadID},
+			}
+			resp, err := c.do(ctx, http.MethodPut, key, query, header, io.NewSectionReader(f, offset, length), length, unsignedPayload)
+			if err != nil {
+				return fmt.Errorf("failed to upload part %d/%d: %w", partNumber, partCount, err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("ETag"); got != "" {
+				etag = got
+			}
+		}
+
+		parts = append(parts, completedPart{PartNumber: partNumber, ETag: etag})
+		task.Set(offset + length)
+	}
+
+	if err := c.completeMultipartUpload(ctx, key, state.UploadID, parts); err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	os.Remove(statePath)
+	return nil
+}
+
+func (c *Client) createMultipartUpload(ctx context.Context, key, sum string) (string, error) {
+	header := http.Header{}
+	header.Set(ChecksumMetadataKey, sum)
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result initiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("object storage returned an empty upload ID")
+	}
+	return result.UploadID, nil
+}
+
+func (c *Client) listParts(ctx context.Context, key, uploadID string) (map[int]string, error) {
+	parts := make(map[int]string)
+	marker := 0
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker > 0 {
+			query.Set("part-number-marker", strconv.Itoa(marker))
+		}
+		resp, err := c.do(ctx, http.MethodGet, key, query, nil, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+
+		var result listPartsResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse response: %w", err)
+		}
+
+		for _, p := range result.Parts {
+			parts[p.PartNumber] = p.ETag
+		}
+		if !result.IsTruncated || result.NextPartNumberMarker <= marker {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+func (c *Client) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(body)
+
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil,
+		bytes.NewReader(body), int64(len(body)), hex.EncodeToString(hash[:]))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 may report a failure inside a 200 response
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e errorResponse
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return &APIError{StatusCode: resp.StatusCode, Code: e.Code, Message: e.Message}
+	}
+	return nil
+}
+
+// partSizeFor picks a part size that keeps the upload under the S3 part limit.
+func partSizeFor(size int64) int64 {
+	partSize := minPartSize
+	for size/partSize >= maxParts {
+		partSize *= 2
+	}
+	return partSize
+}
+
+func md5Section(f *os.File, offset, length int64) ([]byte, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, offset, length)); err != nil {
+		return nil, fmt.Errorf("failed to hash part at offset %d: %w", offset, err)
+	}
+	return h.Sum(nil), nil
+}
+
+func loadUploadState(path string) (*uploadState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func saveUploadState(path string, state *uploadState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save upload state: %w", err)
+	}
+	return nil
+}
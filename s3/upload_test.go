@@ -0,0 +1,412 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testBucket = "ova"
+
+// fakeS3 is a minimal in-memory stand-in for a MinIO-compatible store. It
+// implements just the calls the uploader makes.
+type fakeS3 struct {
+	t   *testing.T
+	url string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	meta    map[string]string // key -> SHA256 metadata
+	uploads map[string]*fakeUpload
+	nextID  int
+	// failPart makes the upload of that part number fail once.
+	failPart int
+	// requests counts the requests by "METHOD kind".
+	requests map[string]int
+	// onPart is called with the number of every part stored.
+	onPart func(part int)
+}
+
+type fakeUpload struct {
+	key    string
+	sha256 string
+	parts  map[int][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *Client) {
+	f := &fakeS3{
+		t:        t,
+		objects:  make(map[string][]byte),
+		meta:     make(map[string]string),
+		uploads:  make(map[string]*fakeUpload),
+		requests: make(map[string]int),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	f.url = srv.URL
+	client, err := NewClient(srv.URL, "", testBucket, "AKIDEXAMPLE", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, client
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+		f.t.Errorf("%s %s: unsigned request: %q", r.Method, r.URL, auth)
+		s3Error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testBucket+"/")
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodHead:
+		f.requests["HEAD object"]++
+		if _, ok := f.objects[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(ChecksumMetadataKey, f.meta[key])
+
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		f.requests["PUT part"]++
+		upload := f.uploads[query.Get("uploadId")]
+		if upload == nil {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		if part == f.failPart {
+			f.failPart = 0
+			s3Error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		upload.parts[part] = body
+		w.Header().Set("ETag", etagOf(body))
+		if f.onPart != nil {
+			f.onPart(part)
+		}
+
+	case r.Method == http.MethodPut:
+		f.requests["PUT object"]++
+		f.objects[key] = body
+		f.meta[key] = r.Header.Get(ChecksumMetadataKey)
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.requests["POST create"]++
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = &fakeUpload{key: key, sha256: r.Header.Get(ChecksumMetadataKey), parts: make(map[int][]byte)}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == http.MethodGet && query.Has("uploadId"):
+		f.requests["GET parts"]++
+		upload := f.uploads[query.Get("uploadId")]
+		if upload == nil {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for n := range upload.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		fmt.Fprint(w, "<ListPartsResult><IsTruncated>false</IsTruncated>")
+		for _, n := range numbers {
+			fmt.Fprintf(w, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>",
+				n, etagOf(upload.parts[n]), len(upload.parts[n]))
+		}
+		fmt.Fprint(w, "</ListPartsResult>")
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.requests["POST complete"]++
+		id := query.Get("uploadId")
+		upload := f.uploads[id]
+		if upload == nil {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete completeMultipartUpload
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			s3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var object []byte
+		for i, part := range complete.Parts {
+			data, ok := upload.parts[part.PartNumber]
+			if part.PartNumber != i+1 || !ok || etagOf(data) != part.ETag {
+				s3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, data...)
+		}
+		f.objects[upload.key] = object
+		f.meta[upload.key] = upload.sha256
+		delete(f.uploads, id)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult/>")
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// smallParts makes files of a few hundred KiB upload in several parts.
+func smallParts(t *testing.T) {
+	old := minPartSize
+	minPartSize = 64 * 1024
+	t.Cleanup(func() { minPartSize = old })
+}
+
+// writeDisk writes size random bytes to a file in a new directory.
+func writeDisk(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	path := filepath.Join(t.TempDir(), "disk.vhdx")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func statePathOf(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".s3-upload.json")
+}
+
+func TestUploadFileMultipart(t *testing.T) {
+	smallParts(t)
+	fake, client := newFakeS3(t)
+	path, data := writeDisk(t, 4*64*1024+1000)
+
+	uploaded, err := client.UploadFile(context.Background(), path, "vm1/disk.vhdx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uploaded {
+		t.Fatal("UploadFile reported nothing uploaded")
+	}
+	if got := fake.requests["PUT part"]; got != 5 {
+		t.Errorf("uploaded %d parts, want 5", got)
+	}
+	if !bytes.Equal(fake.objects["vm1/disk.vhdx"], data) {
+		t.Error("object content differs from the file")
+	}
+	if fake.meta["vm1/disk.vhdx"] == "" {
+		t.Error("object has no checksum metadata")
+	}
+	if _, err := os.Stat(statePathOf(path)); !os.IsNotExist(err) {
+		t.Errorf("upload state left behind: %v", err)
+	}
+}
+
+func TestUploadFileResume(t *testing.T) {
+	smallParts(t)
+	fake, client := newFakeS3(t)
+	path, data := writeDisk(t, 4*64*1024+1000)
+
+	fake.failPart = 3
+	if _, err := client.UploadFile(context.Background(), path, "vm1/disk.vhdx"); err == nil {
+		t.Fatal("upload with a failing part succeeded")
+	}
+	state, err := loadUploadState(statePathOf(path))
+	if err != nil {
+		t.Fatalf("no upload state after the failure: %v", err)
+	}
+	if fake.uploads[state.UploadID] == nil {
+		t.Fatalf("upload %s of the state file is not in progress", state.UploadID)
+	}
+
+	fake.requests = make(map[string]int)
+	if _, err := client.UploadFile(context.Background(), path, "vm1/disk.vhdx"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.requests["POST create"]; got != 0 {
+		t.Errorf("started %d new uploads, want the old one resumed", got)
+	}
+	if got := fake.requests["GET parts"]; got != 1 {
+		t.Errorf("listed parts %d times, want 1", got)
+	}
+	// parts 1 and 2 made it the first time
+	if got := fake.requests["PUT part"]; got != 3 {
+		t.Errorf("uploaded %d parts on resume, want 3", got)
+	}
+	if !bytes.Equal(fake.objects["vm1/disk.vhdx"], data) {
+		t.Error("object content differs from the file")
+	}
+	if _, err := os.Stat(statePathOf(path)); !os.IsNotExist(err) {
+		t.Errorf("upload state left behind: %v", err)
+	}
+}
+
+func TestUploadFileResumeExpired(t *testing.T) {
+	smallParts(t)
+	fake, client := newFakeS3(t)
+	path, data := writeDisk(t, 3*64*1024)
+
+	fake.failPart = 2
+	if _, err := client.UploadFile(context.Background(), path, "vm1/disk.vhdx"); err == nil {
+		t.Fatal("upload with a failing part succeeded")
+	}
+	// The store forgot the upload, e.g. a lifecycle rule aborted it
+	fake.uploads = make(map[string]*fakeUpload)
+
+	if _, err := client.UploadFile(context.Background(), path, "vm1/disk.vhdx"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.objects["vm1/disk.vhdx"], data) {
+		t.Error("object content differs from the file")
+	}
+}
+
+func TestUploadFileCancelled(t *testing.T) {
+	smallParts(t)
+	fake, client := newFakeS3(t)
+	path, data := writeDisk(t, 4*64*1024+1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake.onPart = func(part int) {
+		if part == 2 {
+			cancel()
+		}
+	}
+	if _, err := client.UploadFile(ctx, path, "vm1/disk.vhdx"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("error = %v, want context.Canceled", err)
+	}
+	if got := fake.requests["PUT part"]; got != 2 {
+		t.Errorf("uploaded %d parts after the cancel at part 2", got)
+	}
+
+	// The next run picks up where the cancelled one stopped
+	fake.onPart = nil
+	fake.requests = make(map[string]int)
+	if _, err := client.UploadFile(context.Background(), path, "vm1/disk.vhdx"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.requests["PUT part"]; got != 3 {
+		t.Errorf("uploaded %d parts on resume, want 3", got)
+	}
+	if !bytes.Equal(fake.objects["vm1/disk.vhdx"], data) {
+		t.Error("object content differs from the file")
+	}
+}
+
+func TestCopyToObjectStorageCancelled(t *testing.T) {
+	fake, _ := newFakeS3(t)
+	t.Setenv("S3_ENDPOINT", fake.url)
+	t.Setenv("S3_BUCKET", testBucket)
+	t.Setenv("S3_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("S3_SECRET_ACCESS_KEY", "secret")
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "vm1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "vm1", "vm1.ovf"), []byte("<Envelope/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CopyToObjectStorage(context.Background(), dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["vm1/vm1.ovf"]; !ok {
+		t.Fatal("OVF was not uploaded")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fake.requests = make(map[string]int)
+	if err := CopyToObjectStorage(ctx, dir, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	if len(fake.requests) != 0 {
+		t.Errorf("cancelled upload made requests: %v", fake.requests)
+	}
+}
+
+func TestUploadFileSkipsUpToDate(t *testing.T) {
+	fake, client := newFakeS3(t)
+	path, data := writeDisk(t, 1000)
+
+	if uploaded, err := client.UploadFile(context.Background(), path, "vm1/vm1.ovf"); err != nil || !uploaded {
+		t.Fatalf("first upload: uploaded %v, error %v", uploaded, err)
+	}
+	if got := fake.requests["PUT object"]; got != 1 {
+		t.Fatalf("uploaded %d times, want a single PUT", got)
+	}
+
+	uploaded, err := client.UploadFile(context.Background(), path, "vm1/vm1.ovf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded || fake.requests["PUT object"] != 1 {
+		t.Error("object with a matching checksum was uploaded again")
+	}
+
+	// A changed file is uploaded again
+	data[0] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if uploaded, err := client.UploadFile(context.Background(), path, "vm1/vm1.ovf"); err != nil || !uploaded {
+		t.Fatalf("changed file: uploaded %v, error %v", uploaded, err)
+	}
+	if !bytes.Equal(fake.objects["vm1/vm1.ovf"], data) {
+		t.Error("object content differs from the changed file")
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int64
+	}{
+		{1, minPartSize},
+		{minPartSize * (maxParts - 1), minPartSize},
+		{minPartSize * maxParts, 2 * minPartSize},
+		{4 << 40, 512 << 20},
+	}
+	for _, tt := range tests {
+		if got := partSizeFor(tt.size); got != tt.want {
+			t.Errorf("partSizeFor(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package serve
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures the HTTP server that publishes the output directory.
+type Options struct {
+	Addr     string
+	Root     string
+	User     string // basic auth user, enabled together with Password
+	Password string
+	Token    string // bearer token, also accepted as ?token=
+	TLSCert  string
+	TLSKey   string
+}
+
+// OptionsFromEnv reads the SERVE_* environment variables.
+func OptionsFromEnv(root string) Options {
+	addr := os.Getenv("SERVE_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	return Options{
+		Addr:     addr,
+		Root:     root,
+		User:     os.Getenv("SERVE_USER"),
+		Password: os.Getenv("SERVE_PASSWORD"),
+		Token:    os.Getenv("SERVE_TOKEN"),
+		TLSCert:  os.Getenv("SERVE_TLS_CERT"),
+		TLSKey:   os.Getenv("SERVE_TLS_KEY"),
+	}
+}
+
+// checksumEntry caches a file digest until the file changes.
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	sum     []byte
+}
+
+// Server serves the files below Root with Range support, SHA256 headers,
+// optional authentication and an HTML index for directories.
+type Server struct {
+	opts Options
+	// root opens every served file, so a symlink cannot lead out of Root
+	root *os.Root
+
+	mu        sync.Mutex
+	checksums map[string]checksumEntry
+	// hashing holds the files being hashed, with a channel closed when
+	// the hash is done. queue holds the files the background hasher takes
+	// one at a time, and hasher whether it runs. Files are keyed by their
+	// slash-separated path below Root.
+	hashing map[string]chan struct{}
+	queue   []string
+	hasher  bool
+}
+
+// NewServer opens opts.Root for serving.
+func NewServer(opts Options) (*Server, error) {
+	rootDir, err := filepath.Abs(opts.Root)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(rootDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", rootDir)
+	}
+	root, err := os.OpenRoot(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	opts.Root = rootDir
+	return &Server{
+		opts:      opts,
+		root:      root,
+		checksums: make(map[string]checksumEntry),
+		hashing:   make(map[string]chan struct{}),
+	}, nil
+}
+
+// shutdownTimeout bounds how long running downloads may finish once ctx
+// is done.
+const shutdownTimeout = 10 * time.Second
+
+// ListenAndServe blocks serving HTTP, or HTTPS when a certificate is set,
+// until ctx is done; then it stops accepting connections and gives running
+// requests shutdownTimeout to finish.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	defer s.root.Close()
+	go s.warmChecksums()
+
+	srv := &http.Server{
+		Addr:              s.opts.Addr,
+		Handler:           s,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	scheme := "http"
+	if s.opts.TLSCert != "" || s.opts.TLSKey != "" {
+		scheme = "https"
+	}
+	fmt.Printf("Serving %s on %s://%s\n", s.opts.Root, scheme, s.opts.Addr)
+	if s.opts.User != "" {
+		fmt.Println("Basic authentication enabled")
+	}
+	if s.opts.Token != "" {
+		fmt.Println("Token authentication enabled")
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		stopped <- srv.Shutdown(shutdownCtx)
+	}()
+
+	var err error
+	if scheme == "https" {
+		err = srv.ListenAndServeTLS(s.opts.TLSCert, s.opts.TLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-stopped
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		if s.opts.User != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="hyperv-ova"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	for _, part := range strings.Split(urlPath, "/") {
+		if strings.HasPrefix(part, ".") {
+			// temporary and state files are never published
+			http.NotFound(w, r)
+			return
+		}
+	}
+	name := strings.TrimPrefix(urlPath, "/")
+	if name == "" {
+		name = "."
+	}
+
+	// Fails for symlinks that lead out of the root too
+	info, err := s.root.Stat(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		s.serveIndex(w, r, urlPath, name)
+		return
+	}
+
+	s.serveFile(w, r, name)
+}
+
+// authorized accepts any request when no credentials are configured,
+// otherwise either valid basic credentials or the bearer token.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.opts.User == "" && s.opts.Token == "" {
+		return true
+	}
+
+	if s.opts.User != "" {
+		if user, pass, ok := r.BasicAuth(); ok && secureEqual(user, s.opts.User) && secureEqual(pass, s.opts.Password) {
+			return true
+		}
+	}
+
+	if s.opts.Token != "" {
+		token := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token != "" && secureEqual(token, s.opts.Token) {
+			return true
+		}
+	}
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := s.root.Open(name)
+	if err != nil {
+		http.Error(w, "failed to open file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "failed to stat file", http.StatusInternalServerError)
+		return
+	}
+
+	sum, err := s.checksum(name, info)
+	if err != nil {
+		slog.Warn("Failed to hash file", "path", name, "error", err)
+	} else {
+		w.Header().Set("X-Checksum-Sha256", hex.EncodeToString(sum))
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	}
+
+	// ServeContent handles Range, If-Range and conditional requests
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// checksum returns the SHA256 of the file name, whose current state is
+// info. A digest cached for the file's size and modification time is
+// returned at once; otherwise the hash already running for the file is
+// waited for, or the file is hashed now, so every response carries the
+// checksum headers even if the first one has to wait for a large disk.
+func (s *Server) checksum(name string, info os.FileInfo) ([]byte, error) {
+	for {
+		s.mu.Lock()
+		if entry, ok := s.checksums[name]; ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+			s.mu.Unlock()
+			return entry.sum, nil
+		}
+		if done, ok := s.hashing[name]; ok {
+			s.mu.Unlock()
+			// The hash may fail or be of an older version of the file,
+			// so look again once it is done
+			<-done
+			continue
+		}
+		done := make(chan struct{})
+		s.hashing[name] = done
+		s.mu.Unlock()
+		return s.hashFile(name, done)
+	}
+}
+
+// hashFile hashes name, caches the digest and closes done.
+func (s *Server) hashFile(name string, done chan struct{}) ([]byte, error) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.hashing, name)
+		s.mu.Unlock()
+		close(done)
+	}()
+
+	f, err := s.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+
+	s.mu.Lock()
+	s.checksums[name] = checksumEntry{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	s.mu.Unlock()
+	return sum, nil
+}
+
+// queueChecksum has the background hasher hash name.
+func (s *Server) queueChecksum(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, name)
+	if !s.hasher {
+		s.hasher = true
+		go s.hashQueued()
+	}
+}
+
+// hashQueued hashes the queued files one after another, so the disks are
+// read one at a time however many are published, and returns when the
+// queue is empty. A file a request is hashing already is waited for.
+func (s *Server) hashQueued() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.hasher = false
+			s.mu.Unlock()
+			return
+		}
+		name := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		info, err := s.root.Stat(name)
+		if err != nil {
+			continue
+		}
+		if _, err := s.checksum(name, info); err != nil {
+			slog.Warn("Failed to hash file", "path", name, "error", err)
+		}
+	}
+}
+
+// warmChecksums queues every published file for hashing at startup, so
+// the first download of a file rarely has to wait for its hash.
+func (s *Server) warmChecksums() {
+	fs.WalkDir(s.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != "." {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			s.queueChecksum(p)
+		}
+		return nil
+	})
+}
+
+type indexEntry struct {
+	Name    string
+	Href    string
+	Size    int64
+	ModTime string
+	IsDir   bool
+	SHA256  string
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th align="left">Name</th><th align="right">Size</th><th align="left">Modified</th><th align="left">SHA256</th></tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td align="right">{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.ModTime}}</td><td><code>{{.SHA256}}</code></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// entryHref builds a relative link to a directory entry. The "./" prefix
+// keeps names containing ':' from being read as a URL scheme.
+func entryHref(name string, isDir bool) string {
+	href := "./" + (&url.URL{Path: name}).EscapedPath()
+	if isDir {
+		href += "/"
+	}
+	return href
+}
+
+// serveIndex lists a directory. Checksums are shown once a file was
+// hashed, so listing large disks stays cheap.
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request, urlPath, name string) {
+	dirEntries, err := fs.ReadDir(s.root.FS(), name)
+	if err != nil {
+		http.Error(w, "failed to read directory", http.StatusInternalServerError)
+		return
+	}
+
+	var entries []indexEntry
+	for _, d := range dirEntries {
+		if strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		// Symlinks are listed as what they point to, and left out when
+		// that is outside the root
+		entryName := path.Join(name, d.Name())
+		info, err := s.root.Stat(entryName)
+		if err != nil {
+			continue
+		}
+		entry := indexEntry{
+			Name:    d.Name(),
+			Href:    entryHref(d.Name(), info.IsDir()),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC().Format(time.RFC3339),
+			IsDir:   info.IsDir(),
+		}
+		if !info.IsDir() {
+			s.mu.Lock()
+			if c, ok := s.checksums[entryName]; ok && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+				entry.SHA256 = hex.EncodeToString(c.sum)
+			}
+			s.mu.Unlock()
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := indexTemplate.Execute(w, struct {
+		Path    string
+		Entries []indexEntry
+	}{urlPath, entries}); err != nil {
+		slog.Warn("Failed to render index", "path", urlPath, "error", err)
+	}
+}
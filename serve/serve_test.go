@@ -0,0 +1,348 @@
+package serve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newServer(t *testing.T, opts Options) *Server {
+	t.Helper()
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.root.Close() })
+	return s
+}
+
+// writeTree writes files, by slash-separated path, below root.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWarmChecksums(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"vm1/vm1.ovf":      "<Envelope/>",
+		"vm1/disk.vhdx":    "disk one",
+		"vm2/disk.vhdx":    "disk two",
+		".hidden/skip.bin": "not published",
+	}
+	writeTree(t, root, files)
+
+	s := newServer(t, Options{Root: root})
+	s.warmChecksums()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		done := !s.hasher && len(s.queue) == 0
+		s.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("files were not hashed in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(s.checksums) != 3 {
+		t.Errorf("hashed %d files, want the 3 published ones", len(s.checksums))
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/vm2/disk.vhdx", nil))
+	sum := sha256.Sum256([]byte("disk two"))
+	if got := rec.Header().Get("X-Checksum-Sha256"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("X-Checksum-Sha256 = %q, want %x", got, sum)
+	}
+}
+
+func TestListenAndServeStops(t *testing.T) {
+	s := newServer(t, Options{Addr: "127.0.0.1:0", Root: t.TempDir()})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe(ctx) }()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ListenAndServe = %v after the context was cancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server kept running after the context was cancelled")
+	}
+}
+
+func TestSymlinksStayInRoot(t *testing.T) {
+	outside := t.TempDir()
+	writeTree(t, outside, map[string]string{"secret.txt": "not published", "dir/key": "not published"})
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"vm1/disk.vhdx": "disk one"})
+	for link, target := range map[string]string{
+		"vm1/alias.vhdx": "disk.vhdx",
+		"vm1/secret.txt": filepath.Join(outside, "secret.txt"),
+		"vm1/up.txt":     "../../" + filepath.Base(outside) + "/secret.txt",
+		"outside":        filepath.Join(outside, "dir"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newServer(t, Options{Root: root})
+
+	for path, want := range map[string]int{
+		"/vm1/alias.vhdx": http.StatusOK,
+		"/vm1/secret.txt": http.StatusNotFound,
+		"/vm1/up.txt":     http.StatusNotFound,
+		"/outside/key":    http.StatusNotFound,
+		"/outside/":       http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", path, rec.Code, want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/vm1/", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "alias.vhdx") || strings.Contains(body, "secret.txt") || strings.Contains(body, "up.txt") {
+		t.Errorf("index lists links out of the root or misses the one inside:\n%s", body)
+	}
+}
+
+func TestChecksumOnFirstRequest(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"vm1/disk.vhdx": "disk one", "vm1/vm1.ovf": "<Envelope/>"})
+	s := newServer(t, Options{Root: root})
+
+	// Not hashed before
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/vm1/disk.vhdx", nil))
+	sum := sha256.Sum256([]byte("disk one"))
+	if got := rec.Header().Get("X-Checksum-Sha256"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("X-Checksum-Sha256 = %q, want %x", got, sum)
+	}
+	if got, want := rec.Header().Get("Digest"), "sha-256="+base64.StdEncoding.EncodeToString(sum[:]); got != want {
+		t.Errorf("Digest = %q, want %q", got, want)
+	}
+
+	// Being hashed: the request waits for that hash instead of starting
+	// another one
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.hashing["vm1/vm1.ovf"] = done
+	s.mu.Unlock()
+	served := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/vm1/vm1.ovf", nil))
+		served <- rec
+	}()
+	select {
+	case <-served:
+		t.Fatal("request did not wait for the running hash")
+	case <-time.After(50 * time.Millisecond):
+	}
+	info, err := os.Stat(filepath.Join(root, "vm1", "vm1.ovf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.checksums["vm1/vm1.ovf"] = checksumEntry{size: info.Size(), modTime: info.ModTime(), sum: []byte{0xab}}
+	delete(s.hashing, "vm1/vm1.ovf")
+	s.mu.Unlock()
+	close(done)
+	if got := (<-served).Header().Get("ETag"); got != `"ab"` {
+		t.Errorf("ETag = %q, want the hash that was running", got)
+	}
+}
+
+// get serves a GET of target with the request changed by setup.
+func get(s *Server, target string, setup func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	if setup != nil {
+		setup(r)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestServeRange(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"vm1/disk.vhdx": "0123456789abcdef"})
+	s := newServer(t, Options{Root: root})
+
+	rec := get(s, "/vm1/disk.vhdx", func(r *http.Request) { r.Header.Set("Range", "bytes=4-9") })
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", rec.Code)
+	}
+	if got := rec.Body.String(); got != "456789" {
+		t.Errorf("body = %q, want bytes 4-9", got)
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 4-9/16" {
+		t.Errorf("Content-Range = %q", got)
+	}
+
+	// Resuming with the ETag of the same file gets the range, with another
+	// one the whole file
+	etag := rec.Header().Get("ETag")
+	rec = get(s, "/vm1/disk.vhdx", func(r *http.Request) {
+		r.Header.Set("Range", "bytes=10-")
+		r.Header.Set("If-Range", etag)
+	})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "abcdef" {
+		t.Errorf("If-Range with the ETag: %d %q, want 206 \"abcdef\"", rec.Code, rec.Body.String())
+	}
+	rec = get(s, "/vm1/disk.vhdx", func(r *http.Request) {
+		r.Header.Set("Range", "bytes=10-")
+		r.Header.Set("If-Range", `"other"`)
+	})
+	if rec.Code != http.StatusOK || rec.Body.Len() != 16 {
+		t.Errorf("If-Range with another ETag: %d with %d bytes, want the whole file", rec.Code, rec.Body.Len())
+	}
+}
+
+func TestServeAuth(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"vm1/vm1.ovf": "<Envelope/>"})
+	s := newServer(t, Options{Root: root, User: "admin", Password: "secret", Token: "t0ken"})
+
+	tests := []struct {
+		name   string
+		target string
+		setup  func(r *http.Request)
+		want   int
+	}{
+		{"no credentials", "/vm1/vm1.ovf", nil, http.StatusUnauthorized},
+		{"basic", "/vm1/vm1.ovf", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"wrong password", "/vm1/vm1.ovf", func(r *http.Request) { r.SetBasicAuth("admin", "guess") }, http.StatusUnauthorized},
+		{"wrong user", "/vm1/vm1.ovf", func(r *http.Request) { r.SetBasicAuth("root", "secret") }, http.StatusUnauthorized},
+		{"bearer", "/vm1/vm1.ovf", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0ken") }, http.StatusOK},
+		{"wrong bearer", "/vm1/vm1.ovf", func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, http.StatusUnauthorized},
+		{"token parameter", "/vm1/vm1.ovf?token=t0ken", nil, http.StatusOK},
+		{"wrong token parameter", "/vm1/vm1.ovf?token=guess", nil, http.StatusUnauthorized},
+		// The header wins over the parameter
+		{"wrong bearer, right parameter", "/vm1/vm1.ovf?token=t0ken",
+			func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(s, tt.target, tt.setup)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Code == http.StatusUnauthorized {
+				if got := rec.Header().Get("WWW-Authenticate"); got != `Basic realm="hyperv-ova"` {
+					t.Errorf("WWW-Authenticate = %q", got)
+				}
+				if strings.Contains(rec.Body.String(), "Envelope") {
+					t.Error("rejected request got the file")
+				}
+			}
+		})
+	}
+
+	// Without basic credentials configured there is no basic challenge
+	s = newServer(t, Options{Root: root, Token: "t0ken"})
+	rec := get(s, "/vm1/vm1.ovf", func(r *http.Request) { r.SetBasicAuth("admin", "t0ken") })
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "" {
+		t.Errorf("token only: %d, WWW-Authenticate %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestServeHidesDotFiles(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"vm1/disk.vhdx":          "disk one",
+		"vm1/.disk.vhdx.partial": "partial",
+		".state/journal.json":    "{}",
+		"vm1/.hidden/disk.vhdx":  "hidden",
+	})
+	s := newServer(t, Options{Root: root})
+
+	for _, target := range []string{"/vm1/.disk.vhdx.partial", "/.state/journal.json", "/.state/", "/vm1/.hidden/disk.vhdx", "/vm1/%2Edisk.vhdx.partial"} {
+		if rec := get(s, target, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", target, rec.Code)
+		}
+	}
+	if rec := get(s, "/vm1/disk.vhdx", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /vm1/disk.vhdx = %d", rec.Code)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/vm1/disk.vhdx", strings.NewReader("x")))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT = %d, want 405", rec.Code)
+	}
+}
+
+func TestServeIndex(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"web:01/web:01.ovf":  "<Envelope/>",
+		"web:01/disk 1.vhdx": "disk one",
+		"web:01/.partial":    "hidden",
+		"db01/db01.ovf":      "<Envelope/>",
+	})
+	s := newServer(t, Options{Root: root})
+
+	rec := get(s, "/web:01", nil)
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/web:01/" {
+		t.Fatalf("directory without slash: %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Hash one file, so the index shows its checksum
+	get(s, "/web:01/web:01.ovf", nil)
+	rec = get(s, "/web:01/", nil)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("index: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	sum := sha256.Sum256([]byte("<Envelope/>"))
+	for _, want := range []string{
+		"<h1>Index of /web:01</h1>",
+		`<a href="../">../</a>`,
+		`<a href="./web:01.ovf">web:01.ovf</a>`,
+		`<a href="./disk%201.vhdx">disk 1.vhdx</a>`,
+		hex.EncodeToString(sum[:]),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("index lacks %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, ".partial") {
+		t.Errorf("index lists a dot file:\n%s", body)
+	}
+	// The disk was not hashed yet, and listing does not wait for it
+	diskSum := sha256.Sum256([]byte("disk one"))
+	if strings.Contains(body, hex.EncodeToString(diskSum[:])) {
+		t.Error("index hashed a file")
+	}
+
+	rec = get(s, "/", nil)
+	if body := rec.Body.String(); !strings.Contains(body, `<a href="./db01/">db01/</a>`) || strings.Contains(body, `href="../"`) {
+		t.Errorf("root index:\n%s", body)
+	}
+}
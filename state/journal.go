@@ -0,0 +1,255 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileName is the journal file kept in the output directory. It starts with
+// a dot so it is neither uploaded nor served.
+const FileName = ".state.json"
+
+// Stage is a completed step of a VM's pipeline. Stages only move forward.
+type Stage string
+
+const (
+	StageNone        Stage = ""
+	StageInventoried Stage = "inventoried"
+	StageShutDown    Stage = "shut-down"
+	StageDownloaded  Stage = "downloaded"
+	StageOVFWritten  Stage = "ovf-written"
+	StageCopied      Stage = "copied"
+	StageMigrated    Stage = "migrated"
+)
+
+var stageOrder = []Stage{StageNone, StageInventoried, StageShutDown, StageDownloaded, StageOVFWritten, StageCopied, StageMigrated}
+
+// Stages returns every stage a VM can reach, in order.
+func Stages() []Stage {
+	return append([]Stage(nil), stageOrder[1:]...)
+}
+
+func (s Stage) index() int {
+	for i, st := range stageOrder {
+		if st == s {
+			return i
+		}
+	}
+	return 0
+}
+
+// Disk is a downloaded disk.
+type Disk struct {
+	Source       string    `json:"source"`
+	Local        string    `json:"local"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+	DownloadedAt time.Time `json:"downloadedAt"`
+	// TransferSeconds is how long the download took.
+	TransferSeconds float64 `json:"transferSeconds,omitempty"`
+}
+
+// VM is the journal entry of one VM.
+type VM struct {
+	Name        string    `json:"name"`
+	Stage       Stage     `json:"stage"`
+	Disks       []Disk    `json:"disks,omitempty"`
+	OVF         string    `json:"ovf,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Plan        string    `json:"plan,omitempty"`
+	Migration   string    `json:"migration,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Journal records how far each VM got so a rerun can resume from the last
+// completed stage. Every change is written to disk before it returns.
+type Journal struct {
+	path string
+	mu   sync.Mutex
+	vms  map[string]*VM
+}
+
+// Open loads the journal from dir, or starts an empty one.
+func Open(dir string) (*Journal, error) {
+	j := &Journal{path: filepath.Join(dir, FileName), vms: make(map[string]*VM)}
+
+	content, err := os.ReadFile(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+		return nil, fmt.Errorf("failed to read state journal: %w", err)
+	}
+	var vms []*VM
+	if err := json.Unmarshal(content, &vms); err != nil {
+		return nil, fmt.Errorf("failed to parse state journal %s: %w", j.path, err)
+	}
+	for _, vm := range vms {
+		j.vms[vm.Name] = vm
+	}
+	return j, nil
+}
+
+// Get returns a copy of the entry for name, or an empty entry.
+func (j *Journal) Get(name string) VM {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	vm, ok := j.vms[name]
+	if !ok {
+		return VM{Name: name}
+	}
+	cp := *vm
+	cp.Disks = append([]Disk(nil), vm.Disks...)
+	return cp
+}
+
+// All returns a copy of every entry, sorted by name.
+func (j *Journal) All() []VM {
+	j.mu.Lock()
+	names := make([]string, 0, len(j.vms))
+	for name := range j.vms {
+		names = append(names, name)
+	}
+	j.mu.Unlock()
+
+	sort.Strings(names)
+	vms := make([]VM, 0, len(names))
+	for _, name := range names {
+		vms = append(vms, j.Get(name))
+	}
+	return vms
+}
+
+// Reached reports whether name has completed stage.
+func (j *Journal) Reached(name string, stage Stage) bool {
+	return j.Get(name).Stage.index() >= stage.index()
+}
+
+// Advance records that name completed stage and clears its last error.
+// Going back to an earlier stage is ignored.
+func (j *Journal) Advance(name string, stage Stage) error {
+	return j.update(name, func(vm *VM) {
+		if stage.index() > vm.Stage.index() {
+			vm.Stage = stage
+		}
+		vm.Error = ""
+	})
+}
+
+// DiskDone records a downloaded disk, replacing an earlier record of it.
+func (j *Journal) DiskDone(name string, disk Disk) error {
+	return j.update(name, func(vm *VM) {
+		for i, d := range vm.Disks {
+			if d.Source == disk.Source {
+				vm.Disks[i] = disk
+				return
+			}
+		}
+		vm.Disks = append(vm.Disks, disk)
+	})
+}
+
+// Downloaded returns the record of source if it was downloaded and the
+// local file still has the recorded size.
+func (j *Journal) Downloaded(name, source string) (Disk, bool) {
+	for _, d := range j.Get(name).Disks {
+		if d.Source != source {
+			continue
+		}
+		info, err := os.Stat(d.Local)
+		if err != nil || info.Size() != d.Size {
+			return Disk{}, false
+		}
+		return d, true
+	}
+	return Disk{}, false
+}
+
+// SetOVF records the written OVF and advances name to StageOVFWritten.
+func (j *Journal) SetOVF(name, path string) error {
+	return j.update(name, func(vm *VM) {
+		vm.OVF = path
+		if StageOVFWritten.index() > vm.Stage.index() {
+			vm.Stage = StageOVFWritten
+		}
+		vm.Error = ""
+	})
+}
+
+// SetCopied records the destination and advances name to StageCopied.
+func (j *Journal) SetCopied(name, destination string) error {
+	return j.update(name, func(vm *VM) {
+		vm.Destination = destination
+		if StageCopied.index() > vm.Stage.index() {
+			vm.Stage = StageCopied
+		}
+		vm.Error = ""
+	})
+}
+
+// SetMigration records the Forklift plan and migration created for name.
+func (j *Journal) SetMigration(name, plan, migration string) error {
+	return j.update(name, func(vm *VM) {
+		vm.Plan = plan
+		vm.Migration = migration
+	})
+}
+
+// Fail records the error that stopped name; its stage is kept.
+func (j *Journal) Fail(name string, cause error) error {
+	return j.update(name, func(vm *VM) {
+		vm.Error = cause.Error()
+	})
+}
+
+// Reset forgets name so the next run starts it from scratch.
+func (j *Journal) Reset(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.vms, name)
+	return j.save()
+}
+
+func (j *Journal) update(name string, change func(vm *VM)) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	vm, ok := j.vms[name]
+	if !ok {
+		vm = &VM{Name: name}
+		j.vms[name] = vm
+	}
+	change(vm)
+	vm.UpdatedAt = time.Now().UTC()
+	return j.save()
+}
+
+// save writes the journal atomically; the caller holds j.mu.
+func (j *Journal) save() error {
+	vms := make([]*VM, 0, len(j.vms))
+	for _, vm := range j.vms {
+		vms = append(vms, vm)
+	}
+	sort.Slice(vms, func(a, b int) bool { return vms[a].Name < vms[b].Name })
+
+	content, err := json.MarshalIndent(vms, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state journal: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("failed to write state journal: %w", err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("failed to write state journal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openJournal(t *testing.T, dir string) *Journal {
+	t.Helper()
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestJournalRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "web01", "web01.vhdx")
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(local, []byte("disk data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := openJournal(t, dir)
+	disk := Disk{Source: `D:\VMs\web01.vhdx`, Local: local, Size: 9, SHA256: "abc",
+		DownloadedAt: time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC), TransferSeconds: 1.5}
+	steps := []func() error{
+		func() error { return j.Advance("web01", StageShutDown) },
+		func() error { return j.DiskDone("web01", disk) },
+		func() error { return j.SetOVF("web01", filepath.Join(dir, "web01", "web01.ovf")) },
+		func() error { return j.SetCopied("web01", "nfs:/ova") },
+		func() error { return j.SetMigration("web01", "plan-1", "migration-1") },
+		func() error { return j.Advance("db01", StageInventoried) },
+		func() error { return j.Fail("db01", errors.New("shutdown timed out")) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened := openJournal(t, dir)
+	if got, want := reopened.All(), j.All(); !reflect.DeepEqual(got, want) {
+		t.Errorf("reloaded journal differs:\n got %+v\nwant %+v", got, want)
+	}
+	web := reopened.Get("web01")
+	if web.Stage != StageCopied || web.Destination != "nfs:/ova" || web.Plan != "plan-1" || len(web.Disks) != 1 {
+		t.Errorf("web01 = %+v", web)
+	}
+	if db := reopened.Get("db01"); db.Stage != StageInventoried || db.Error != "shutdown timed out" {
+		t.Errorf("db01 = %+v", db)
+	}
+	if _, ok := reopened.Downloaded("web01", disk.Source); !ok {
+		t.Error("disk with the recorded size is not reported as downloaded")
+	}
+	if err := os.WriteFile(local, []byte("trunc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Downloaded("web01", disk.Source); ok {
+		t.Error("disk with another size is reported as downloaded")
+	}
+
+	if err := reopened.Reset("web01"); err != nil {
+		t.Fatal(err)
+	}
+	if got := openJournal(t, dir).Get("web01"); got.Stage != StageNone || got.Disks != nil {
+		t.Errorf("web01 after reset = %+v", got)
+	}
+}
+
+func TestJournalReached(t *testing.T) {
+	j := openJournal(t, t.TempDir())
+	if err := j.Advance("web01", StageOVFWritten); err != nil {
+		t.Fatal(err)
+	}
+	// Stages never move back
+	if err := j.Advance("web01", StageShutDown); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stage := range Stages() {
+		want := stage.index() <= StageOVFWritten.index()
+		if got := j.Reached("web01", stage); got != want {
+			t.Errorf("Reached(%s) = %v, want %v", stage, got, want)
+		}
+	}
+	if !j.Reached("unknown", StageNone) || j.Reached("unknown", StageInventoried) {
+		t.Error("a VM not in the journal must only have reached StageNone")
+	}
+
+	if err := j.Fail("web01", errors.New("copy failed")); err != nil {
+		t.Fatal(err)
+	}
+	if got := j.Get("web01"); got.Stage != StageOVFWritten || got.Error != "copy failed" {
+		t.Errorf("after Fail = %+v, want the stage kept and the error set", got)
+	}
+	if err := j.SetCopied("web01", "s3://bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if got := j.Get("web01"); got.Stage != StageCopied || got.Error != "" {
+		t.Errorf("after SetCopied = %+v, want copied without an error", got)
+	}
+}
+
+func TestJournalSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, FileName)
+	j := openJournal(t, dir)
+	if err := j.Advance("web01", StageInventoried); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	// A write that fails leaves the journal on disk as it was
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Advance("web01", StageShutDown); err == nil {
+		t.Fatal("Advance succeeded although the journal could not be written")
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != string(saved) {
+		t.Errorf("journal changed by a failed write: %s, %v", got, err)
+	}
+	if err := os.Remove(path + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unreadable journal is reported instead of starting over
+	if err := os.WriteFile(path, []byte(`[{"name": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir); err == nil || !strings.Contains(err.Error(), "failed to parse state journal") {
+		t.Errorf("Open of a corrupt journal: error = %v", err)
+	}
+}